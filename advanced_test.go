@@ -6,12 +6,16 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"errors"
+	"fmt"
 	"os"
 	"path"
 	"strings"
 	"sync"
 	"testing"
 	"time"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
 )
 
 // Test transaction commit and rollback
@@ -64,6 +68,100 @@ func TestTransactionCommitRollback(t *testing.T) {
 	assert(val == nil, "value should be nil after rollback")
 }
 
+// Test the closure style transactions
+func TestManagedTransactions(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "managed.db")
+
+	db, err := newBolt(fn, "")
+	assert(err == nil, "boltdb: %s", err)
+	defer db.Close()
+
+	err = db.Update(func(tx ebolt.Tx) error {
+		return tx.Set("u/1", []byte("one"))
+	})
+	assert(err == nil, "update: %s", err)
+
+	err = db.View(func(tx ebolt.Tx) error {
+		v, err := tx.Get("u/1")
+		assert(bytes.Equal(v, []byte("one")), "view: content mismatch")
+		return err
+	})
+	assert(err == nil, "view: %s", err)
+
+	// an error rolls back everything
+	oops := errors.New("oops")
+	err = db.Update(func(tx ebolt.Tx) error {
+		if err := tx.Set("u/2", []byte("two")); err != nil {
+			return err
+		}
+		return oops
+	})
+	assert(err == oops, "update: exp oops, saw %v", err)
+
+	_, err = db.Get("u/2")
+	assert(errors.Is(err, ebolt.ErrNotFound), "update: error didn't roll back: %v", err)
+
+	// so does a panic
+	func() {
+		defer func() {
+			assert(recover() != nil, "update: panic was swallowed")
+		}()
+		db.Update(func(tx ebolt.Tx) error {
+			tx.Set("u/3", []byte("three"))
+			panic("oops")
+		})
+	}()
+
+	_, err = db.Get("u/3")
+	assert(errors.Is(err, ebolt.ErrNotFound), "update: panic didn't roll back: %v", err)
+
+	// the db is usable after the panic
+	err = db.Set("u/4", []byte("four"))
+	assert(err == nil, "set after panic: %s", err)
+
+	// the transaction belongs to Update
+	err = db.Update(func(tx ebolt.Tx) error {
+		return tx.Commit()
+	})
+	assert(errors.Is(err, ebolt.ErrTxManaged), "update: exp managed, saw %v", err)
+
+	err = db.View(func(tx ebolt.Tx) error {
+		return tx.Set("u/5", []byte("five"))
+	})
+	assert(errors.Is(err, ebolt.ErrReadOnly), "view: exp read-only, saw %v", err)
+
+	// a failing SetMany leaves nothing behind
+	err = db.SetMany([]ebolt.KV{
+		{Key: "m/1", Val: []byte("one")},
+		{Key: "u/1/x", Val: []byte("under a leaf")},
+	})
+	assert(err != nil, "set-many: wrote under a leaf")
+
+	_, err = db.Get("m/1")
+	assert(errors.Is(err, ebolt.ErrBucketNotFound), "set-many: partial write was committed: %v", err)
+
+	// concurrent batches
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := db.Batch(func(tx ebolt.Tx) error {
+				return tx.Set(fmt.Sprintf("b/%02d", i), []byte{byte(i)})
+			})
+			assert(err == nil, "batch %d: %s", i, err)
+		}(i)
+	}
+	wg.Wait()
+
+	keys, err := db.AllKeys("b")
+	assert(err == nil, "keys: %s", err)
+	assert(len(keys) == 20, "batch: exp 20 keys, saw %d", len(keys))
+}
+
 // Test concurrent transactions
 func TestConcurrentTransactions(t *testing.T) {
 	assert := newAsserter(t)
@@ -165,15 +263,11 @@ func TestEncryptionVerification(t *testing.T) {
 	assert(err == nil, "set: %s", err)
 	db1.Close()
 
-	// Try to open with a different key - should be able to open but data should be unreadable
+	// Try to open with a different key - must fail right away
 	db2, err := newBolt(fn, "other key")
-	assert(err == nil, "open db2: %s", err)
-
-	// Attempt to read the value with the wrong key
-	val, err := db2.Get(testKey)
-	// Either we get an error or nil value, but we shouldn't get the correct data
-	assert(val == nil || !bytes.Equal(val, testValue), "encryption failed: data readable with wrong key")
-	db2.Close()
+	assert(err != nil, "open db2: opened with wrong key")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "open db2: exp wrong-key error, saw %s", err)
+	assert(db2 == nil, "open db2: expected nil db")
 
 	// Reopen with the correct key
 	db3, err := newBolt(fn, "key0")
@@ -181,7 +275,7 @@ func TestEncryptionVerification(t *testing.T) {
 	defer db3.Close()
 
 	// Should be able to read the value
-	val, err = db3.Get(testKey)
+	val, err := db3.Get(testKey)
 	assert(err == nil, "get with correct key: %s", err)
 	assert(bytes.Equal(val, testValue), "value mismatch with correct key")
 
@@ -193,6 +287,87 @@ func TestEncryptionVerification(t *testing.T) {
 	assert(!bytes.Contains(fileData, testValue), "plaintext found in database file")
 }
 
+// Test that records moved to another key-path are rejected
+func TestRelocatedRecord(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "relocate.db")
+
+	db, err := newBolt(fn, "key0")
+	assert(err == nil, "open: %s", err)
+
+	err = db.SetMany([]ebolt.KV{
+		{Key: "a/secret", Val: []byte("secret")},
+		{Key: "b/public", Val: []byte("public")},
+		{Key: "c/x", Val: []byte("x")},
+		{Key: "c/y", Val: []byte("y")},
+	})
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	// with write access to the file: copy a/secret over b/public and
+	// swap c/x and c/y
+	raw, err := bolt.Open(fn, 0600, nil)
+	assert(err == nil, "raw open: %s", err)
+
+	err = raw.Update(func(tx *bolt.Tx) error {
+		var top []*bolt.Bucket
+		tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) != ".ebolt" {
+				top = append(top, bu)
+			}
+			return nil
+		})
+
+		var one, two []*bolt.Bucket
+		for _, bu := range top {
+			switch len(recordKeys(bu)) {
+			case 1:
+				one = append(one, bu)
+			case 2:
+				two = append(two, bu)
+			}
+		}
+		assert(len(one) == 2 && len(two) == 1, "raw: unexpected layout")
+
+		ka, kb := recordKeys(one[0])[0], recordKeys(one[1])[0]
+		va, vb := bytes.Clone(one[0].Get(ka)), bytes.Clone(one[1].Get(kb))
+		if err := one[0].Put(ka, vb); err != nil {
+			return err
+		}
+		if err := one[1].Put(kb, va); err != nil {
+			return err
+		}
+
+		keys := recordKeys(two[0])
+		kx, ky := keys[0], keys[1]
+		vx, vy := bytes.Clone(two[0].Get(kx)), bytes.Clone(two[0].Get(ky))
+		if err := two[0].Put(kx, vy); err != nil {
+			return err
+		}
+		return two[0].Put(ky, vx)
+	})
+	assert(err == nil, "raw update: %s", err)
+	raw.Close()
+
+	db, err = newBolt(fn, "key0")
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	for _, k := range []string{"a/secret", "b/public", "c/x", "c/y"} {
+		_, err = db.Get(k)
+		assert(errors.Is(err, ebolt.ErrIntegrity), "get %s: exp integrity error, saw %v", k, err)
+	}
+
+	for _, d := range []string{"a", "b", "c"} {
+		_, err = db.All(d)
+		assert(errors.Is(err, ebolt.ErrIntegrity), "all %s: exp integrity error, saw %v", d, err)
+		_, err = db.AllKeys(d)
+		assert(errors.Is(err, ebolt.ErrIntegrity), "keys %s: exp integrity error, saw %v", d, err)
+	}
+}
+
 // Test backup and restore
 func TestBackupRestore(t *testing.T) {
 	assert := newAsserter(t)
@@ -302,6 +477,63 @@ func TestErrorHandling(t *testing.T) {
 	assert(err != nil, "dir nonexistent should error")
 }
 
+// Test that every error can be told apart with errors.Is
+func TestErrorKinds(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "kinds.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open db: %s", err)
+
+	err = db.Set("a/b", []byte("value"))
+	assert(err == nil, "set: %s", err)
+
+	_, err = db.Get("a/c")
+	assert(errors.Is(err, ebolt.ErrNotFound), "get missing: exp not-found, saw %v", err)
+
+	var se *ebolt.StorageError
+	assert(errors.As(err, &se) && se.Op == "get" && se.Key == "a/c", "get missing: saw %v", err)
+
+	_, err = db.Get("x/c")
+	assert(errors.Is(err, ebolt.ErrBucketNotFound), "get: exp bucket not-found, saw %v", err)
+
+	for _, fp := range []func(string) error{
+		func(p string) error { _, err := db.All(p); return err },
+		func(p string) error { _, err := db.AllKeys(p); return err },
+		func(p string) error { _, err := db.Dir(p); return err },
+		func(p string) error { return db.Del(p + "/c") },
+	} {
+		err = fp("x")
+		assert(errors.Is(err, ebolt.ErrBucketNotFound), "exp bucket not-found, saw %v", err)
+	}
+
+	tx, err := db.BeginTransaction(false)
+	assert(err == nil, "begin: %s", err)
+	err = tx.Set("a/c", []byte("value"))
+	assert(errors.Is(err, ebolt.ErrReadOnly), "set in read-only tx: exp read-only, saw %v", err)
+	tx.Rollback()
+	db.Close()
+
+	// a corrupted value
+	err = pokeRecord(fn, func(b []byte) {
+		b[len(b)-1] ^= 1
+	})
+	assert(err == nil, "poke: %s", err)
+
+	db, err = newBoltOpt(fn, "key", &ebolt.Config{Bolt: &bolt.Options{ReadOnly: true}})
+	assert(err == nil, "open read-only: %s", err)
+	defer db.Close()
+
+	_, err = db.Get("a/b")
+	assert(errors.Is(err, ebolt.ErrDecrypt), "get corrupt: exp decrypt error, saw %v", err)
+	assert(!errors.Is(err, ebolt.ErrIntegrity), "get corrupt: saw integrity error")
+
+	err = db.Set("a/b", []byte("value"))
+	assert(errors.Is(err, ebolt.ErrReadOnly), "set in read-only db: exp read-only, saw %v", err)
+}
+
 // Test edge cases
 func TestEdgeCases(t *testing.T) {
 	assert := newAsserter(t)
@@ -375,6 +607,34 @@ func TestClosedDB(t *testing.T) {
 	assert(err != nil, "begin tx on closed db should error")
 }
 
+// Test opening with the bbolt options
+func TestOpenOptions(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "opts.db")
+
+	key := make([]byte, 32)
+	crand.Read(key)
+
+	db, err := ebolt.Open(fn, key, &ebolt.Options{Timeout: time.Second})
+	assert(err == nil, "open: %s", err)
+
+	err = db.Set("a/b", []byte("value"))
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	db, err = ebolt.Open(fn, key, &ebolt.Options{ReadOnly: true})
+	assert(err == nil, "open read-only: %s", err)
+	defer db.Close()
+
+	val, err := db.Get("a/b")
+	assert(err == nil && string(val) == "value", "get: %q, %v", val, err)
+
+	err = db.Set("a/b", []byte("value"))
+	assert(errors.Is(err, ebolt.ErrReadOnly), "set in read-only db: exp read-only, saw %v", err)
+}
+
 // Benchmark basic operations
 func BenchmarkBasicOperations(b *testing.B) {
 	assert := newBenchAsserter(b)
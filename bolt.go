@@ -3,49 +3,231 @@
 package ebolt
 
 import (
+	"errors"
 	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
 
+// Options are passed on to bbolt by Open()
 type Options = bolt.Options
 
+// Config controls how a db is opened or created
+type Config struct {
+	// Bolt are passed on to bbolt; nil means its defaults
+	Bolt *bolt.Options
+
+	// Suite is the cipher suite of a new db: one of SuiteAES256GCM
+	// (the default) or SuiteXChaCha20Poly1305. An existing db always
+	// uses the suite it was created with.
+	Suite string
+
+	// KeyDepth gives every bucket of a new db up to this depth a key
+	// of its own; such a bucket can be destroyed with DB.Shred(). A
+	// depth of 1 covers the top-level buckets. The default of 0 encrypts
+	// everything with the data key.
+	KeyDepth int
+
+	// Padding pads the records of a new db to hide their sizes; nil
+	// means no padding. An existing db keeps the policy it was created
+	// with.
+	Padding *Padding
+
+	// KeyCommit makes every value of a new db carry a commitment to
+	// the key that encrypted it (see cipher.go). An existing db keeps
+	// the setting it was created with.
+	KeyCommit bool
+
+	// Flat stores every record of a new db in a single bucket keyed by
+	// a PRF of its key-path; this hides the shape of the bucket tree
+	// (see flat.go). An existing db keeps the layout it was created
+	// with.
+	Flat bool
+
+	// Metadata stores the modification time and size of each record of
+	// a new db alongside it; Stat() reads them without decrypting the
+	// value (see stat.go). An existing db keeps the setting it was
+	// created with.
+	Metadata bool
+
+	// Indexes are the secondary indexes kept by this handle (see
+	// index.go). A write by a handle that doesn't declare an index of
+	// the db makes it stale. Missing and stale indexes are built when
+	// the db is opened for writing.
+	Indexes []Index
+
+	// Sweep runs Sweep() in the background at this interval until the
+	// db is closed (see ttl.go); 0 means it only runs when called. A
+	// read-only db isn't swept.
+	Sweep time.Duration
+
+	// SweepBatch is the most records Sweep() deletes in a single
+	// transaction; 0 means 1024.
+	SweepBatch int
+
+	// SweepError, if set, is called with the error of each background
+	// sweep that fails; the sweep is tried again at the next interval.
+	SweepError func(error)
+}
+
 type bdb struct {
 	db *bolt.DB
 
+	// the options 'db' was opened with; Shred() reopens it
+	bopt *bolt.Options
+
+	// Rekey() and Shred() hold this exclusively while they rewrite
+	// the db; every transaction holds it shared.
+	mu sync.RWMutex
+
 	// encrypts KV
 	c *encryptor
+
+	// the data key behind 'c' and the format header
+	dek []byte
+	h   *header
+
+	// the key slot that unwrapped 'dek'
+	slot string
+
+	// buckets up to this depth have keys of their own; their
+	// encryptors are cached by key id.
+	depth int
+	keys  sync.Map
+
+	// secondary indexes declared by Config.Indexes
+	ix []*index
+
+	// records deleted by each transaction of Sweep()
+	batch int
+
+	// called with the errors of the background sweeper; may be nil
+	sweepErr func(error)
+
+	// closed to stop the background sweeper
+	stop     chan struct{}
+	stopOnce sync.Once
+	wg       sync.WaitGroup
 }
 
 var _ DB = &bdb{}
 
 // Create or open a new encrypted bolt db. The supplied 'key' will
-// be expanded and used to encrypt the values stored in the db. The
-// leaf of a key-path is obfuscated while preserving the intermediate
-// paths in plaintext. This compromise gives us better performance
-// without sacrificing too much privacy.
-func Open(fn string, key []byte, opt *bolt.Options) (DB, error) {
-	db, err := bolt.Open(fn, 0600, opt)
+// be expanded and used to wrap the random data key that encrypts the
+// db (see OpenWithWrapper). The leaf of a key-path is obfuscated while
+// preserving the intermediate paths in plaintext. This compromise gives
+// us better performance without sacrificing too much privacy.
+//
+// A db written by an older version of ebolt is migrated to the current
+// on-disk format when it is opened for writing. 'opt' is passed on to
+// bbolt; use OpenWithConfig() to choose how a new db is encrypted.
+func Open(fn string, key []byte, opt *Options) (DB, error) {
+	return OpenWithConfig(fn, key, &Config{Bolt: opt})
+}
+
+// OpenWithConfig is like Open() but 'cfg' also controls how a new db
+// is encrypted and laid out, and what the handle maintains.
+func OpenWithConfig(fn string, key []byte, cfg *Config) (DB, error) {
+	return OpenWithWrapper(fn, newKeyWrapper(key), cfg)
+}
+
+// Create or open a new encrypted bolt db whose data key is protected
+// by the KeyWrapper 'w'. A new db gets a random data key that is
+// wrapped by 'w' and stored in the db; an existing db is opened by
+// unwrapping its data key with 'w'.
+func OpenWithWrapper(fn string, w KeyWrapper, opt *Config) (DB, error) {
+	if opt == nil {
+		opt = &Config{}
+	}
+
+	db, err := bolt.Open(fn, 0600, opt.Bolt)
 	if err != nil {
 		return nil, fmt.Errorf("db %s: %w", fn, err)
 	}
 
-	c, err := newEncryptor(key)
+	b := &bdb{
+		db:       db,
+		bopt:     opt.Bolt,
+		batch:    opt.SweepBatch,
+		sweepErr: opt.SweepError,
+	}
+	if b.batch <= 0 {
+		b.batch = defaultSweepBatch
+	}
+
+	if b.ix, err = makeIndexes(opt.Indexes); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db %s: %w", fn, err)
+	}
+
+	if err = b.setup(w, opt); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db %s: %w", fn, err)
+	}
+
+	if err = b.buildIndexes(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db %s: %w", fn, err)
+	}
+
+	if opt.Sweep > 0 && !db.IsReadOnly() {
+		b.stop = make(chan struct{})
+		b.wg.Add(1)
+		go b.sweeper(opt.Sweep)
+	}
+	return b, nil
+}
+
+// Create or open a new encrypted bolt db protected by the passphrase
+// 'pass'. A key-encryption key is derived from 'pass' with Argon2id
+// under a random salt; the salt and the cost parameters are stored
+// in the db next to the wrapped data key. A new db uses 'params' -
+// or DefaultArgon2Params if 'params' is nil.
+//
+// Opening an existing db with 'params' that differ from the stored
+// ones rewraps the data key under the new parameters (and a new salt);
+// nothing else is re-encrypted. A nil 'params' keeps what is stored.
+func OpenWithPassphrase(fn string, pass []byte, params *Argon2Params, opt *Config) (DB, error) {
+	p := DefaultArgon2Params
+	if params != nil {
+		p = *params
+	}
+	if !p.valid() {
+		return nil, fmt.Errorf("db %s: %w: argon2id: invalid parameters %+v", fn, ErrConfig, p)
+	}
+
+	w := newPassphraseWrapper(pass, p)
+	db, err := OpenWithWrapper(fn, w, opt)
 	if err != nil {
 		return nil, err
 	}
 
-	b := &bdb{
-		db: db,
-		c:  c,
+	b := db.(*bdb)
+	if params == nil || w.seen == (Argon2Params{}) || w.seen == p || b.db.IsReadOnly() {
+		return db, nil
 	}
 
-	return b, nil
+	if err = b.Rewrap(w); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("db %s: %w", fn, err)
+	}
+	return db, nil
 }
 
 // Close finalizes all transactions and releases database resources.
 func (b *bdb) Close() error {
+	// the sweeper takes the lock; it must be gone before we do
+	if b.stop != nil {
+		b.stopOnce.Do(func() { close(b.stop) })
+		b.wg.Wait()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	return b.db.Close()
 }
 
@@ -56,31 +238,76 @@ func (b *bdb) BeginTransaction(wr bool) (Tx, error) {
 	return b.beginXact(wr)
 }
 
+// View runs 'fn' in a read-only transaction. The transaction is rolled
+// back when 'fn' returns - or panics - and its error is returned.
+func (b *bdb) View(fn func(Tx) error) error {
+	return b.managed("view", (*bolt.DB).View, fn)
+}
+
+// Update runs 'fn' in a read-write transaction. The transaction is
+// committed if 'fn' returns nil; it's rolled back if 'fn' returns an
+// error or panics. The error of 'fn' or of the commit is returned.
+func (b *bdb) Update(fn func(Tx) error) error {
+	return b.managed("update", (*bolt.DB).Update, fn)
+}
+
+// Batch is like Update but concurrent callers may share a single
+// transaction (see bbolt's DB.Batch). If one of them fails, the others
+// are retried: 'fn' may run more than once and must be idempotent.
+func (b *bdb) Batch(fn func(Tx) error) error {
+	return b.managed("batch", (*bolt.DB).Batch, fn)
+}
+
+// run 'fn' in a transaction managed by 'run' - one of bbolt's View,
+// Update or Batch. Errors that don't come from 'fn' - e.g., a failed
+// commit - are returned as a StorageError for 'op'. The db is picked
+// under the lock: Shred() replaces it.
+func (b *bdb) managed(op string, run func(*bolt.DB, func(*bolt.Tx) error) error, fn func(Tx) error) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	var ferr error
+	err := run(b.db, func(tx *bolt.Tx) error {
+		t := b.newXact(tx, nil)
+		t.managed = true
+
+		ferr = fn(t)
+		return ferr
+	})
+	if err != nil && ferr == nil {
+		return &StorageError{op, "", boltErr(err)}
+	}
+	return err
+}
+
 // Get retrieves and decrypts the value stored at the specified path.
 // The path format "a/b/name" is interpreted where intermediate components
 // are buckets and the final component is the key.
 func (b *bdb) Get(p string) ([]byte, error) {
-	tx, err := b.beginXact(false)
-	if err != nil {
-		return nil, err
-	}
-
-	defer tx.Rollback()
+	var v []byte
 
-	return tx.Get(p)
+	err := b.View(func(tx Tx) error {
+		var err error
+		v, err = tx.Get(p)
+		return err
+	})
+	return v, err
 }
 
 // Set encrypts and stores a value at the specified path, automatically
 // creating any intermediate buckets as needed. The leaf component of the
 // path is obfuscated while bucket names remain in plaintext.
 func (b *bdb) Set(p string, v []byte) error {
-	tx, err := b.beginXact(true)
-	if err != nil {
-		return err
-	}
+	return b.Update(func(tx Tx) error {
+		return tx.Set(p, v)
+	})
+}
 
-	defer tx.Commit()
-	return tx.Set(p, v)
+// SetWithTTL is like Set but the record expires after 'ttl'
+func (b *bdb) SetWithTTL(p string, v []byte, ttl time.Duration) error {
+	return b.Update(func(tx Tx) error {
+		return tx.SetWithTTL(p, v, ttl)
+	})
 }
 
 // SetMany encrypts and stores multiple key-value pairs. Each key follows
@@ -89,84 +316,167 @@ func (b *bdb) SetMany(kv []KV) error {
 	if len(kv) == 0 {
 		return nil
 	}
-	if len(kv) == 1 {
-		x := &kv[0]
-		return b.Set(x.Key, x.Val)
-	}
-
-	tx, err := b.beginXact(true)
-	if err != nil {
-		return err
-	}
 
-	defer tx.Commit()
-	return tx.SetMany(kv)
+	return b.Update(func(tx Tx) error {
+		return tx.SetMany(kv)
+	})
 }
 
-// Get retrieves and decrypts the value stored at the specified path.
-// The path format "a/b/name" is interpreted where intermediate components
-// are buckets and the final component is the key.
+// Del removes the encrypted value at the specified path.
 func (b *bdb) Del(p string) error {
-	tx, err := b.beginXact(true)
-	if err != nil {
-		return err
-	}
-
-	defer tx.Commit()
-	return tx.Del(p)
+	return b.Update(func(tx Tx) error {
+		return tx.Del(p)
+	})
 }
 
 // DelMany deletes multiple keys in a single transaction.
 // Each path is processed according to the hierarchical bucket structure.
 func (b *bdb) DelMany(v []string) error {
-	tx, err := b.beginXact(true)
-	if err != nil {
+	return b.Update(func(tx Tx) error {
+		return tx.DelMany(v)
+	})
+}
+
+// DelDir deletes the bucket 'p'. A bucket that isn't empty is deleted
+// - with everything under it - only if 'recursive' is true.
+func (b *bdb) DelDir(p string, recursive bool) error {
+	return b.Update(func(tx Tx) error {
+		return tx.DelDir(p, recursive)
+	})
+}
+
+// Rename moves the record or bucket 'src' to 'dst'
+func (b *bdb) Rename(src, dst string) error {
+	return b.Update(func(tx Tx) error {
+		return tx.Rename(src, dst)
+	})
+}
+
+// Copy copies the record or bucket 'src' to 'dst'
+func (b *bdb) Copy(src, dst string) error {
+	return b.Update(func(tx Tx) error {
+		return tx.Copy(src, dst)
+	})
+}
+
+// Exists returns true if 'p' is a record or a bucket
+func (b *bdb) Exists(p string) (bool, error) {
+	var ok bool
+
+	err := b.View(func(tx Tx) error {
+		var err error
+		ok, err = tx.Exists(p)
 		return err
-	}
+	})
+	return ok, err
+}
+
+// IsDir returns true if 'p' is a bucket
+func (b *bdb) IsDir(p string) (bool, error) {
+	var ok bool
 
-	defer tx.Commit()
-	return tx.DelMany(v)
+	err := b.View(func(tx Tx) error {
+		var err error
+		ok, err = tx.IsDir(p)
+		return err
+	})
+	return ok, err
+}
+
+// Stat describes the record or bucket 'p' without decrypting its value
+func (b *bdb) Stat(p string) (*Info, error) {
+	var fi *Info
+
+	err := b.View(func(tx Tx) error {
+		var err error
+		fi, err = tx.Stat(p)
+		return err
+	})
+	return fi, err
+}
+
+// Lookup returns the key-paths of the records whose value of the index
+// 'name' is 'val'
+func (b *bdb) Lookup(name, val string) ([]string, error) {
+	var ret []string
+
+	err := b.View(func(tx Tx) error {
+		var err error
+		ret, err = tx.Lookup(name, val)
+		return err
+	})
+	return ret, err
 }
 
 // All retrieves all entries within a given bucket path, returning a map
 // of decrypted key-value pairs. The keys in the map are the original
 // unobfuscated key-paths.
 func (b *bdb) All(p string) (map[string][]byte, error) {
-	tx, err := b.beginXact(false)
-	if err != nil {
-		return nil, err
-	}
+	var ret map[string][]byte
 
-	defer tx.Rollback()
-
-	return tx.All(p)
+	err := b.View(func(tx Tx) error {
+		var err error
+		ret, err = tx.All(p)
+		return err
+	})
+	return ret, err
 }
 
 // AllKeys returns all keys within a given bucket path without
 // retrieving their values. The returned keys are the original
 // unobfuscated key-paths.
 func (b *bdb) AllKeys(p string) ([]string, error) {
-	tx, err := b.beginXact(false)
-	if err != nil {
-		return nil, err
-	}
-
-	defer tx.Rollback()
+	var ret []string
 
-	return tx.AllKeys(p)
+	err := b.View(func(tx Tx) error {
+		var err error
+		ret, err = tx.AllKeys(p)
+		return err
+	})
+	return ret, err
 }
 
 // Dir returns all sub-buckets under the specified path without
 // retrieving individual key-value pairs. In boltdb terminology,
 // this returns all sub-buckets of a bucket.
 func (b *bdb) Dir(p string) ([]string, error) {
-	tx, err := b.beginXact(false)
-	if err != nil {
-		return nil, err
-	}
+	var ret []string
 
-	defer tx.Rollback()
-	return tx.Dir(p)
+	err := b.View(func(tx Tx) error {
+		var err error
+		ret, err = tx.Dir(p)
+		return err
+	})
+	return ret, err
+}
+
+// List returns the records in bucket 'p' sorted by leaf name, as
+// selected by 'opt'. When there are more than opt.Limit records, it
+// also returns an opaque token that continues the listing.
+func (b *bdb) List(p string, opt ListOptions) ([]KV, string, error) {
+	var kv []KV
+	var tok string
+
+	err := b.View(func(tx Tx) error {
+		var err error
+		kv, tok, err = tx.List(p, opt)
+		return err
+	})
+	return kv, tok, err
+}
+
+// Find returns the records whose key-paths match 'pattern', sorted by
+// key-path. Segments are matched with path.Match(); a "**" segment
+// matches any number of segments.
+func (b *bdb) Find(pattern string) ([]KV, error) {
+	var kv []KV
+
+	err := b.View(func(tx Tx) error {
+		var err error
+		kv, err = tx.Find(pattern)
+		return err
+	})
+	return kv, err
 }
 
 // Backup performs a live backup of the encrypted database to the provided
@@ -182,6 +492,63 @@ func (b *bdb) Backup(wr io.Writer) (int64, error) {
 	return tx.backup(wr)
 }
 
+// Errors returned by the db and its transactions; they're wrapped in a
+// StorageError and can be tested with errors.Is().
+var (
+	// ErrNotFound is returned when a key-path has no record
+	ErrNotFound = errors.New("not found")
+
+	// ErrBucketNotFound is returned when a bucket (a directory of a
+	// key-path) doesn't exist
+	ErrBucketNotFound = errors.New("bucket not found")
+
+	// ErrDecrypt is returned when a record or name fails to decrypt:
+	// it was corrupted, forged or encrypted with a different key.
+	ErrDecrypt = errors.New("decryption failed")
+
+	// ErrIntegrity is returned when a record doesn't belong where it is
+	// stored: e.g., a ciphertext that was copied or moved to another
+	// key-path by someone with write access to the file.
+	ErrIntegrity = errors.New("integrity check failed")
+
+	// ErrReadOnly is returned when writing to a db opened read-only or
+	// in a read-only transaction
+	ErrReadOnly = errors.New("db is read-only")
+
+	// ErrExists is returned when renaming or copying to a key-path or
+	// bucket that already exists
+	ErrExists = errors.New("already exists")
+
+	// ErrNotEmpty is returned when deleting a bucket that isn't empty
+	// without asking for a recursive delete
+	ErrNotEmpty = errors.New("bucket not empty")
+
+	// ErrIndexNotFound is returned by Lookup() for an index that isn't
+	// declared - or isn't built yet, or is stale, in a read-only db
+	ErrIndexNotFound = errors.New("index not found")
+
+	// ErrConstraint is returned when a write would give two records the
+	// same value of a unique index; the error is a *ConstraintError.
+	ErrConstraint = errors.New("uniqueness constraint violated")
+
+	// ErrTxManaged is returned when a transaction run by View, Update
+	// or Batch is committed or rolled back by hand
+	ErrTxManaged = errors.New("transaction is managed")
+)
+
+// map the errors of bbolt to ours; the original stays in the chain
+func boltErr(err error) error {
+	switch {
+	case err == nil, errors.Is(err, ErrReadOnly), errors.Is(err, ErrBucketNotFound):
+		return err
+	case errors.Is(err, bolt.ErrDatabaseReadOnly), errors.Is(err, bolt.ErrTxNotWritable):
+		return fmt.Errorf("%w: %w", ErrReadOnly, err)
+	case errors.Is(err, bolt.ErrBucketNotFound):
+		return ErrBucketNotFound
+	}
+	return err
+}
+
 type StorageError struct {
 	Op  string
 	Key string
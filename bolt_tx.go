@@ -3,9 +3,13 @@
 package ebolt
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 
 	bolt "go.etcd.io/bbolt"
 )
@@ -14,32 +18,83 @@ type xact struct {
 	*bolt.Tx
 	errs []error
 	c    *encryptor
+	h    *header
+
+	// buckets up to this depth have keys of their own
+	depth int
+	keys  *sync.Map
+
+	// encryptor for the entries of the key table; set on first use
+	tk *encryptor
+
+	// releases the db lock when the transaction ends
+	unlock func()
+
+	// the transaction belongs to View, Update or Batch
+	managed bool
+
+	// secondary indexes kept up to date by writes
+	ix []*index
+
+	// the indexes this handle doesn't declare are marked stale
+	stale bool
 }
 
 var _ Tx = &xact{}
 
 // create a new xact instance and record the encryptor
 func (b *bdb) beginXact(wr bool) (*xact, error) {
+	b.mu.RLock()
 	tx, err := b.db.Begin(wr)
 	if err != nil {
-		return nil, &StorageError{"begin-tx", "", err}
+		b.mu.RUnlock()
+		return nil, &StorageError{"begin-tx", "", boltErr(err)}
 	}
 
+	return b.newXact(tx, b.mu.RUnlock), nil
+}
+
+// wrap the bolt transaction 'tx'; 'unlock' releases the db lock when
+// the transaction ends.
+func (b *bdb) newXact(tx *bolt.Tx, unlock func()) *xact {
 	t := &xact{
-		Tx: tx,
-		c:  b.c,
+		Tx:     tx,
+		c:      b.c,
+		h:      b.h,
+		depth:  b.depth,
+		keys:   &b.keys,
+		unlock: unlock,
+		ix:     b.ix,
 	}
-	return t, nil
+	return t
 }
 
 func (t *xact) Commit() error {
+	if t.managed {
+		return &StorageError{"commit", "", ErrTxManaged}
+	}
+
+	defer t.release()
 	return t.Tx.Commit()
 }
 
 func (t *xact) Rollback() error {
+	if t.managed {
+		return &StorageError{"rollback", "", ErrTxManaged}
+	}
+
+	defer t.release()
 	return t.Tx.Rollback()
 }
 
+// release the db lock; it's safe to call this more than once
+func (t *xact) release() {
+	if t.unlock != nil {
+		t.unlock()
+		t.unlock = nil
+	}
+}
+
 func splitLeaf(p string) []string {
 	v := strings.Split(p, "/")
 	switch len(v) {
@@ -62,200 +117,341 @@ func splitBucket(p string) []string {
 	return strings.Split(p, "/")
 }
 
-func (t *xact) encPath(v []string) [][]byte {
-	z := make([][]byte, len(v))
-	for i := range v {
-		z[i] = t.c.encSegment(v[i])
-	}
-	return z
+// return the canonical form of the key-path 'p': the one that names
+// the same leaf in the same buckets.
+func canonical(p string) string {
+	return strings.Join(splitLeaf(p), "/")
 }
 
-// given a path to a leaf-node (the "K" in KV) - return the intermediate
-// buckets and encrypted leaf
-func (t *xact) leaf2bucket(p string) (*bolt.Bucket, []byte) {
-	v := splitLeaf(p)
-	z := t.encPath(v)
-	n := len(z)
-
-	nm, z := z[n-1], z[:n-1]
+// return the path of a directory given its segments
+func dirPath(v []string) string {
+	return strings.Join(v, "/")
+}
 
-	bu := t.Bucket(z[0])
-	if bu == nil {
-		return nil, nil
-	}
-	for _, x := range z[1:] {
-		if bu = bu.Bucket(x); bu == nil {
-			return nil, nil
-		}
+// return the shortest key-path for the canonical key-path 'p' of a
+// record: the one without ".root/" for a top-level leaf.
+func userPath(p string) string {
+	if nm, ok := strings.CutPrefix(p, ".root/"); ok && !strings.Contains(nm, "/") {
+		return nm
 	}
-	return bu, nm
+	return p
 }
 
-// given a path to a leaf-node (the "K" in KV) - make the intermediate
-// buckets and return encrypted leaf name
-func (t *xact) mkleaf2bucket(p string) (*bolt.Bucket, []byte, error) {
-	v := splitLeaf(p)
-	z := t.encPath(v)
-	n := len(z)
-	nm, z := z[n-1], z[:n-1]
+// verify that the record stored under the encrypted leaf name 'k' in
+// the bucket at 'dir' - whose contents are encrypted by 'c' - was
+// written for the key-path 'nm'
+func verifyLoc(c *encryptor, dir []string, k []byte, nm string) error {
+	v := splitLeaf(nm)
+	n := len(v) - 1
 
-	bu, err := t.CreateBucketIfNotExists(z[0])
-	if err != nil {
-		return nil, nil, &StorageError{"new-bucket", p, err}
+	ok := slices.Equal(v[:n], dir) && bytes.Equal(c.encSegment(v[n]), k)
+	if !ok {
+		return fmt.Errorf("%w: record of %s found elsewhere", ErrIntegrity, nm)
 	}
+	return nil
+}
+
+// descend into the buckets named by 'v'; return the last bucket and
+// the encryptor for its contents. If 'mk' is true, missing buckets are
+// created; else a missing bucket returns a nil bucket.
+func (t *xact) walk(v []string, mk bool) (*bolt.Bucket, *encryptor, error) {
+	var bu *bolt.Bucket
+
+	c := t.c
+	for i, s := range v {
+		nm := c.encSegment(s)
+
+		var sub *bolt.Bucket
+		if i == 0 {
+			sub = t.Bucket(nm)
+		} else {
+			sub = bu.Bucket(nm)
+		}
+
+		fresh := false
+		if sub == nil {
+			if !mk {
+				return nil, nil, nil
+			}
+
+			var err error
+			if i == 0 {
+				sub, err = t.CreateBucket(nm)
+			} else {
+				sub, err = bu.CreateBucket(nm)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			fresh = true
+		}
 
-	for _, x := range z[1:] {
-		if bu, err = bu.CreateBucketIfNotExists(x); err != nil {
-			return nil, nil, &StorageError{"new-bucket", p, err}
+		bu = sub
+		if i < t.depth {
+			var err error
+			if c, err = t.bucketKey(bu, fresh); err != nil {
+				return nil, nil, fmt.Errorf("%s: %w", strings.Join(v[:i+1], "/"), err)
+			}
 		}
 	}
-	return bu, nm, nil
+	return bu, c, nil
 }
 
-// given a dir name, return the encrypted path segments
-func (t *xact) dir2bucket(p string) *bolt.Bucket {
-	v := splitBucket(p)
-	z := t.encPath(v)
+// given a path to a leaf-node (the "K" in KV) - return the intermediate
+// buckets, encrypted leaf and the encryptor for the leaf
+func (t *xact) leaf2bucket(p string) (*bolt.Bucket, []byte, *encryptor, error) {
+	v := splitLeaf(p)
+	n := len(v) - 1
 
-	bu := t.Bucket(z[0])
-	if bu == nil {
-		return nil
+	bu, c, err := t.walk(v[:n], false)
+	if bu == nil || err != nil {
+		return nil, nil, nil, err
 	}
-	for _, x := range z[1:] {
-		if bu = bu.Bucket(x); bu == nil {
-			return nil
-		}
+	return bu, c.encSegment(v[n]), c, nil
+}
+
+// given a path to a leaf-node (the "K" in KV) - make the intermediate
+// buckets and return encrypted leaf name and the encryptor for the leaf
+func (t *xact) mkleaf2bucket(p string) (*bolt.Bucket, []byte, *encryptor, error) {
+	v := splitLeaf(p)
+	n := len(v) - 1
+
+	bu, c, err := t.walk(v[:n], true)
+	if err != nil {
+		return nil, nil, nil, &StorageError{"new-bucket", p, boltErr(err)}
 	}
-	return bu
+	return bu, c.encSegment(v[n]), c, nil
+}
+
+// given a dir name, return its bucket and the encryptor for its
+// contents
+func (t *xact) dir2bucket(p string) (*bolt.Bucket, *encryptor, error) {
+	return t.walk(splitBucket(p), false)
 }
 
 func (t *xact) Get(p string) ([]byte, error) {
-	bu, nm := t.leaf2bucket(p)
+	if t.c.flat {
+		return t.flatGet(p)
+	}
+
+	bu, nm, c, err := t.leaf2bucket(p)
+	if err != nil {
+		return nil, &StorageError{"get", p, boltErr(err)}
+	}
 	if bu == nil {
-		return nil, &StorageError{"get", p, fmt.Errorf("bucket not found for %s", p)}
+		return nil, &StorageError{"get", p, ErrBucketNotFound}
 	}
 	v := bu.Get(nm)
 	if v == nil {
-		return nil, nil
+		return nil, &StorageError{"get", p, ErrNotFound}
 	}
-	_, ret, err := t.c.decryptKV(v)
+	k, ret, exp, err := c.decryptRec(v)
 	if err != nil {
-		return nil, &StorageError{"get", p, err}
+		return nil, &StorageError{"get", p, boltErr(err)}
 	}
-	return ret, nil
-}
 
-func (t *xact) Set(p string, v []byte) error {
-	bu, nm, err := t.mkleaf2bucket(p)
-	if err != nil {
-		return &StorageError{"set", p, err}
+	// the record must have been written for this path; anything else
+	// was moved here from elsewhere.
+	if canonical(k) != canonical(p) {
+		return nil, &StorageError{"get", p, fmt.Errorf("%w: record belongs to %s", ErrIntegrity, k)}
 	}
-	v = t.c.encryptKV(p, v)
-	if err = bu.Put(nm, v); err != nil {
-		return &StorageError{"set", p, err}
+	if expired(exp) {
+		return nil, &StorageError{"get", p, ErrNotFound}
 	}
+	return ret, nil
+}
 
-	return err
+func (t *xact) Set(p string, v []byte) error {
+	return t.put("set", p, v)
 }
 
 func (t *xact) SetMany(kv []KV) error {
-	if len(kv) == 0 {
-		return nil
+	return t.putMany("set-many", kv, nil, nil)
+}
+
+// write the record for 'p' and update the indexes that cover it
+func (t *xact) put(op, p string, v []byte) error {
+	return t.putMany(op, []KV{{p, v}}, nil, nil)
+}
+
+// write the records 'kv' - that expire at the times in 'exp', if it
+// isn't nil - and update the indexes that cover them. The unique
+// indexes are checked before anything is written; the records in
+// 'gone' are about to be removed and don't count.
+func (t *xact) putMany(op string, kv []KV, meta []recMeta, gone map[string]bool) error {
+	var bv [][]blindVals
+
+	if len(t.ix) > 0 {
+		bv = make([][]blindVals, len(kv))
+		for i := range kv {
+			var err error
+			if bv[i], err = t.extract(kv[i].Key, kv[i].Val); err != nil {
+				return &StorageError{op, kv[i].Key, err}
+			}
+		}
+
+		if err := t.checkUnique(kv, bv, gone); err != nil {
+			if ce, ok := err.(*ConstraintError); ok {
+				return &StorageError{op, ce.Key, err}
+			}
+			return &StorageError{op, "", boltErr(err)}
+		}
 	}
-	if len(kv) == 1 {
-		x := &kv[0]
-		return t.Set(x.Key, x.Val)
+
+	// the write goes ahead: the indexes this handle doesn't keep are
+	// stale from now on
+	if err := t.staleIndexes(); err != nil {
+		return &StorageError{op, "", boltErr(err)}
 	}
 
 	for i := range kv {
+		var m recMeta
+		if meta != nil {
+			m = meta[i]
+		}
+
 		w := &kv[i]
-		bu, nm, err := t.mkleaf2bucket(w.Key)
-		if err != nil {
-			return &StorageError{"set-many", w.Key, err}
+		if err := t.putRec(op, w.Key, w.Val, &m); err != nil {
+			return err
+		}
+		if bv == nil {
+			continue
 		}
-		v := t.c.encryptKV(w.Key, w.Val)
-		if err = bu.Put(nm, v); err != nil {
-			return &StorageError{"set-many", w.Key, err}
+		if err := t.index(w.Key, bv[i]); err != nil {
+			return &StorageError{op, w.Key, boltErr(err)}
 		}
 	}
 	return nil
 }
 
-func (t *xact) Del(p string) error {
-	bu, nm := t.leaf2bucket(p)
-	if bu == nil {
-		return &StorageError{"del", p, fmt.Errorf("bucket not found for %s", p)}
+// write the record for 'p' with the modification time and expiry in
+// 'm' and add new records to the sorted index of their bucket. A zero
+// modification time is now.
+func (t *xact) putRec(op, p string, v []byte, m *recMeta) error {
+	if m.mtime.IsZero() {
+		m.mtime = time.Now()
+	}
+	if t.c.flat {
+		return t.flatSet(op, p, v, m)
 	}
 
-	if err := bu.Delete(nm); err != nil {
-		return &StorageError{"del", p, err}
+	bu, nm, c, err := t.mkleaf2bucket(p)
+	if err != nil {
+		return &StorageError{op, p, boltErr(err)}
+	}
+
+	fresh := bu.Get(nm) == nil
+	if err = bu.Put(nm, c.encryptRec(p, v, m.mtime, m.exp)); err != nil {
+		return &StorageError{op, p, boltErr(err)}
+	}
+
+	if fresh {
+		dir := splitLeaf(p)
+		n := len(dir) - 1
+		if err = t.sortedAdd(bu, c, dir[:n], dir[n]); err != nil {
+			return &StorageError{op, p, boltErr(err)}
+		}
 	}
 	return nil
 }
 
+func (t *xact) Del(p string) error {
+	return t.del(p)
+}
+
 func (t *xact) DelMany(v []string) error {
 	for _, p := range v {
-		bu, nm := t.leaf2bucket(p)
-		if bu == nil {
-			return &StorageError{"del", p, fmt.Errorf("bucket not found for %s", p)}
-		}
-		if err := bu.Delete(nm); err != nil {
-			return &StorageError{"del", p, err}
+		if err := t.del(p); err != nil {
+			return err
 		}
 	}
 	return nil
 }
 
-func (t *xact) All(p string) (map[string][]byte, error) {
-	ret := make(map[string][]byte)
-	bu := t.dir2bucket(p)
+// delete the record for 'p' and remove it from the indexes
+func (t *xact) del(p string) error {
+	if err := t.delRec(p); err != nil {
+		return err
+	}
+	if err := t.staleIndexes(); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	if err := t.unindex(p); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	return nil
+}
+
+// delete the record for 'p' and remove it from the sorted index of its
+// bucket
+func (t *xact) delRec(p string) error {
+	if t.c.flat {
+		return t.flatDel(p)
+	}
+
+	bu, nm, c, err := t.leaf2bucket(p)
+	if err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
 	if bu == nil {
-		return nil, &StorageError{"all", p, fmt.Errorf("bucket not found")}
+		return &StorageError{"del", p, ErrBucketNotFound}
 	}
-	err := bu.ForEach(func(_, v []byte) error {
-		nm, v, err := t.c.decryptKV(v)
-		if err != nil {
-			return &StorageError{"all", p, err}
-		}
-		ret[nm] = v
+	if bu.Get(nm) == nil {
 		return nil
-	})
+	}
+
+	if err := bu.Delete(nm); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
 
-	return ret, err
+	dir := splitLeaf(p)
+	n := len(dir) - 1
+	if err = t.sortedDel(bu, c, dir[:n], dir[n]); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	return nil
 }
 
-func (t *xact) AllKeys(p string) ([]string, error) {
-	bu := t.dir2bucket(p)
-	if bu == nil {
-		return nil, &StorageError{"all", p, fmt.Errorf("bucket not found")}
+func (t *xact) All(p string) (map[string][]byte, error) {
+	ret := make(map[string][]byte)
+	err := t.iter("all", p, true, func(nm string, v []byte) bool {
+		ret[nm] = v
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
+	return ret, nil
+}
 
+func (t *xact) AllKeys(p string) ([]string, error) {
 	var keys []string
-	err := bu.ForEach(func(_, v []byte) error {
-		nm, _, err := t.c.decryptKV(v)
-		if err != nil {
-			return &StorageError{"all", p, err}
-		}
+	err := t.iter("all", p, false, func(nm string, _ []byte) bool {
 		keys = append(keys, nm)
-		return nil
+		return true
 	})
-
 	if err != nil {
 		return nil, err
 	}
-
 	return keys, nil
 }
 
 func (t *xact) Dir(p string) ([]string, error) {
-	bu := t.dir2bucket(p)
+	if t.c.flat {
+		return t.flatDirs(p)
+	}
+
+	bu, c, err := t.dir2bucket(p)
+	if err != nil {
+		return nil, &StorageError{"dir", p, boltErr(err)}
+	}
 	if bu == nil {
-		return nil, &StorageError{"all", p, fmt.Errorf("bucket not found")}
+		return nil, &StorageError{"dir", p, ErrBucketNotFound}
 	}
 
 	var ret []string
-	err := bu.ForEachBucket(func(k []byte) error {
-		nm, err := t.c.decSegment(k)
+	err = bu.ForEachBucket(func(k []byte) error {
+		nm, err := c.decSegment(k)
 		if err != nil {
 			return err
 		}
@@ -263,7 +459,7 @@ func (t *xact) Dir(p string) ([]string, error) {
 		return nil
 	})
 	if err != nil {
-		return nil, err
+		return nil, &StorageError{"dir", p, err}
 	}
 	return ret, nil
 }
@@ -9,132 +9,476 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha3"
+	"crypto/subtle"
 	"encoding/binary"
+	"time"
 )
 
 // Encrypting Keys and Values:
 //
-// - We expand the input key into distinct keys for enciphering
+// - The db is encrypted with a random 64-byte data key (DEK); it is
+//   stored in the format header wrapped by a KeyWrapper. Databases
+//   that predate this use sha3-512 of the caller's key as the DEK.
+// - We expand the DEK into distinct keys for enciphering
 //   keys and values separately. We also expand this into a
-//   shared nonce.
+//   key for deriving synthetic nonces.
 // - Each path segment of a given key-path is encrypted separately
-//   with AES-GCM - but with a common nonce for all segments
+//   with the AEAD of the db's cipher suite (see suite.go) under a
+//   synthetic nonce: the nonce is a PRF of the segment itself (SIV).
+//   This keeps the encryption deterministic - so that we can look up
+//   a bucket by its name - while ensuring that distinct segments
+//   never share a nonce.
 // - Values are encrypted with a unique and random nonce
 // - We store a copy of the full unencrypted key-path along with the
-//   plaintext value; both are encrypted and treated as "value".
+//   plaintext value; both are encrypted and treated as "value". Reads
+//   verify the key-path against the record's location; this binds each
+//   ciphertext to where it is stored.
+// - Neither AES-GCM nor XChaCha20-Poly1305 commit to their key: a
+//   ciphertext can be crafted to decrypt validly under more than one
+//   key. A db can opt into key commitment; every value then carries a
+//   tag that binds its nonce to the data key:
+//
+//	tag = cSHAKE256(commit_key, "Value Commitment", nonce)[:32]
+//	ct  = nonce || tag || aead.seal(nonce, klen || k || v)
+//
+//   decryptKV() verifies the tag before opening the AEAD. Finding a
+//   ciphertext that is valid under two keys now requires a collision
+//   in cSHAKE256.
+// - Every value carries its expiry (see ttl.go) - and, if the db opts
+//   into record metadata, its modification time and size (see
+//   stat.go) - sealed on their own with a separate key so that they
+//   can be read without opening the value:
+//
+//	ct = nonce || tag || len [1] || meta_aead.seal(nonce, meta) ||
+//	     aead.seal(nonce, klen || k || v)
+//
+//   Databases created before this have no metadata block.
+//
+// Databases written in formatV0 sealed every segment under a single
+// key-derived nonce; we retain the ability to decode them so that they
+// can be migrated (see migrate.go).
+
+// size of the data key
+const dekSize = 64
+
+// key commitment schemes recorded in the header
+const (
+	commitCSHAKE = "cshake256"
+
+	commitTagSize = 32
+)
 
 type encryptor struct {
-	val   cipher.AEAD
-	key   cipher.AEAD
+	ver uint32
+	val cipher.AEAD
+	key cipher.AEAD
+
+	// formatV1: PRF key for synthetic segment nonces
+	siv []byte
+
+	// formatV1: MAC key for the format header
+	chk []byte
+
+	// formatV1: secret behind the key table of per-bucket keys (see
+	// shred.go)
+	tab []byte
+
+	// formatV1: PRF key for the blind indexes (see index.go)
+	bix []byte
+
+	// key commitment for values; nil if the db doesn't use it
+	commit []byte
+
+	// padding policy for values and segments; nil if the db doesn't
+	// use it
+	pad *Padding
+
+	// the db uses the flat layout (see flat.go)
+	flat bool
+
+	// AEAD for the metadata block of records; nil if the db predates
+	// it
+	meta cipher.AEAD
+
+	// the metadata block records the mtime and size of values
+	stat bool
+
+	// formatV0: common nonce for all segments
 	nonce []byte
 }
 
-// make a new encryptor with the given key
-func newEncryptor(key []byte) (*encryptor, error) {
-	// first compress the key with sha3 to lengthen potentially short keys
-	xpanded := sha3.Sum512(key)
-	keymat := expand(32+32+aes.BlockSize, xpanded[:], "DB Encryption Keys")
+// make a new encryptor from the data key 'dek' for the on-disk format
+// and cipher suite in 'h'
+func newEncryptor(dek []byte, h *header) (*encryptor, error) {
+	if h.ver == formatV0 {
+		return newEncryptorV0(dek)
+	}
+
+	cs, err := suiteByName(h.suite)
+	if err != nil {
+		return nil, err
+	}
+
+	keymat := expand(32+32+32, dek, cs.kdf)
 	defer clear(keymat)
 
 	aekey, keymat := keymat[:32], keymat[32:]
 	ctrkey, keymat := keymat[:32], keymat[32:]
-	iv := keymat
+	sivkey := keymat
 
-	blk0, err := aes.NewCipher(aekey)
+	aead0, err := cs.aead(aekey)
 	if err != nil {
-		return nil, fmt.Errorf("aes: %w", err)
+		return nil, err
 	}
 
-	blk1, err := aes.NewCipher(ctrkey)
+	aead1, err := cs.aead(ctrkey)
 	if err != nil {
-		return nil, fmt.Errorf("aes: %w", err)
+		return nil, err
 	}
 
-	aead0, err := cipher.NewGCM(blk0)
+	c := &encryptor{
+		ver: h.ver,
+		key: aead0,
+		val: aead1,
+		siv: append([]byte{}, sivkey...),
+		chk: expand(32, dek, "DB Key Check"),
+		tab: expand(32, dek, "Bucket Key Table"),
+		bix: expand(32, dek, "Blind Index Key"),
+		pad: h.pad,
+	}
+
+	switch h.commit {
+	case "":
+	case commitCSHAKE:
+		c.commit = expand(32, dek, "DB Commitment Key")
+	default:
+		return nil, fmt.Errorf("%w: key commitment %q", ErrFormat, h.commit)
+	}
+
+	switch h.layout {
+	case "":
+	case layoutFlat:
+		c.flat = true
+	default:
+		return nil, fmt.Errorf("%w: layout %q", ErrFormat, h.layout)
+	}
+
+	switch h.recmeta {
+	case "":
+	case recmetaV1, recmetaExpiry:
+		c.stat = h.recmeta == recmetaV1
+
+		mk := expand(32, dek, "Record Metadata Key")
+		defer clear(mk)
+
+		if c.meta, err = cs.aead(mk); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("%w: record metadata %q", ErrFormat, h.recmeta)
+	}
+	return c, nil
+}
+
+// make an encryptor for the original (formatV0) on-disk format
+func newEncryptorV0(dek []byte) (*encryptor, error) {
+	keymat := expand(32+32+aes.BlockSize, dek, "DB Encryption Keys")
+	defer clear(keymat)
+
+	aekey, keymat := keymat[:32], keymat[32:]
+	ctrkey, keymat := keymat[:32], keymat[32:]
+	iv := keymat
+
+	aead0, err := newGCM(aekey)
 	if err != nil {
-		return nil, fmt.Errorf("aes-gcm: %w", err)
+		return nil, err
 	}
 
-	aead1, err := cipher.NewGCM(blk1)
+	aead1, err := newGCM(ctrkey)
 	if err != nil {
-		return nil, fmt.Errorf("aes-gcm: %w", err)
+		return nil, err
 	}
 
 	c := &encryptor{
+		ver:   formatV0,
 		key:   aead0,
 		val:   aead1,
-		nonce: iv[:aead0.NonceSize()],
+		nonce: append([]byte{}, iv[:aead0.NonceSize()]...),
 	}
 	return c, nil
 }
 
+func newGCM(key []byte) (cipher.AEAD, error) {
+	blk, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("aes: %w", err)
+	}
+
+	aead, err := cipher.NewGCM(blk)
+	if err != nil {
+		return nil, fmt.Errorf("aes-gcm: %w", err)
+	}
+	return aead, nil
+}
+
 // Encrypt one path segment
 func (c *encryptor) encSegment(s string) []byte {
 	nm := []byte(s)
-	z := make([]byte, len(nm)+c.key.Overhead())
+	if c.ver == formatV0 {
+		z := make([]byte, len(nm)+c.key.Overhead())
+		return c.key.Seal(z[:0], c.nonce, nm, nil)
+	}
 
-	ct := c.key.Seal(z[:0], c.nonce, nm, nil)
-	return ct
+	if c.pad != nil {
+		nm = c.pad.segment(nm)
+	}
+
+	nonce := c.segNonce(nm)
+	ct := make([]byte, len(nonce), len(nonce)+len(nm)+c.key.Overhead())
+	copy(ct, nonce)
+	return c.key.Seal(ct, nonce, nm, nil)
 }
 
 // Decrypt one path segment
 func (c *encryptor) decSegment(v []byte) (string, error) {
-	if len(v) < c.key.Overhead() {
-		return "", fmt.Errorf("seg: too short (%d)", len(v))
+	if c.ver == formatV0 {
+		if len(v) < c.key.Overhead() {
+			return "", fmt.Errorf("%w: seg: too short (%d)", ErrDecrypt, len(v))
+		}
+
+		z := make([]byte, len(v)-c.key.Overhead())
+		pt, err := c.key.Open(z[:0], c.nonce, v, nil)
+		if err != nil {
+			return "", fmt.Errorf("%w: seg: %w", ErrDecrypt, err)
+		}
+		return string(pt), nil
 	}
 
-	z := make([]byte, len(v)-c.key.Overhead())
-	pt, err := c.key.Open(z[:0], c.nonce, v, nil)
+	nl := c.key.NonceSize()
+	if len(v) < nl+c.key.Overhead() {
+		return "", fmt.Errorf("%w: seg: too short (%d)", ErrDecrypt, len(v))
+	}
+
+	nonce, ct := v[:nl], v[nl:]
+	pt, err := c.key.Open(nil, nonce, ct, nil)
 	if err != nil {
-		return "", err
+		return "", fmt.Errorf("%w: seg: %w", ErrDecrypt, err)
+	}
+
+	// the nonce must be the one derived from the plaintext; anything
+	// else wasn't produced by encSegment.
+	if subtle.ConstantTimeCompare(c.segNonce(pt), nonce) != 1 {
+		return "", fmt.Errorf("%w: seg: synthetic nonce mismatch", ErrDecrypt)
+	}
+	if c.pad != nil {
+		if pt, err = unpad(pt); err != nil {
+			return "", fmt.Errorf("%w: seg: %w", ErrDecrypt, err)
+		}
 	}
 	return string(pt), nil
 }
 
+// derive the synthetic nonce for segment 'nm'
+func (c *encryptor) segNonce(nm []byte) []byte {
+	return expand(c.key.NonceSize(), c.siv, "Segment SIV", nm)
+}
+
+// MAC the encoded format header 'h'; a mismatch means the header was
+// written with a different key.
+func (c *encryptor) check(h []byte) []byte {
+	return expand(32, c.chk, "DB Header Check", h)
+}
+
+// return the size of the key commitment tag of each value
+func (c *encryptor) tagSize() int {
+	if c.commit == nil {
+		return 0
+	}
+	return commitTagSize
+}
+
+// compute the key commitment tag for 'nonce'
+func (c *encryptor) commitTag(nonce []byte) []byte {
+	return expand(commitTagSize, c.commit, "Value Commitment", nonce)
+}
+
 // Encrypt the key & values for a given kv pair
 func (c *encryptor) encryptKV(k string, v []byte) []byte {
-	nl := c.val.NonceSize()
+	return c.encryptRec(k, v, time.Now(), time.Time{})
+}
+
+// Encrypt the key & values for a given kv pair that was last written at
+// 'mtime' and expires at 'exp'; a zero 'exp' never expires. A db without
+// a metadata block can't keep either.
+func (c *encryptor) encryptRec(k string, v []byte, mtime, exp time.Time) []byte {
+	nl := c.val.NonceSize() + c.tagSize()
 	ov := c.val.Overhead()
 
-	ct := make([]byte, nl+ov+len(k)+len(v)+4)
-	nonce, pt := ct[:nl], ct[nl:]
+	var m []byte
+	if c.meta != nil {
+		m = c.marshalMeta(&recMeta{mtime, int64(len(v)), exp})
+		nl += 1 + len(m) + c.meta.Overhead()
+	}
+
+	// the padding starts with 0x80; the rest is zero
+	n := len(k) + len(v) + 4
+	if c.pad != nil {
+		n = c.pad.size(k, n+1)
+	}
+
+	ct := make([]byte, nl+ov+n)
+	nonce, pt := ct[:c.val.NonceSize()], ct[nl:]
 
 	randfill(nonce)
+	if c.commit != nil {
+		copy(ct[len(nonce):], c.commitTag(nonce))
+	}
+	if c.meta != nil {
+		z := ct[len(nonce)+c.tagSize():]
+		z[0] = byte(len(m) + c.meta.Overhead())
+		c.meta.Seal(z[1:1], nonce, m, []byte(canonical(k)))
+	}
 
 	z := enc32(pt, len(k))
 	z = xcopy(z, k)
 	z = xcopy(z, v)
-	n := cap(pt) - cap(z)
+	if c.pad != nil {
+		z[0] = 0x80
+	}
 
-	z = c.val.Seal(pt[:0], nonce, pt[:n], nil)
+	c.val.Seal(pt[:0], nonce, pt[:n], nil)
 	return ct
 }
 
-// Decrypt the key, value pair in 'ct'
+// Decrypt the key, value pair in 'ct'; a record that has expired
+// returns errExpired.
 func (c *encryptor) decryptKV(ct []byte) (string, []byte, error) {
-	nl := c.val.NonceSize()
-	ov := c.val.Overhead()
+	k, v, exp, err := c.decryptRec(ct)
+	if err == nil && expired(exp) {
+		err = errExpired
+	}
+	return k, v, err
+}
+
+// Decrypt the key, value pair in 'ct' and its expiry; a zero expiry
+// means the record doesn't expire.
+func (c *encryptor) decryptRec(ct []byte) (string, []byte, time.Time, error) {
+	k, v, m, err := c.openRec(ct)
+	return k, v, m.exp, err
+}
+
+// Decrypt the key, value pair in 'ct' and its metadata; the metadata
+// is zero if the db doesn't keep any.
+func (c *encryptor) openRec(ct []byte) (string, []byte, recMeta, error) {
+	var none recMeta
 
+	rec := ct
+	nl, err := c.prefixLen(ct)
+	if err != nil {
+		return "", nil, none, err
+	}
+
+	ov := c.val.Overhead()
 	if len(ct) < (nl + ov + 4) {
-		return "", nil, fmt.Errorf("aes-gcm decrypt: buf len %d too small", len(ct))
+		return "", nil, none, fmt.Errorf("%w: buf len %d too small", ErrDecrypt, len(ct))
 	}
 
+	ns := c.val.NonceSize()
 	pt := make([]byte, len(ct)-ov-4)
-	nonce, ct := ct[:nl], ct[nl:]
+	nonce, tag, ct := ct[:ns], ct[ns:ns+c.tagSize()], ct[nl:]
+
+	if c.commit != nil && subtle.ConstantTimeCompare(c.commitTag(nonce), tag) != 1 {
+		return "", nil, none, fmt.Errorf("%w: key commitment mismatch", ErrDecrypt)
+	}
 
-	pt, err := c.val.Open(pt[:0], nonce, ct, nil)
+	pt, err = c.val.Open(pt[:0], nonce, ct, nil)
 	if err != nil {
-		return "", nil, fmt.Errorf("aes-gcm decrypt: %w", err)
+		return "", nil, none, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+
+	if c.pad != nil {
+		if pt, err = unpad(pt); err != nil {
+			return "", nil, none, fmt.Errorf("%w: %w", ErrDecrypt, err)
+		}
+	}
+	if len(pt) < 4 {
+		return "", nil, none, fmt.Errorf("%w: pt len %d too small", ErrDecrypt, len(pt))
 	}
 
 	z, kl := dec32[int](pt)
 	if len(z) < kl {
-		return "", nil, fmt.Errorf("aes-gcm decrypt: pt len %d too small", len(z))
+		return "", nil, none, fmt.Errorf("%w: pt len %d too small", ErrDecrypt, len(z))
 	}
 
-	k := z[:kl]
+	k := string(z[:kl])
 	v := z[kl:]
-	return string(k), v, nil
+	m, err := c.readMeta(k, rec)
+	if err != nil {
+		return "", nil, none, err
+	}
+	if m == nil {
+		return k, v, none, nil
+	}
+	return k, v, *m, nil
+}
+
+// return the size of what precedes the sealed key & value in the
+// record 'ct': the nonce, commitment tag and metadata
+func (c *encryptor) prefixLen(ct []byte) (int, error) {
+	nl := c.val.NonceSize() + c.tagSize()
+	if c.meta == nil {
+		return nl, nil
+	}
+
+	if len(ct) <= nl {
+		return 0, fmt.Errorf("%w: buf len %d too small", ErrDecrypt, len(ct))
+	}
+	return nl + 1 + int(ct[nl]), nil
+}
+
+// seal an opaque blob 'pt' with the value cipher and a random nonce
+func (c *encryptor) seal(pt []byte) []byte {
+	nl := c.val.NonceSize()
+
+	ct := make([]byte, nl, nl+len(pt)+c.val.Overhead())
+	randfill(ct)
+	return c.val.Seal(ct, ct[:nl], pt, nil)
+}
+
+// open a blob sealed by seal()
+func (c *encryptor) unseal(ct []byte) ([]byte, error) {
+	nl := c.val.NonceSize()
+	if len(ct) < nl+c.val.Overhead() {
+		return nil, fmt.Errorf("%w: unseal: buf len %d too small", ErrDecrypt, len(ct))
+	}
+
+	nonce, ct := ct[:nl], ct[nl:]
+	pt, err := c.val.Open(nil, nonce, ct, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: unseal: %w", ErrDecrypt, err)
+	}
+	return pt, nil
+}
+
+// seal 'pt' like seal() but padded by the padding policy of the db:
+// for blobs - lists of names - whose size would reveal their contents.
+func (c *encryptor) sealPadded(pt []byte) []byte {
+	if c.pad != nil {
+		pt = c.pad.segment(pt)
+	}
+	return c.seal(pt)
+}
+
+// open a blob sealed by sealPadded()
+func (c *encryptor) unsealPadded(ct []byte) ([]byte, error) {
+	pt, err := c.unseal(ct)
+	if c.pad == nil || err != nil {
+		return pt, err
+	}
+	if pt, err = unpad(pt); err != nil {
+		return nil, fmt.Errorf("%w: unseal: %w", ErrDecrypt, err)
+	}
+	return pt, nil
 }
 
 func enc32[T ~int | ~uint | ~int32 | ~uint32](b []byte, v T) []byte {
@@ -147,6 +491,20 @@ func dec32[T ~int | ~uint | ~int32 | ~uint32](b []byte) ([]byte, T) {
 	return b[4:], T(n)
 }
 
+// split a length-prefixed field off the front of 'b'; return the
+// remainder, the field and true if 'b' was long enough.
+func decField(b []byte) ([]byte, []byte, bool) {
+	if len(b) < 4 {
+		return nil, nil, false
+	}
+
+	b, n := dec32[int](b)
+	if len(b) < n {
+		return nil, nil, false
+	}
+	return b[n:], b[:n], true
+}
+
 func xcopy[T ~string | ~[]byte](dst []byte, src T) []byte {
 	n := copy(dst, src)
 	return dst[n:]
@@ -165,6 +523,18 @@ func expand(n int, secret []byte, ctx string, ad ...[]byte) []byte {
 	return out
 }
 
+// make a new random data key
+func newDEK() []byte {
+	return randfill(make([]byte, dekSize))
+}
+
+// derive the data key of a db that predates envelope encryption
+// from the caller's key.
+func legacyDEK(key []byte) []byte {
+	x := sha3.Sum512(key)
+	return x[:]
+}
+
 func randfill(b []byte) []byte {
 	if _, err := rand.Read(b); err != nil {
 		panic(fmt.Sprintf("rand: %s", err))
@@ -0,0 +1,96 @@
+// codec.go -- encoding typed values to and from record values
+
+package ebolt
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+)
+
+// Codec converts typed values to and from the values of records (see
+// Collection). Marshal and Unmarshal are given pointers to the value.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(b []byte, v any) error
+}
+
+// JSONCodec encodes values with encoding/json
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(b []byte, v any) error {
+	return json.Unmarshal(b, v)
+}
+
+// GobCodec encodes values with encoding/gob. Each value is encoded on
+// its own and carries the description of its type.
+type GobCodec struct{}
+
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(b []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(b)).Decode(v)
+}
+
+// BinaryCodec is a compact encoding without any description of the
+// type. It uses the value's own binary encoding if it has one
+// (encoding.BinaryMarshaler and encoding.BinaryUnmarshaler); strings and
+// byte slices are stored as is; anything else must be fixed-size data -
+// numbers, bools and arrays or structs of them - and is encoded with
+// encoding/binary in little-endian order.
+type BinaryCodec struct{}
+
+func (BinaryCodec) Marshal(v any) ([]byte, error) {
+	switch x := v.(type) {
+	case encoding.BinaryAppender:
+		return x.AppendBinary(nil)
+	case encoding.BinaryMarshaler:
+		return x.MarshalBinary()
+	case *string:
+		return []byte(*x), nil
+	case *[]byte:
+		return *x, nil
+	}
+	return binary.Append(nil, binary.LittleEndian, v)
+}
+
+func (BinaryCodec) Unmarshal(b []byte, v any) error {
+	switch x := v.(type) {
+	case encoding.BinaryUnmarshaler:
+		return x.UnmarshalBinary(b)
+	case *string:
+		*x = string(b)
+		return nil
+	case *[]byte:
+		*x = bytes.Clone(b)
+		return nil
+	}
+
+	n, err := binary.Decode(b, binary.LittleEndian, v)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return fmt.Errorf("binary: %d trailing bytes", len(b)-n)
+	}
+	return nil
+}
+
+var (
+	_ Codec = JSONCodec{}
+	_ Codec = GobCodec{}
+	_ Codec = BinaryCodec{}
+)
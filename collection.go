@@ -0,0 +1,193 @@
+// collection.go -- typed records of a bucket
+
+package ebolt
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Collection is a bucket whose records hold values of type T; a Codec
+// converts them to and from the bytes that are stored. Each record is
+// named by an id: the last segment of its key-path.
+//
+// A Collection works on a DB - where each call is a transaction of its
+// own - or within a Tx. It isn't safe for concurrent use.
+//
+// On a DB, All() reads the records a page at a time, each page in a
+// read-only transaction of its own; no transaction is held while the
+// loop body runs, so it can write to the db. The records written ahead
+// of the iteration are seen as they are when their page is read. Use a
+// Collection of a Tx to iterate over a consistent snapshot.
+type Collection[T any] struct {
+	ops   Ops
+	dir   string
+	codec Codec
+	err   error
+}
+
+// number of records All() reads in each transaction on a DB
+const collectionPage = 256
+
+// NewCollection returns the collection of values of type T in the
+// bucket 'dir' of 'ops' - a DB or a Tx. A nil 'codec' means JSONCodec.
+func NewCollection[T any](ops Ops, dir string, codec Codec) *Collection[T] {
+	if codec == nil {
+		codec = JSONCodec{}
+	}
+	return &Collection[T]{
+		ops:   ops,
+		dir:   strings.Trim(dir, "/"),
+		codec: codec,
+	}
+}
+
+// Put encodes 'v' and stores it as the record 'id'
+func (c *Collection[T]) Put(id string, v T) error {
+	p, err := c.key("put", id)
+	if err != nil {
+		return err
+	}
+
+	b, err := c.codec.Marshal(&v)
+	if err != nil {
+		return &StorageError{"put", p, err}
+	}
+	return c.ops.Set(p, b)
+}
+
+// Get returns the value of the record 'id'
+func (c *Collection[T]) Get(id string) (T, error) {
+	var v T
+
+	p, err := c.key("get", id)
+	if err != nil {
+		return v, err
+	}
+
+	b, err := c.ops.Get(p)
+	if err != nil {
+		return v, err
+	}
+	if err = c.codec.Unmarshal(b, &v); err != nil {
+		return v, &StorageError{"get", p, err}
+	}
+	return v, nil
+}
+
+// Del deletes the record 'id'
+func (c *Collection[T]) Del(id string) error {
+	p, err := c.key("del", id)
+	if err != nil {
+		return err
+	}
+	return c.ops.Del(p)
+}
+
+// All returns an iterator over the ids and values of the records of the
+// collection; a collection whose bucket doesn't exist is empty. An
+// error ends the iteration and is returned by Err().
+func (c *Collection[T]) All() iter.Seq2[string, T] {
+	return func(yield func(string, T) bool) {
+		each := func(p string, b []byte) (bool, error) {
+			var v T
+			if err := c.codec.Unmarshal(b, &v); err != nil {
+				return false, &StorageError{"all", p, err}
+			}
+			return yield(path.Base(p), v), nil
+		}
+
+		c.err = c.each(each)
+		if errors.Is(c.err, ErrBucketNotFound) {
+			c.err = nil
+		}
+	}
+}
+
+// Err returns the error that ended the last All(); nil if it ran to
+// completion or was stopped by the caller.
+func (c *Collection[T]) Err() error {
+	return c.err
+}
+
+// call 'fn' for every record of the collection until it returns false
+// or an error
+func (c *Collection[T]) each(fn func(p string, b []byte) (bool, error)) error {
+	run := func(tx Tx) error {
+		for p, b := range tx.Iter(c.dir) {
+			more, err := fn(p, b)
+			if !more || err != nil {
+				return err
+			}
+		}
+		return tx.Err()
+	}
+
+	switch o := c.ops.(type) {
+	case Tx:
+		return run(o)
+	case DB:
+		return c.pages(o, fn)
+	}
+
+	// some other implementation of Ops
+	m, err := c.ops.All(c.dir)
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(m))
+	for p := range m {
+		keys = append(keys, p)
+	}
+	slices.Sort(keys)
+
+	for _, p := range keys {
+		more, err := fn(p, m[p])
+		if !more || err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// call 'fn' for every record of the collection in 'db' until it returns
+// false or an error; each page of records is read by its own List() so
+// that no transaction is open while 'fn' runs. The pages continue after
+// the id last seen rather than with a List() token: a token doesn't
+// survive a Rekey() between pages.
+func (c *Collection[T]) pages(db DB, fn func(p string, b []byte) (bool, error)) error {
+	opt := ListOptions{Limit: collectionPage}
+	for {
+		kv, tok, err := db.List(c.dir, opt)
+		if err != nil {
+			return err
+		}
+
+		for i := range kv {
+			more, err := fn(kv[i].Key, kv[i].Val)
+			if !more || err != nil {
+				return err
+			}
+		}
+		if len(tok) == 0 {
+			return nil
+		}
+		opt.After = path.Base(kv[len(kv)-1].Key)
+	}
+}
+
+// return the key-path of the record 'id'
+func (c *Collection[T]) key(op, id string) (string, error) {
+	if len(id) == 0 || strings.Contains(id, "/") {
+		return "", &StorageError{op, id, fmt.Errorf("invalid id %q", id)}
+	}
+	if len(c.dir) == 0 {
+		return id, nil
+	}
+	return c.dir + "/" + id, nil
+}
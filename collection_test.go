@@ -0,0 +1,206 @@
+// collection_test.go -- typed collection tests
+
+package ebolt_test
+
+import (
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/opencoff/ebolt"
+)
+
+type point struct {
+	X, Y int32
+	Up   bool
+}
+
+func TestCollection(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	codecs := map[string]ebolt.Codec{
+		"json": ebolt.JSONCodec{},
+		"gob":  ebolt.GobCodec{},
+		"bin":  ebolt.BinaryCodec{},
+	}
+
+	for _, flat := range []bool{false, true} {
+		for name, codec := range codecs {
+			fn := path.Join(tmp, fmt.Sprintf("coll-%s-%v.db", name, flat))
+
+			db, err := newBoltOpt(fn, "key", &ebolt.Config{Flat: flat})
+			assert(err == nil, "%s: open: %s", name, err)
+
+			pts := ebolt.NewCollection[point](db, "shapes/points", codec)
+
+			// nothing is there yet
+			n := 0
+			for range pts.All() {
+				n++
+			}
+			assert(pts.Err() == nil && n == 0, "%s: all of empty: %d, %v", name, n, pts.Err())
+
+			exp := make(map[string]point)
+			for i := range 10 {
+				id := fmt.Sprintf("p%02d", i)
+				exp[id] = point{int32(i), int32(-i), i%2 == 0}
+
+				err = pts.Put(id, exp[id])
+				assert(err == nil, "%s: put %s: %s", name, id, err)
+			}
+
+			p, err := pts.Get("p03")
+			assert(err == nil, "%s: get: %s", name, err)
+			assert(p == exp["p03"], "%s: get: exp %v, saw %v", name, exp["p03"], p)
+
+			_, err = pts.Get("p99")
+			assert(errors.Is(err, ebolt.ErrNotFound), "%s: get missing: %v", name, err)
+
+			err = pts.Put("a/b", point{})
+			assert(err != nil, "%s: put: accepted an id with a /", name)
+
+			var ids []string
+			for id, p := range pts.All() {
+				assert(p == exp[id], "%s: all %s: exp %v, saw %v", name, id, exp[id], p)
+				ids = append(ids, id)
+			}
+			assert(pts.Err() == nil, "%s: all: %s", name, pts.Err())
+			assert(len(ids) == len(exp), "%s: all: exp %d, saw %d", name, len(exp), len(ids))
+
+			// the caller can stop early
+			n = 0
+			for range pts.All() {
+				n++
+				break
+			}
+			assert(pts.Err() == nil && n == 1, "%s: all: stop: %d, %v", name, n, pts.Err())
+
+			// on a db, the loop body can write
+			n = 0
+			for id, p := range pts.All() {
+				p.X += 100
+				err = pts.Put(id, p)
+				assert(err == nil, "%s: put in loop %s: %s", name, id, err)
+				if n == 0 {
+					nk := sha3.Sum256([]byte(id))
+					err = db.Rekey(nk[:])
+					assert(err == nil, "%s: rekey in loop: %s", name, err)
+				}
+				n++
+			}
+			assert(pts.Err() == nil && n == len(exp), "%s: all: write: %d, %v", name, n, pts.Err())
+
+			for id, p := range pts.All() {
+				assert(p.X == exp[id].X+100, "%s: all %s: exp X %d, saw %d", name, id, exp[id].X+100, p.X)
+			}
+
+			err = pts.Del("p03")
+			assert(err == nil, "%s: del: %s", name, err)
+
+			// within a transaction
+			err = db.Update(func(tx ebolt.Tx) error {
+				pts := ebolt.NewCollection[point](tx, "shapes/points", codec)
+				if err := pts.Put("p03", point{X: 42}); err != nil {
+					return err
+				}
+
+				n := 0
+				for range pts.All() {
+					n++
+				}
+				assert(n == len(exp), "%s: tx all: exp %d, saw %d", name, len(exp), n)
+				return pts.Err()
+			})
+			assert(err == nil, "%s: update: %s", name, err)
+
+			p, err = pts.Get("p03")
+			assert(err == nil && p.X == 42, "%s: get after update: %v, %v", name, p, err)
+
+			// a value that doesn't decode ends the iteration
+			err = db.Set("shapes/points/bad", []byte("x"))
+			assert(err == nil, "%s: set: %s", name, err)
+
+			for range pts.All() {
+			}
+			assert(pts.Err() != nil, "%s: all: undecodable value went unnoticed", name)
+			db.Close()
+		}
+	}
+}
+
+func TestCollectionPages(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "coll-pages.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	defer db.Close()
+
+	// more records than All() reads in one transaction
+	const n = 600
+
+	pts := ebolt.NewCollection[point](db, "points", nil)
+	for i := range n {
+		err = pts.Put(fmt.Sprintf("p%04d", i), point{X: int32(i)})
+		assert(err == nil, "put: %s", err)
+	}
+
+	// each record is seen once, even as records are added and deleted
+	// around the iteration
+	seen := make(map[string]bool)
+	for id, p := range pts.All() {
+		assert(!seen[id], "all: %s seen twice", id)
+		seen[id] = true
+
+		want := fmt.Sprintf("p%04d", p.X)
+		assert(id == want, "all: exp %s, saw %s", want, id)
+
+		err = pts.Del(id)
+		assert(err == nil, "del %s: %s", id, err)
+		err = pts.Put("a"+id, p)
+		assert(err == nil, "put: %s", err)
+	}
+	assert(pts.Err() == nil && len(seen) == n, "all: saw %d, %v", len(seen), pts.Err())
+}
+
+func TestBinaryCodec(t *testing.T) {
+	assert := newAsserter(t)
+
+	c := ebolt.BinaryCodec{}
+
+	s := "hello"
+	b, err := c.Marshal(&s)
+	assert(err == nil && string(b) == s, "string: %q, %v", b, err)
+
+	var s2 string
+	err = c.Unmarshal(b, &s2)
+	assert(err == nil && s2 == s, "string: %q, %v", s2, err)
+
+	// types that have their own encoding use it
+	now := time.Now().Truncate(0)
+	b, err = c.Marshal(&now)
+	assert(err == nil, "time: %s", err)
+
+	var then time.Time
+	err = c.Unmarshal(b, &then)
+	assert(err == nil && then.Equal(now), "time: exp %s, saw %s; %v", now, then, err)
+
+	// fixed-size data is encoded without any overhead
+	pt := point{1, 2, true}
+	b, err = c.Marshal(&pt)
+	assert(err == nil && len(b) == 9, "point: %d bytes, %v", len(b), err)
+
+	err = c.Unmarshal(append(b, 0), &pt)
+	assert(err != nil, "point: trailing bytes accepted")
+
+	m := map[string]int{}
+	_, err = c.Marshal(&m)
+	assert(err != nil, "map: encoded a value that isn't fixed-size")
+}
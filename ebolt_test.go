@@ -6,6 +6,7 @@ import (
 	"bytes"
 	crand "crypto/rand"
 	"crypto/sha3"
+	"errors"
 	"fmt"
 	"math/rand/v2"
 	"path"
@@ -16,6 +17,10 @@ import (
 )
 
 func newBolt(fn string, pw string) (ebolt.DB, error) {
+	return newBoltOpt(fn, pw, nil)
+}
+
+func newBoltOpt(fn string, pw string, opt *ebolt.Config) (ebolt.DB, error) {
 	var key [32]byte
 
 	if len(pw) == 0 {
@@ -26,7 +31,7 @@ func newBolt(fn string, pw string) (ebolt.DB, error) {
 		h.Sum(key[:0])
 	}
 
-	return ebolt.Open(fn, key[:], nil)
+	return ebolt.OpenWithConfig(fn, key[:], opt)
 }
 
 func TestSetGetOne(t *testing.T) {
@@ -105,7 +110,7 @@ func TestSetGetAll(t *testing.T) {
 			assert(err == nil, "del: %s: %s", nm, err)
 
 			v, err := db.Get(nm)
-			assert(err == nil, "get: %s: %s", nm, err)
+			assert(errors.Is(err, ebolt.ErrNotFound), "get: %s: exp not-found, saw %v", nm, err)
 			assert(v == nil, "get: %s: expected to be deleted", nm)
 		}
 	}
@@ -237,7 +242,7 @@ func TestMany(t *testing.T) {
 	// now these shouldn't exist
 	for _, nm := range paths {
 		v, err := db.Get(nm)
-		assert(err == nil, "get-after-del: %s", err)
+		assert(errors.Is(err, ebolt.ErrNotFound), "get-after-del: exp not-found, saw %v", err)
 		assert(len(v) == 0, "get-after-del: found %s: %x\n", nm, v)
 	}
 }
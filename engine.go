@@ -5,12 +5,15 @@
 // "dir" is a boltdb bucket. And the last part of the key-path is the
 // a "key" in the last bucket.
 //
-// All values stored in the db are encrypted with AES-256-GCM.
+// All values stored in the db are encrypted with AES-256-GCM or
+// XChaCha20-Poly1305.
 // The last part of the key-path is obfuscated with its MAC.
 package ebolt
 
 import (
 	"io"
+	"iter"
+	"time"
 )
 
 // KV represents a "key, value" pair for storage operations
@@ -23,7 +26,8 @@ type KV struct {
 type Ops interface {
 	// Get retrieves and decrypts the value stored at the specified path.
 	// The path format "a/b/name" is interpreted where intermediate components
-	// are buckets and the final component is the key.
+	// are buckets and the final component is the key. A missing key
+	// returns ErrNotFound; a missing bucket returns ErrBucketNotFound.
 	Get(p string) ([]byte, error)
 
 	// Set encrypts and stores a value at the specified path, automatically
@@ -31,17 +35,52 @@ type Ops interface {
 	// path is obfuscated while bucket names remain in plaintext.
 	Set(p string, v []byte) error
 
+	// SetWithTTL is like Set but the record expires after 'ttl': reads
+	// treat it as absent from then on. Sweep() deletes it.
+	SetWithTTL(p string, v []byte, ttl time.Duration) error
+
 	// SetMany encrypts and stores multiple key-value pairs. Each key follows
 	// the path format with automatic bucket creation.
 	SetMany(v []KV) error
 
-	// Del removes the encrypted value at the specified path.
+	// Del removes the encrypted value at the specified path. Deleting a
+	// missing key isn't an error; a missing bucket is.
 	Del(p string) error
 
 	// DelMany deletes multiple keys in a single transaction.
 	// Each path is processed according to the hierarchical bucket structure.
 	DelMany(v []string) error
 
+	// DelDir deletes the bucket 'p'. A bucket that isn't empty is
+	// deleted - with everything under it - only if 'recursive' is true;
+	// else it returns ErrNotEmpty.
+	DelDir(p string, recursive bool) error
+
+	// Rename moves the record or bucket 'src' - with everything under
+	// it - to 'dst', which must not exist. Each record is re-encrypted
+	// for its new key-path.
+	Rename(src, dst string) error
+
+	// Copy copies the record or bucket 'src' - with everything under
+	// it - to 'dst', which must not exist. Each record is re-encrypted
+	// for its new key-path.
+	Copy(src, dst string) error
+
+	// Exists returns true if 'p' is a record or a bucket; values aren't
+	// decrypted.
+	Exists(p string) (bool, error)
+
+	// IsDir returns true if 'p' is a bucket
+	IsDir(p string) (bool, error)
+
+	// Stat describes the record or bucket 'p' without decrypting its
+	// value. A missing key-path returns ErrNotFound.
+	Stat(p string) (*Info, error)
+
+	// Lookup returns the key-paths of the records whose value of the
+	// index 'name' is 'val', sorted (see Config.Indexes).
+	Lookup(name, val string) ([]string, error)
+
 	// All retrieves all entries within a given bucket path, returning a map
 	// of decrypted key-value pairs. The keys in the map are the original
 	// unobfuscated keys (including their full path).
@@ -56,6 +95,16 @@ type Ops interface {
 	// retrieving individual key-value pairs. In boltdb terminology,
 	// this returns all sub-buckets of a bucket.
 	Dir(p string) ([]string, error)
+
+	// List returns the records in bucket 'p' sorted by leaf name, as
+	// selected by 'opt'. When there are more than opt.Limit records, it
+	// also returns an opaque token that continues the listing.
+	List(p string, opt ListOptions) ([]KV, string, error)
+
+	// Find returns the records whose key-paths match 'pattern', sorted
+	// by key-path. Segments are matched with path.Match(); a "**"
+	// segment matches any number of segments.
+	Find(pattern string) ([]KV, error)
 }
 
 // DB interface extends Ops with database management functionality
@@ -71,10 +120,61 @@ type DB interface {
 	// but write transactions are exclusive.
 	BeginTransaction(writable bool) (Tx, error)
 
+	// View runs 'fn' in a read-only transaction that is rolled back
+	// when 'fn' returns or panics. The error of 'fn' is returned.
+	View(fn func(Tx) error) error
+
+	// Update runs 'fn' in a read-write transaction. The transaction is
+	// committed if 'fn' returns nil and rolled back if it returns an
+	// error or panics. The error of 'fn' or of the commit is returned.
+	Update(fn func(Tx) error) error
+
+	// Batch is like Update but lets concurrent callers share one
+	// transaction. 'fn' may be retried and must be idempotent.
+	Batch(fn func(Tx) error) error
+
 	// Backup performs a live backup of the encrypted database to the provided
 	// io.Writer, returning the number of bytes written. The database remains
 	// usable during the backup process.
 	Backup(wr io.Writer) (int64, error)
+
+	// Rekey re-encrypts every bucket name and value under a new, random
+	// data key - and new bucket keys, see Config.KeyDepth - and wraps it
+	// with 'key'. The database stays open while this happens; other
+	// transactions wait for it to complete. A Rekey interrupted by a
+	// crash is completed the next time the database is opened with
+	// either the old or the new key.
+	Rekey(key []byte) error
+
+	// Rewrap protects the data key with 'w' instead of the key the
+	// database was opened with. Nothing else is re-encrypted.
+	Rewrap(w KeyWrapper) error
+
+	// AddKeySlot stores the data key wrapped by 'w' in a new key slot
+	// called 'name'; the database can then be opened with any of its
+	// key slots. Nothing is re-encrypted.
+	AddKeySlot(name string, w KeyWrapper) error
+
+	// RemoveKeySlot revokes the key slot called 'name'. The last key
+	// slot can't be removed.
+	RemoveKeySlot(name string) error
+
+	// ListKeySlots returns the key slots of the database.
+	ListKeySlots() ([]KeySlot, error)
+
+	// Shred deletes the bucket 'p' along with its own key and replaces
+	// the file with a copy that holds neither; the old file is
+	// overwritten with zeros. It's best effort: copies of the file and
+	// blocks the filesystem keeps behind are out of its reach. Only
+	// buckets up to Config.KeyDepth have keys of their own. Other
+	// transactions wait for it to complete.
+	Shred(p string) error
+
+	// Sweep deletes the records that have expired (see SetWithTTL) in
+	// write transactions of at most Config.SweepBatch records each; it
+	// returns the number of records deleted. Config.Sweep runs it in
+	// the background.
+	Sweep() (int, error)
 }
 
 // Tx interface represents an active transaction. This enables callers to perform
@@ -90,4 +190,24 @@ type Tx interface {
 	// Rollback discards all changes made within this transaction.
 	// After calling Rollback, the transaction is no longer usable.
 	Rollback() error
+
+	// Iter returns an iterator over the key-paths and values of the
+	// records in bucket 'p'. Values are decrypted lazily as it advances;
+	// the caller can stop early. An error ends the iteration and is
+	// returned by Err().
+	Iter(p string) iter.Seq2[string, []byte]
+
+	// Keys returns an iterator over the key-paths of the records in
+	// bucket 'p' without returning their values. An error ends the
+	// iteration and is returned by Err().
+	Keys(p string) iter.Seq[string]
+
+	// Err returns the error that ended the last Iter() or Keys().
+	Err() error
+
+	// Walk calls 'fn' for every bucket and record below the bucket 'p' -
+	// or below the top of the db if 'p' is empty - in lexical order.
+	// 'fn' can return fs.SkipDir or fs.SkipAll to prune the walk; 'opt'
+	// limits its depth and can skip decrypting values.
+	Walk(p string, opt WalkOptions, fn WalkFunc) error
 }
@@ -0,0 +1,120 @@
+// export_test.go -- expose internals to the tests
+
+package ebolt
+
+import (
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	FormatV0      = formatV0
+	FormatV1      = formatV1
+	FormatVersion = formatVersion
+)
+
+// EncSegment encrypts the path segment 's' with 'key' in format 'ver'
+func EncSegment(key []byte, ver uint32, s string) []byte {
+	c, err := newEncryptor(legacyDEK(key), newHeader().as(ver))
+	if err != nil {
+		panic(err)
+	}
+	return c.encSegment(s)
+}
+
+// WriteV0 creates a db in the original (formatV0) on-disk format
+func WriteV0(fn string, key []byte, kv []KV) error {
+	c, err := newEncryptor(legacyDEK(key), newHeader().as(formatV0))
+	if err != nil {
+		return err
+	}
+
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, x := range kv {
+			v := splitLeaf(x.Key)
+			bu, err := tx.CreateBucketIfNotExists(c.encSegment(v[0]))
+			if err != nil {
+				return err
+			}
+			for _, nm := range v[1 : len(v)-1] {
+				if bu, err = bu.CreateBucketIfNotExists(c.encSegment(nm)); err != nil {
+					return err
+				}
+			}
+			err = bu.Put(c.encSegment(v[len(v)-1]), c.encryptKV(x.Key, x.Val))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Version returns the on-disk format version of the db in 'fn'
+func Version(fn string) (uint32, error) {
+	db, err := bolt.Open(fn, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var ver uint32
+	err = db.View(func(tx *bolt.Tx) error {
+		h, _, err := readHeader(tx)
+		if err == nil {
+			ver = h.ver
+		}
+		return err
+	})
+	return ver, err
+}
+
+// InterruptRekey starts moving 'd' to 'key' but gives up after moving
+// 'n' records - as if the process had crashed.
+func InterruptRekey(d DB, key []byte, n int) error {
+	b := d.(*bdb)
+	cur, _, _, err := b.startRekey(newDEK(), newKeyWrapper(key))
+	if err != nil {
+		return err
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		_, err := reencryptTx(tx, b.h, b.c, cur, n)
+		return err
+	})
+}
+
+// PassphraseParams returns the Argon2id parameters of the key slot
+// called 'slot' in the db in 'fn'.
+func PassphraseParams(fn string, slot string) (Argon2Params, error) {
+	var p Argon2Params
+
+	db, err := bolt.Open(fn, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return p, err
+	}
+	defer db.Close()
+
+	err = db.View(func(tx *bolt.Tx) error {
+		h, _, err := readHeader(tx)
+		if err != nil {
+			return err
+		}
+		for _, ks := range h.slots {
+			if ks.name == slot {
+				z := ks.dek[argonSaltLen:]
+				z, p.Time = dec32[uint32](z)
+				z, p.Memory = dec32[uint32](z)
+				p.Threads = z[0]
+				return nil
+			}
+		}
+		return ErrKeySlotNotFound
+	})
+	return p, err
+}
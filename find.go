@@ -0,0 +1,346 @@
+// find.go -- glob queries over key-paths
+
+package ebolt
+
+import (
+	"path"
+	"slices"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Find returns the records whose key-paths match 'pattern', sorted by
+// key-path. Each segment of the pattern is matched against a segment
+// of the key-path with path.Match(); a "**" segment matches any number
+// of segments - including none. A pattern without a "/" matches the
+// top-level records, just like Get().
+//
+// Only the names of buckets and records are decrypted as the pattern
+// is matched; values are decrypted for matching records alone.
+func (t *xact) Find(pattern string) ([]KV, error) {
+	pat := strings.Split(pattern, "/")
+	if len(pat) == 1 && pat[0] != "**" {
+		pat = splitLeaf(pattern)
+	}
+
+	for _, s := range pat {
+		if _, err := path.Match(s, ""); err != nil {
+			return nil, &StorageError{"find", pattern, err}
+		}
+	}
+
+	root, err := t.nodeAt(nil)
+	if err != nil {
+		return nil, &StorageError{"find", pattern, boltErr(err)}
+	}
+	if root == nil {
+		return nil, nil
+	}
+
+	f := &finder{
+		seen: make(map[string]bool),
+	}
+	if err = f.find(root, nil, pat); err != nil {
+		return nil, &StorageError{"find", pattern, err}
+	}
+
+	slices.SortFunc(f.kv, func(a, b KV) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+	return f.kv, nil
+}
+
+// findNode is a directory visited by Find() and Walk()
+type findNode interface {
+	// return the names of the sub-directories - or of the records
+	names(dirs bool) ([]string, error)
+
+	// return the sub-directory 'nm'; nil if it doesn't exist
+	sub(nm string) (findNode, error)
+
+	// return the value of the record 'nm' and its metadata; nil if it
+	// doesn't exist and errExpired if it has expired
+	read(nm string) ([]byte, recMeta, error)
+}
+
+type finder struct {
+	kv   []KV
+	seen map[string]bool
+}
+
+// match 'pat' under the directory 'n' at 'dir'
+func (f *finder) find(n findNode, dir []string, pat []string) error {
+	if len(pat) == 0 {
+		return nil
+	}
+
+	s := pat[0]
+	if s == "**" {
+		// a trailing "**" matches every record below
+		rest := pat[1:]
+		if len(rest) == 0 {
+			rest = []string{"*"}
+		}
+
+		if err := f.find(n, dir, rest); err != nil {
+			return err
+		}
+		return f.each(n, dir, "*", true, func(sub findNode, d []string) error {
+			return f.find(sub, d, pat)
+		})
+	}
+
+	if len(pat) > 1 {
+		return f.each(n, dir, s, false, func(sub findNode, d []string) error {
+			return f.find(sub, d, pat[1:])
+		})
+	}
+
+	// the last segment names records
+	leaves := []string{s}
+	if isGlob(s) {
+		names, err := n.names(false)
+		if err != nil {
+			return err
+		}
+
+		leaves = leaves[:0]
+		for _, nm := range names {
+			if ok, _ := path.Match(s, nm); ok {
+				leaves = append(leaves, nm)
+			}
+		}
+	}
+
+	for _, nm := range leaves {
+		p := userPath(dirPath(append(dir, nm)))
+		if f.seen[p] {
+			continue
+		}
+
+		val, _, err := n.read(nm)
+		if err == errExpired {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			f.seen[p] = true
+			f.kv = append(f.kv, KV{p, val})
+		}
+	}
+	return nil
+}
+
+// call 'fp' for every sub-directory of 'n' that matches 's'. The bucket
+// of the top-level records matches a glob only if 'deep' is true: "*/x"
+// doesn't match "x" but "**/x" does.
+func (f *finder) each(n findNode, dir []string, s string, deep bool, fp func(findNode, []string) error) error {
+	dirs := []string{s}
+	if isGlob(s) {
+		names, err := n.names(true)
+		if err != nil {
+			return err
+		}
+
+		dirs = dirs[:0]
+		for _, nm := range names {
+			if len(dir) == 0 && nm == ".root" && !deep {
+				continue
+			}
+			if ok, _ := path.Match(s, nm); ok {
+				dirs = append(dirs, nm)
+			}
+		}
+	}
+
+	for _, nm := range dirs {
+		sub, err := n.sub(nm)
+		if err != nil {
+			return err
+		}
+		if sub == nil {
+			continue
+		}
+
+		d := append(slices.Clip(dir), nm)
+		if err = fp(sub, d); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// return the directory at 'dir' - the top of the db if it's empty; nil
+// if it doesn't exist.
+func (t *xact) nodeAt(dir []string) (findNode, error) {
+	if t.c.flat {
+		bu, x, err := t.flatDir2Index(dir)
+		if x == nil || err != nil {
+			return nil, err
+		}
+		return &flatNode{t, bu, x}, nil
+	}
+
+	var n findNode = &treeNode{t: t, c: t.c}
+	for _, nm := range dir {
+		sub, err := n.sub(nm)
+		if sub == nil || err != nil {
+			return nil, err
+		}
+		n = sub
+	}
+	return n, nil
+}
+
+// return true if the key-path segments 'v' match the pattern segments
+// 'pat' - as Find() would
+func matchPath(pat, v []string) bool {
+	if len(pat) == 0 {
+		return len(v) == 0
+	}
+
+	if pat[0] == "**" {
+		// a trailing "**" matches every record below
+		if len(pat) == 1 {
+			return len(v) > 0
+		}
+		for i := range len(v) + 1 {
+			if matchPath(pat[1:], v[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(v) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pat[0], v[0])
+	return ok && matchPath(pat[1:], v[1:])
+}
+
+// return true if the pattern segment 's' isn't a literal name
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, `*?[\`)
+}
+
+// treeNode is a bucket; a nil bucket is the top of the db.
+type treeNode struct {
+	t   *xact
+	bu  *bolt.Bucket
+	c   *encryptor
+	dir []string
+}
+
+func (n *treeNode) names(dirs bool) ([]string, error) {
+	var names []string
+
+	add := func(k []byte) error {
+		nm, err := n.c.decSegment(k)
+		if err != nil {
+			return err
+		}
+		names = append(names, nm)
+		return nil
+	}
+
+	if n.bu == nil {
+		if !dirs {
+			return nil, nil
+		}
+		err := n.t.ForEach(func(k []byte, _ *bolt.Bucket) error {
+			if isSystem(k) {
+				return nil
+			}
+			return add(k)
+		})
+		return names, err
+	}
+
+	err := n.bu.ForEach(func(k, v []byte) error {
+		if (v == nil) != dirs || isReserved(k) {
+			return nil
+		}
+		return add(k)
+	})
+	return names, err
+}
+
+func (n *treeNode) sub(nm string) (findNode, error) {
+	var sub *bolt.Bucket
+
+	k := n.c.encSegment(nm)
+	if n.bu == nil {
+		sub = n.t.Bucket(k)
+	} else {
+		sub = n.bu.Bucket(k)
+	}
+	if sub == nil {
+		return nil, nil
+	}
+
+	dir := append(slices.Clip(n.dir), nm)
+
+	c := n.c
+	if len(dir) <= n.t.depth {
+		var err error
+		if c, err = n.t.bucketKey(sub, false); err != nil {
+			return nil, err
+		}
+	}
+	return &treeNode{n.t, sub, c, dir}, nil
+}
+
+func (n *treeNode) read(nm string) ([]byte, recMeta, error) {
+	if n.bu == nil {
+		return nil, recMeta{}, nil
+	}
+	return n.t.readLeaf(n.bu, n.c, n.dir, nm)
+}
+
+// flatNode is a directory of the flat layout
+type flatNode struct {
+	t  *xact
+	bu *bolt.Bucket
+	x  *dirIndex
+}
+
+func (n *flatNode) names(dirs bool) ([]string, error) {
+	var names []string
+	for _, e := range n.x.ents {
+		if e.dir == dirs {
+			names = append(names, e.name)
+		}
+	}
+	return names, nil
+}
+
+// return the path of the child 'nm'
+func (n *flatNode) child(nm string) string {
+	if len(n.x.path) == 0 {
+		return nm
+	}
+	return n.x.path + "/" + nm
+}
+
+func (n *flatNode) sub(nm string) (findNode, error) {
+	if i, ok := n.x.find(nm); !ok || !n.x.ents[i].dir {
+		return nil, nil
+	}
+
+	x, err := n.t.readIndex(n.bu, n.child(nm))
+	if x == nil || err != nil {
+		return nil, err
+	}
+	return &flatNode{n.t, n.bu, x}, nil
+}
+
+func (n *flatNode) read(nm string) ([]byte, recMeta, error) {
+	if i, ok := n.x.find(nm); !ok || n.x.ents[i].dir {
+		return nil, recMeta{}, nil
+	}
+	return n.t.flatRead(n.bu, n.child(nm))
+}
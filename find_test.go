@@ -0,0 +1,86 @@
+// find_test.go -- glob query tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestFind(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  nil,
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 2},
+	}
+
+	m := map[string][]byte{
+		"users/1/email":      randbytes(),
+		"users/1/name":       randbytes(),
+		"users/2/email":      randbytes(),
+		"users/2/prefs/lang": randbytes(),
+		"admins/9/email":     randbytes(),
+		"sess-1":             randbytes(),
+		"sess-2":             randbytes(),
+		"other":              randbytes(),
+		"a/b/c/sess-3":       randbytes(),
+	}
+
+	tests := []struct {
+		pat string
+		exp []string
+	}{
+		{"users/*/email", []string{"users/1/email", "users/2/email"}},
+		{"users/1/*", []string{"users/1/email", "users/1/name"}},
+		{"*/*/email", []string{"admins/9/email", "users/1/email", "users/2/email"}},
+		{"users/[2-9]/*", []string{"users/2/email"}},
+		{"sess-*", []string{"sess-1", "sess-2"}},
+		{"**/sess-*", []string{"a/b/c/sess-3", "sess-1", "sess-2"}},
+		{"users/**", []string{"users/1/email", "users/1/name", "users/2/email", "users/2/prefs/lang"}},
+		{"users/**/lang", []string{"users/2/prefs/lang"}},
+		{"**/email", []string{"admins/9/email", "users/1/email", "users/2/email"}},
+		{"*/sess-1", nil},
+		{"users/3/*", nil},
+		{"other", []string{"other"}},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		for k, v := range m {
+			err = db.Set(k, v)
+			assert(err == nil, "%s: set %s: %s", name, k, err)
+		}
+
+		for _, x := range tests {
+			kv, err := db.Find(x.pat)
+			assert(err == nil, "%s: find %s: %s", name, x.pat, err)
+
+			var keys []string
+			for i := range kv {
+				keys = append(keys, kv[i].Key)
+				assert(bytes.Equal(kv[i].Val, m[kv[i].Key]), "%s: find %s: %s: content mismatch", name, x.pat, kv[i].Key)
+			}
+			assert(slices.Equal(keys, x.exp), "%s: find %s: exp %v, saw %v", name, x.pat, x.exp, keys)
+		}
+
+		kv, err := db.Find("**")
+		assert(err == nil, "%s: find **: %s", name, err)
+		assert(len(kv) == len(m), "%s: find **: exp %d, saw %d", name, len(m), len(kv))
+
+		_, err = db.Find("users/[/x")
+		assert(err != nil, "%s: find: bad pattern accepted", name)
+		db.Close()
+	}
+}
@@ -0,0 +1,472 @@
+// flat.go -- the structure-hiding "flat" layout
+
+package ebolt
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// In the default layout every directory of a key-path is a bolt
+// bucket: the shape of the bucket tree - how many directories there
+// are, how deep they go and how many records each holds - is visible
+// to anyone who can read the file even though the names are encrypted.
+//
+// A db created with Config.Flat keeps all records in a single bucket
+// instead. A record is keyed by a PRF of its canonical key-path and
+// every directory has an index record - keyed by a PRF of the
+// directory's path - that holds the sorted list of its children. Index
+// records are sealed like any other value: they're indistinguishable
+// from records in the file. Use a padding policy to also hide the size
+// of directory listings.
+//
+// The flat layout doesn't support per-bucket keys.
+
+const (
+	// the one bucket of a flat db; its name is encrypted as a path
+	// segment.
+	flatBucket = ".flat"
+
+	// the embedded key-path of index records; a canonical key-path
+	// always has a "/" in it.
+	flatIndex = ".index"
+
+	// the layout recorded in the header
+	layoutFlat = "flat"
+)
+
+// return the flat key of the record for the canonical key-path 'p'
+func (c *encryptor) leafKey(p string) []byte {
+	return expand(32, c.siv, "Flat Leaf", []byte(p))
+}
+
+// return the flat key of the index record of the directory 'd'
+func (c *encryptor) dirKey(d string) []byte {
+	return expand(32, c.siv, "Flat Dir", []byte(d))
+}
+
+// dirent is a child of a directory
+type dirent struct {
+	name string
+	dir  bool
+}
+
+// dirIndex is the decoded index record of a directory; 'ents' are
+// sorted by name. It is encoded as:
+//
+//	len(path) [4] || path || { dir [1] || len(name) [4] || name }*
+type dirIndex struct {
+	path string
+	ents []dirent
+}
+
+func (x *dirIndex) marshal() []byte {
+	n := 4 + len(x.path)
+	for i := range x.ents {
+		n += 5 + len(x.ents[i].name)
+	}
+
+	b := make([]byte, n)
+	z := enc32(b, len(x.path))
+	z = xcopy(z, x.path)
+	for i := range x.ents {
+		e := &x.ents[i]
+		z[0] = 0
+		if e.dir {
+			z[0] = 1
+		}
+		z = enc32(z[1:], len(e.name))
+		z = xcopy(z, e.name)
+	}
+	return b
+}
+
+func unmarshalIndex(b []byte) (*dirIndex, error) {
+	b, p, ok := decField(b)
+	if !ok {
+		return nil, fmt.Errorf("%w: malformed directory index", ErrIntegrity)
+	}
+
+	x := &dirIndex{path: string(p)}
+	for len(b) > 0 {
+		var nm []byte
+
+		dir := b[0] == 1
+		if b, nm, ok = decField(b[1:]); !ok {
+			return nil, fmt.Errorf("%w: malformed directory index", ErrIntegrity)
+		}
+		x.ents = append(x.ents, dirent{string(nm), dir})
+	}
+	return x, nil
+}
+
+// find the child 'nm'; return its position and true if it exists
+func (x *dirIndex) find(nm string) (int, bool) {
+	return slices.BinarySearchFunc(x.ents, nm, func(e dirent, nm string) int {
+		return strings.Compare(e.name, nm)
+	})
+}
+
+// add the child 'nm'; return true if the index changed. A child can't
+// be both a record and a directory.
+func (x *dirIndex) add(nm string, dir bool) (bool, error) {
+	i, ok := x.find(nm)
+	if ok {
+		if x.ents[i].dir != dir {
+			return false, bolt.ErrIncompatibleValue
+		}
+		return false, nil
+	}
+
+	x.ents = slices.Insert(x.ents, i, dirent{nm, dir})
+	return true, nil
+}
+
+// remove the child 'nm'; return true if the index changed
+func (x *dirIndex) remove(nm string) bool {
+	i, ok := x.find(nm)
+	if ok {
+		x.ents = slices.Delete(x.ents, i, i+1)
+	}
+	return ok
+}
+
+// return the bucket of a flat db; it's created if 'mk' is true
+func (t *xact) flat(mk bool) (*bolt.Bucket, error) {
+	nm := t.c.encSegment(flatBucket)
+	if !mk {
+		return t.Bucket(nm), nil
+	}
+	return t.CreateBucketIfNotExists(nm)
+}
+
+// read the index of directory 'd'; return nil if it doesn't exist
+func (t *xact) readIndex(bu *bolt.Bucket, d string) (*dirIndex, error) {
+	v := bu.Get(t.c.dirKey(d))
+	if v == nil {
+		return nil, nil
+	}
+
+	nm, b, err := t.c.decryptKV(v)
+	if err != nil {
+		return nil, err
+	}
+	if nm != flatIndex {
+		return nil, fmt.Errorf("%w: record found in place of index of %s", ErrIntegrity, d)
+	}
+
+	x, err := unmarshalIndex(b)
+	if err != nil {
+		return nil, err
+	}
+	if x.path != d {
+		return nil, fmt.Errorf("%w: index of %s found in place of %s", ErrIntegrity, x.path, d)
+	}
+	return x, nil
+}
+
+func (t *xact) writeIndex(bu *bolt.Bucket, x *dirIndex) error {
+	return bu.Put(t.c.dirKey(x.path), t.c.encryptKV(flatIndex, x.marshal()))
+}
+
+// return the bucket and index of the directory named by 'v'; a nil
+// index means the directory doesn't exist.
+func (t *xact) flatDir2Index(v []string) (*bolt.Bucket, *dirIndex, error) {
+	bu, err := t.flat(false)
+	if bu == nil || err != nil {
+		return nil, nil, err
+	}
+
+	x, err := t.readIndex(bu, dirPath(v))
+	if x == nil || err != nil {
+		return nil, nil, err
+	}
+	return bu, x, nil
+}
+
+// return true if the directory 'd' exists
+func (t *xact) flatHasDir(bu *bolt.Bucket, d string) bool {
+	return bu.Get(t.c.dirKey(d)) != nil
+}
+
+// read and verify the record for the canonical key-path 'p'; return
+// its value and expiry, nil if it doesn't exist and errExpired if it
+// has expired.
+func (t *xact) flatRead(bu *bolt.Bucket, p string) ([]byte, recMeta, error) {
+	var m recMeta
+
+	v := bu.Get(t.c.leafKey(p))
+	if v == nil {
+		return nil, m, nil
+	}
+
+	nm, val, m, err := t.c.openRec(v)
+	if err != nil {
+		return nil, m, err
+	}
+	if nm != p {
+		return nil, m, fmt.Errorf("%w: record belongs to %s", ErrIntegrity, nm)
+	}
+	if expired(m.exp) {
+		return nil, m, errExpired
+	}
+	return val, m, nil
+}
+
+func (t *xact) flatGet(p string) ([]byte, error) {
+	v := splitLeaf(p)
+	n := len(v) - 1
+
+	bu, err := t.flat(false)
+	if err != nil {
+		return nil, &StorageError{"get", p, boltErr(err)}
+	}
+	if bu == nil || !t.flatHasDir(bu, dirPath(v[:n])) {
+		return nil, &StorageError{"get", p, ErrBucketNotFound}
+	}
+
+	val, _, err := t.flatRead(bu, dirPath(v))
+	if err != nil && err != errExpired {
+		return nil, &StorageError{"get", p, boltErr(err)}
+	}
+	if val == nil {
+		return nil, &StorageError{"get", p, ErrNotFound}
+	}
+	return val, nil
+}
+
+// write the record for 'p' that expires at 'exp' and add it - and its
+// directories - to the directory indices
+func (t *xact) flatPut(p string, val []byte, m *recMeta) error {
+	bu, err := t.flat(true)
+	if err != nil {
+		return err
+	}
+
+	v := splitLeaf(p)
+	cp := dirPath(v)
+
+	if err = t.flatLink(bu, v, false); err != nil {
+		return err
+	}
+	return bu.Put(t.c.leafKey(cp), t.c.encryptRec(cp, val, m.mtime, m.exp))
+}
+
+// add each child named by 'v' to its parent - from the last one up -
+// until we reach a parent that already exists. The last child is a
+// directory if 'dir' is true.
+func (t *xact) flatLink(bu *bolt.Bucket, v []string, dir bool) error {
+	for i := len(v) - 1; i >= 0; i-- {
+		d := dirPath(v[:i])
+		x, err := t.readIndex(bu, d)
+		if err != nil {
+			return err
+		}
+
+		fresh := x == nil
+		if fresh {
+			x = &dirIndex{path: d}
+		}
+
+		changed, err := x.add(v[i], dir || i < len(v)-1)
+		if err != nil {
+			return err
+		}
+		if changed {
+			if err = t.writeIndex(bu, x); err != nil {
+				return err
+			}
+		}
+		if !fresh {
+			break
+		}
+	}
+	return nil
+}
+
+// make the directory named by 'v' and its parents
+func (t *xact) flatMkdir(v []string) error {
+	bu, err := t.flat(true)
+	if err != nil {
+		return err
+	}
+
+	x, err := t.readIndex(bu, dirPath(v))
+	if x != nil || err != nil {
+		return err
+	}
+
+	if err = t.writeIndex(bu, &dirIndex{path: dirPath(v)}); err != nil {
+		return err
+	}
+	return t.flatLink(bu, v, true)
+}
+
+// delete the directory named by 'v' and everything under it
+func (t *xact) flatDelDir(v []string) error {
+	n := len(v) - 1
+
+	bu, up, err := t.flatDir2Index(v[:n])
+	if up == nil || err != nil {
+		return err
+	}
+
+	var rm func(d string) error
+	rm = func(d string) error {
+		x, err := t.readIndex(bu, d)
+		if x == nil || err != nil {
+			return err
+		}
+
+		for _, e := range x.ents {
+			cp := d + "/" + e.name
+			if e.dir {
+				err = rm(cp)
+			} else {
+				err = bu.Delete(t.c.leafKey(cp))
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return bu.Delete(t.c.dirKey(d))
+	}
+
+	if err = rm(dirPath(v)); err != nil {
+		return err
+	}
+
+	up.remove(v[n])
+	return t.writeIndex(bu, up)
+}
+
+func (t *xact) flatSet(op, p string, val []byte, m *recMeta) error {
+	if err := t.flatPut(p, val, m); err != nil {
+		return &StorageError{op, p, boltErr(err)}
+	}
+	return nil
+}
+
+func (t *xact) flatDel(p string) error {
+	v := splitLeaf(p)
+	n := len(v) - 1
+
+	bu, x, err := t.flatDir2Index(v[:n])
+	if err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	if x == nil {
+		return &StorageError{"del", p, ErrBucketNotFound}
+	}
+
+	if i, ok := x.find(v[n]); !ok || x.ents[i].dir {
+		return nil
+	}
+
+	x.remove(v[n])
+	if err = t.writeIndex(bu, x); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	if err = bu.Delete(t.c.leafKey(dirPath(v))); err != nil {
+		return &StorageError{"del", p, boltErr(err)}
+	}
+	return nil
+}
+
+// call 'yield' for every record in the directory 'p' until it returns
+// false; values are read only if 'vals' is true.
+func (t *xact) flatIter(op, p string, vals bool, yield func(string, []byte) bool) error {
+	v := splitBucket(p)
+	bu, x, err := t.flatDir2Index(v)
+	if err != nil {
+		return &StorageError{op, p, boltErr(err)}
+	}
+	if x == nil {
+		return &StorageError{op, p, ErrBucketNotFound}
+	}
+
+	for _, e := range x.ents {
+		if e.dir {
+			continue
+		}
+
+		// the record is read even if the caller doesn't want the
+		// value: it may have expired.
+		cp := x.path + "/" + e.name
+		val, _, err := t.flatRead(bu, cp)
+		switch {
+		case err == errExpired:
+			continue
+		case err != nil:
+			return &StorageError{op, p, boltErr(err)}
+		case val == nil:
+			return &StorageError{op, p, fmt.Errorf("%w: record %s is missing", ErrIntegrity, cp)}
+		}
+		if !vals {
+			val = nil
+		}
+		if !yield(userPath(cp), val) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (t *xact) flatDirs(p string) ([]string, error) {
+	_, x, err := t.flatDir2Index(splitBucket(p))
+	if err != nil {
+		return nil, &StorageError{"dir", p, boltErr(err)}
+	}
+	if x == nil {
+		return nil, &StorageError{"dir", p, ErrBucketNotFound}
+	}
+
+	var ret []string
+	for _, e := range x.ents {
+		if e.dir {
+			ret = append(ret, e.name)
+		}
+	}
+	return ret, nil
+}
+
+// move every record and index of the flat bucket 'from' to 'to'
+func (r *reencryptor) moveFlat(from, to *bolt.Bucket) (bool, error) {
+	done := true
+	err := from.ForEach(func(k, v []byte) error {
+		if r.n == 0 {
+			done = false
+			return nil
+		}
+
+		nm, val, exp, err := r.src.decryptRec(v)
+		if err != nil {
+			return fmt.Errorf("key %x: %w", k, err)
+		}
+
+		nk := r.dst.leafKey(nm)
+		if nm == flatIndex {
+			x, err := unmarshalIndex(val)
+			if err != nil {
+				return err
+			}
+			nk = r.dst.dirKey(x.path)
+		}
+
+		ct, err := r.reencrypt(r.src, r.dst, nm, val, exp, v)
+		if err != nil {
+			return fmt.Errorf("key %x: %w", k, err)
+		}
+		if err = to.Put(nk, ct); err != nil {
+			return err
+		}
+
+		r.moved = append(r.moved, moved{from, k})
+		r.n--
+		return nil
+	})
+	return done, err
+}
@@ -0,0 +1,216 @@
+// flat_test.go -- flat layout tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"errors"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestFlat(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "flat.db")
+
+	db, err := newBoltOpt(fn, "key", &ebolt.Config{Flat: true})
+	assert(err == nil, "open: %s", err)
+
+	m := map[string][]byte{
+		"a/b/c/001": randbytes(),
+		"a/b/d/002": randbytes(),
+		"a/b/003":   randbytes(),
+		"a/x":       randbytes(),
+		"a/y":       randbytes(),
+		"top":       randbytes(),
+	}
+	for k, v := range m {
+		err = db.Set(k, v)
+		assert(err == nil, "set %s: %s", k, err)
+	}
+	db.Close()
+
+	// the layout comes from the header
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	for k, v := range m {
+		z, err := db.Get(k)
+		assert(err == nil, "get %s: %s", k, err)
+		assert(bytes.Equal(z, v), "get %s: content mismatch", k)
+	}
+
+	_, err = db.Get("a/z")
+	assert(errors.Is(err, ebolt.ErrNotFound), "get missing leaf: exp not-found, saw %v", err)
+
+	_, err = db.Get("nope/z")
+	assert(errors.Is(err, ebolt.ErrBucketNotFound), "get: exp bucket not-found, saw %v", err)
+
+	dirs, err := db.Dir("a/b")
+	assert(err == nil, "dir: %s", err)
+	assert(slices.Equal(dirs, []string{"c", "d"}), "dir a/b: saw %v", dirs)
+
+	dirs, err = db.Dir("a")
+	assert(err == nil, "dir: %s", err)
+	assert(slices.Equal(dirs, []string{"b"}), "dir a: saw %v", dirs)
+
+	all, err := db.All("a")
+	assert(err == nil, "all: %s", err)
+	assert(len(all) == 2, "all: exp 2, saw %d", len(all))
+	for k, v := range all {
+		assert(bytes.Equal(v, m[k]), "all %s: content mismatch", k)
+	}
+
+	all, err = db.All("")
+	assert(err == nil, "all root: %s", err)
+	assert(len(all) == 1 && bytes.Equal(all["top"], m["top"]), "all root: saw %v", all)
+
+	keys, err := db.AllKeys("a/b")
+	assert(err == nil, "keys: %s", err)
+	assert(slices.Equal(keys, []string{"a/b/003"}), "keys: saw %v", keys)
+
+	// a leaf can't also be a directory
+	err = db.Set("a/x/1", randbytes())
+	assert(errors.Is(err, bolt.ErrIncompatibleValue), "set under a leaf: %v", err)
+
+	err = db.Del("a/x")
+	assert(err == nil, "del: %s", err)
+	_, err = db.Get("a/x")
+	assert(errors.Is(err, ebolt.ErrNotFound), "del: leaf is still there")
+
+	keys, err = db.AllKeys("a")
+	assert(err == nil, "keys: %s", err)
+	assert(slices.Equal(keys, []string{"a/y"}), "keys after del: saw %v", keys)
+
+	err = db.Del("nope/z")
+	assert(errors.Is(err, ebolt.ErrBucketNotFound), "del: exp bucket not-found, saw %v", err)
+
+	_, err = newBoltOpt(path.Join(tmp, "bad.db"), "key", &ebolt.Config{Flat: true, KeyDepth: 1})
+	assert(errors.Is(err, ebolt.ErrConfig), "flat with per-bucket keys: exp config error, saw %v", err)
+}
+
+// the file of a flat db has a single bucket of equal sized keys
+func TestFlatShape(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "flat-shape.db")
+
+	db, err := newBoltOpt(fn, "key", &ebolt.Config{Flat: true})
+	assert(err == nil, "open: %s", err)
+
+	m := map[string][]byte{
+		"a/b/c/001": randbytes(),
+		"a/002":     randbytes(),
+		"x/y/003":   randbytes(),
+	}
+	for k, v := range m {
+		err = db.Set(k, v)
+		assert(err == nil, "set %s: %s", k, err)
+	}
+	db.Close()
+
+	raw, err := bolt.Open(fn, 0600, nil)
+	assert(err == nil, "raw open: %s", err)
+
+	var keys [][]byte
+	err = raw.View(func(tx *bolt.Tx) error {
+		n := 0
+		err := tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+			n++
+			return bu.ForEach(func(k, v []byte) error {
+				assert(v != nil, "raw: saw a sub-bucket")
+				keys = append(keys, slices.Clone(k))
+				return nil
+			})
+		})
+		assert(n == 1, "raw: exp 1 bucket, saw %d", n)
+		return err
+	})
+	assert(err == nil, "raw view: %s", err)
+
+	// 3 records and the indices of 6 directories: the root, a, a/b,
+	// a/b/c, x and x/y
+	assert(len(keys) == 3+6, "raw: exp 9 records, saw %d", len(keys))
+	for _, k := range keys {
+		assert(len(k) == 32, "raw: saw a key of %d bytes", len(k))
+	}
+
+	// swap two records: reading either is rejected
+	err = raw.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+
+			a := slices.Clone(bu.Get(keys[0]))
+			b := slices.Clone(bu.Get(keys[1]))
+			if err := bu.Put(keys[0], b); err != nil {
+				return err
+			}
+			return bu.Put(keys[1], a)
+		})
+	})
+	assert(err == nil, "raw update: %s", err)
+	raw.Close()
+
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	bad := 0
+	for k := range m {
+		if _, err := db.Get(k); err != nil {
+			assert(errors.Is(err, ebolt.ErrIntegrity), "get %s: exp integrity error, saw %v", k, err)
+			bad++
+		}
+	}
+	for _, d := range []string{"a", "a/b", "a/b/c", "x", "x/y"} {
+		if _, err := db.AllKeys(d); err != nil {
+			assert(errors.Is(err, ebolt.ErrIntegrity), "keys %s: exp integrity error, saw %v", d, err)
+			bad++
+		}
+	}
+	assert(bad > 0, "swapped records went unnoticed")
+}
+
+func TestFlatRekey(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "flat-rekey.db")
+
+	db, err := newBoltOpt(fn, "old", &ebolt.Config{Flat: true})
+	assert(err == nil, "open: %s", err)
+
+	m := fillRekey(t, db)
+
+	nk := sha3.Sum256([]byte("new"))
+	err = ebolt.InterruptRekey(db, nk[:], 700)
+	assert(err == nil, "interrupt: %s", err)
+	db.Close()
+
+	db, err = newBolt(fn, "new")
+	assert(err == nil, "resume: %s", err)
+	verifyRekey(t, db, m)
+
+	keys, err := db.AllKeys("bulk")
+	assert(err == nil, "keys: %s", err)
+	assert(len(keys) == 1500, "keys: exp 1500, saw %d", len(keys))
+
+	err = db.Rekey(sha3.New256().Sum(nil))
+	assert(err == nil, "rekey: %s", err)
+	verifyRekey(t, db, m)
+	db.Close()
+}
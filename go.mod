@@ -2,6 +2,9 @@ module github.com/opencoff/ebolt
 
 go 1.25.5
 
-require go.etcd.io/bbolt v1.4.3
+require (
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/crypto v0.47.0
+)
 
 require golang.org/x/sys v0.40.0 // indirect
@@ -0,0 +1,471 @@
+// index.go -- blind secondary indexes
+
+package ebolt
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A db can keep secondary indexes over the values of its records. An
+// Index selects the records it covers by their key-path and extracts
+// the values to index from each; Lookup() returns the key-paths of the
+// records with a given value without decrypting anything else.
+//
+// The indexed values are never stored. Each is replaced by a blind
+// token: a PRF of the index name and the value under a key of its own
+// derived from the data key. The entries live in a reserved top-level bucket
+// whose name is in plaintext - an encrypted name is never this short:
+//
+//	.blind / PRF(name) / token / PRF(path) = seal(path)
+//	.blind / PRF(name) / PRF(path)         = seal(token*)
+//	.blind / PRF(name) / .spec             = seal(pattern || unique)
+//
+// The second kind maps a record to its tokens: replacing or deleting
+// a record doesn't require decrypting its old value.
+//
+// Tokens are deterministic: the file reveals how many records share a
+// value of an index - though not the value.
+//
+// Indexes are declared when the db is opened (see Config.Indexes) and
+// every write through that handle keeps them up to date. The first
+// write of a transaction by a handle that doesn't declare an index
+// deletes its .spec: the index is stale. Lookup() refuses a stale
+// index. An index that doesn't exist yet - or is stale, or whose
+// declaration changed - is built when the db is opened for writing.
+// Rekey() rebuilds every index under the new data key.
+
+// the reserved bucket of the index entries
+var blindBucket = []byte(".blind")
+
+// the record holding the pattern of an index
+var blindSpec = []byte(".spec")
+
+// size of blind tokens and entry keys
+const blindSize = 32
+
+// Index is a secondary index over the values of records
+type Index struct {
+	// Name identifies the index in Lookup()
+	Name string
+
+	// Pattern selects the records that are indexed by their key-path;
+	// it's matched like the pattern of Find().
+	Pattern string
+
+	// Extract returns the values of the record 'p' to index; a record
+	// with none isn't indexed. An error fails the write of the record.
+	Extract func(p string, val []byte) ([]string, error)
+
+	// Unique admits at most one record per value (see unique.go)
+	Unique bool
+}
+
+// index is a declared Index with its pattern split in segments
+type index struct {
+	Index
+
+	pat []string
+}
+
+// validate the indexes in 'v'
+func makeIndexes(v []Index) ([]*index, error) {
+	var ret []*index
+
+	for i := range v {
+		ix := &index{Index: v[i]}
+		if len(ix.Name) == 0 || ix.Extract == nil {
+			return nil, fmt.Errorf("%w: index %d: missing name or extractor", ErrConfig, i)
+		}
+		if slices.ContainsFunc(ret, func(x *index) bool { return x.Name == ix.Name }) {
+			return nil, fmt.Errorf("%w: index %s: declared twice", ErrConfig, ix.Name)
+		}
+
+		ix.pat = strings.Split(ix.Pattern, "/")
+		for _, s := range ix.pat {
+			if _, err := path.Match(s, ""); err != nil {
+				return nil, fmt.Errorf("%w: index %s: %w", ErrConfig, ix.Name, err)
+			}
+		}
+		ret = append(ret, ix)
+	}
+	return ret, nil
+}
+
+// return the declaration of the index as recorded with its entries
+func (ix *index) spec() []byte {
+	var unique byte
+	if ix.Unique {
+		unique = 1
+	}
+	return append(appendField(nil, ix.Pattern), unique)
+}
+
+// return the blind token of the value 'val' of the index 'name'
+func (c *encryptor) blindToken(name, val string) []byte {
+	return expand(blindSize, c.bix, "Blind Token", appendField(appendField(nil, name), val))
+}
+
+// return the key of the entries of the canonical key-path 'p' in the
+// index 'name'
+func (c *encryptor) blindEntry(name, p string) []byte {
+	return expand(blindSize, c.bix, "Blind Entry", appendField(appendField(nil, name), p))
+}
+
+// return the name of the bucket of the index 'name'
+func (c *encryptor) blindIndex(name string) []byte {
+	return expand(blindSize, c.bix, "Blind Index", []byte(name))
+}
+
+// return the bucket of the index 'ix'; it's created if 'mk' is true
+func (t *xact) indexBucket(ix *index, mk bool) (*bolt.Bucket, error) {
+	nm := t.c.blindIndex(ix.Name)
+
+	top := t.Bucket(blindBucket)
+	if !mk {
+		if top == nil {
+			return nil, nil
+		}
+		return top.Bucket(nm), nil
+	}
+
+	top, err := t.CreateBucketIfNotExists(blindBucket)
+	if err != nil {
+		return nil, err
+	}
+	return top.CreateBucketIfNotExists(nm)
+}
+
+// blindVals are the values of a record for the index 'ix'
+type blindVals struct {
+	ix   *index
+	vals []string
+}
+
+// extract the values of every index that covers the record 'p'
+func (t *xact) extract(p string, v []byte) ([]blindVals, error) {
+	if len(t.ix) == 0 {
+		return nil, nil
+	}
+
+	up := userPath(canonical(p))
+	seg := strings.Split(up, "/")
+
+	var ret []blindVals
+	for _, ix := range t.ix {
+		if !matchPath(ix.pat, seg) {
+			continue
+		}
+
+		vals, err := ix.Extract(up, v)
+		if err != nil {
+			return nil, fmt.Errorf("index %s: %w", ix.Name, err)
+		}
+		ret = append(ret, blindVals{ix, vals})
+	}
+	return ret, nil
+}
+
+// replace the entries of the record 'p' by those in 'bv'
+func (t *xact) index(p string, bv []blindVals) error {
+	for i := range bv {
+		if err := t.indexRec(bv[i].ix, p, bv[i].vals); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replace the entries of the record 'p' in the index 'ix' by 'vals'
+func (t *xact) indexRec(ix *index, p string, vals []string) error {
+	bu, err := t.indexBucket(ix, true)
+	if err != nil {
+		return err
+	}
+
+	cp := canonical(p)
+	ek := t.c.blindEntry(ix.Name, cp)
+	if err = t.unindexIn(bu, ek); err != nil {
+		return err
+	}
+	if len(vals) == 0 {
+		return nil
+	}
+
+	var toks []byte
+
+	slices.Sort(vals)
+	for _, val := range slices.Compact(vals) {
+		tok := t.c.blindToken(ix.Name, val)
+		tb, err := bu.CreateBucketIfNotExists(tok)
+		if err != nil {
+			return err
+		}
+		if err = tb.Put(ek, t.c.sealPadded([]byte(cp))); err != nil {
+			return err
+		}
+		toks = append(toks, tok...)
+	}
+	return bu.Put(ek, t.c.sealPadded(toks))
+}
+
+// remove the record 'p' from every index that covers it
+func (t *xact) unindex(p string) error {
+	if len(t.ix) == 0 {
+		return nil
+	}
+
+	cp := canonical(p)
+	seg := strings.Split(userPath(cp), "/")
+	for _, ix := range t.ix {
+		if !matchPath(ix.pat, seg) {
+			continue
+		}
+
+		bu, err := t.indexBucket(ix, false)
+		if err != nil {
+			return err
+		}
+		if bu == nil {
+			continue
+		}
+		if err = t.unindexIn(bu, t.c.blindEntry(ix.Name, cp)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove the entries keyed by 'ek' from the index bucket 'bu'
+func (t *xact) unindexIn(bu *bolt.Bucket, ek []byte) error {
+	v := bu.Get(ek)
+	if v == nil {
+		return nil
+	}
+
+	toks, err := t.c.unsealPadded(v)
+	if err != nil {
+		return err
+	}
+	if len(toks)%blindSize != 0 {
+		return fmt.Errorf("%w: malformed index entry", ErrIntegrity)
+	}
+
+	for ; len(toks) > 0; toks = toks[blindSize:] {
+		tok := toks[:blindSize]
+		tb := bu.Bucket(tok)
+		if tb == nil {
+			continue
+		}
+		if err = tb.Delete(ek); err != nil {
+			return err
+		}
+		if k, _ := tb.Cursor().First(); k == nil {
+			if err = bu.DeleteBucket(tok); err != nil {
+				return err
+			}
+		}
+	}
+	return bu.Delete(ek)
+}
+
+// remove every record under the bucket named by 'v' from the indexes
+func (t *xact) unindexDir(v []string) error {
+	if err := t.staleIndexes(); err != nil {
+		return err
+	}
+	if len(t.ix) == 0 || t.Bucket(blindBucket) == nil {
+		return nil
+	}
+
+	var rm func(n findNode, d string) error
+	rm = func(n findNode, d string) error {
+		leaves, err := n.names(false)
+		if err != nil {
+			return err
+		}
+		for _, nm := range leaves {
+			if err = t.unindex(d + "/" + nm); err != nil {
+				return err
+			}
+		}
+
+		subs, err := n.names(true)
+		if err != nil {
+			return err
+		}
+		for _, nm := range subs {
+			sub, err := n.sub(nm)
+			if err != nil {
+				return err
+			}
+			if sub != nil {
+				if err = rm(sub, d+"/"+nm); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	n, err := t.nodeAt(v)
+	if n == nil || err != nil {
+		return err
+	}
+	return rm(n, dirPath(v))
+}
+
+// mark the indexes in the file that this handle doesn't declare as
+// stale: its writes don't keep them up to date. It's done once per
+// transaction, before its first write.
+func (t *xact) staleIndexes() error {
+	if t.stale {
+		return nil
+	}
+
+	top := t.Bucket(blindBucket)
+	if top == nil {
+		t.stale = true
+		return nil
+	}
+
+	own := make(map[string]bool, len(t.ix))
+	for _, ix := range t.ix {
+		own[string(t.c.blindIndex(ix.Name))] = true
+	}
+
+	var v [][]byte
+	err := top.ForEach(func(k, val []byte) error {
+		if val == nil && !own[string(k)] {
+			v = append(v, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, nm := range v {
+		if err = top.Bucket(nm).Delete(blindSpec); err != nil {
+			return err
+		}
+	}
+	t.stale = true
+	return nil
+}
+
+// build the indexes that don't exist, are stale or whose declaration
+// changed
+func (t *xact) buildIndexes() error {
+	for _, ix := range t.ix {
+		bu, err := t.indexBucket(ix, false)
+		if err != nil {
+			return err
+		}
+
+		if bu != nil {
+			spec, err := t.c.unseal(bu.Get(blindSpec))
+			if err == nil && bytes.Equal(spec, ix.spec()) {
+				continue
+			}
+
+			if err = t.Bucket(blindBucket).DeleteBucket(t.c.blindIndex(ix.Name)); err != nil {
+				return err
+			}
+		}
+
+		if bu, err = t.indexBucket(ix, true); err != nil {
+			return err
+		}
+		if err = bu.Put(blindSpec, t.c.seal(ix.spec())); err != nil {
+			return err
+		}
+
+		kv, err := t.Find(ix.Pattern)
+		if err != nil {
+			return err
+		}
+		for i := range kv {
+			r := &kv[i]
+			vals, err := ix.Extract(r.Key, r.Val)
+			if err != nil {
+				return fmt.Errorf("index %s: %s: %w", ix.Name, r.Key, err)
+			}
+			if err = t.checkBuild(ix, bu, canonical(r.Key), vals); err != nil {
+				return err
+			}
+			if err = t.indexRec(ix, r.Key, vals); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// build the declared indexes that are missing
+func (b *bdb) buildIndexes() error {
+	if len(b.ix) == 0 || b.db.IsReadOnly() {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return b.newXact(tx, nil).buildIndexes()
+	})
+}
+
+// Lookup returns the key-paths of the records whose value of the index
+// 'name' is 'val', sorted.
+func (t *xact) Lookup(name, val string) ([]string, error) {
+	i := slices.IndexFunc(t.ix, func(ix *index) bool { return ix.Name == name })
+	if i < 0 {
+		return nil, &StorageError{"lookup", name, ErrIndexNotFound}
+	}
+
+	bu, err := t.indexBucket(t.ix[i], false)
+	if err != nil {
+		return nil, &StorageError{"lookup", name, boltErr(err)}
+	}
+	if bu == nil {
+		return nil, &StorageError{"lookup", name, fmt.Errorf("%w: index isn't built", ErrIndexNotFound)}
+	}
+	if bu.Get(blindSpec) == nil {
+		return nil, &StorageError{"lookup", name, fmt.Errorf("%w: index is stale", ErrIndexNotFound)}
+	}
+
+	tb := bu.Bucket(t.c.blindToken(name, val))
+	if tb == nil {
+		return nil, nil
+	}
+
+	var ret []string
+	err = tb.ForEach(func(k, v []byte) error {
+		cp, err := t.c.unsealPadded(v)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(t.c.blindEntry(name, string(cp)), k) {
+			return fmt.Errorf("%w: index entry of %s found elsewhere", ErrIntegrity, cp)
+		}
+
+		// a record that has expired keeps its entries until it's swept
+		_, ct, err := t.liveRecord(string(cp))
+		if err != nil {
+			return err
+		}
+		if ct != nil {
+			ret = append(ret, userPath(string(cp)))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &StorageError{"lookup", name, err}
+	}
+
+	slices.Sort(ret)
+	return ret, nil
+}
@@ -0,0 +1,217 @@
+// index_test.go -- blind secondary index tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+type user struct {
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+func emailIndex() ebolt.Index {
+	return ebolt.Index{
+		Name:    "email",
+		Pattern: "users/*",
+		Extract: func(p string, val []byte) ([]string, error) {
+			var u user
+			if err := json.Unmarshal(val, &u); err != nil {
+				return nil, err
+			}
+			if len(u.Email) == 0 {
+				return nil, nil
+			}
+			return []string{u.Email}, nil
+		},
+	}
+}
+
+func TestIndex(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  {},
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+		opt.Indexes = []ebolt.Index{emailIndex()}
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		put := func(id string, u user) {
+			b, _ := json.Marshal(&u)
+			err := db.Set("users/"+id, b)
+			assert(err == nil, "%s: set %s: %s", name, id, err)
+		}
+		lookup := func(email string, exp ...string) {
+			got, err := db.Lookup("email", email)
+			assert(err == nil, "%s: lookup %s: %s", name, email, err)
+			assert(slices.Equal(got, exp), "%s: lookup %s: exp %v, saw %v", name, email, exp, got)
+		}
+
+		put("1001", user{"alice@example.com", "alice"})
+		put("1002", user{"bob@example.com", "bob"})
+		put("1003", user{"alice@example.com", "alice again"})
+		put("1004", user{"", "anon"})
+
+		// not covered by the pattern
+		err = db.Set("admins/1", []byte(`{"email":"alice@example.com"}`))
+		assert(err == nil, "%s: set: %s", name, err)
+
+		lookup("alice@example.com", "users/1001", "users/1003")
+		lookup("bob@example.com", "users/1002")
+		lookup("carol@example.com")
+
+		// replacing a record replaces its entries
+		put("1003", user{"carol@example.com", "carol"})
+		lookup("alice@example.com", "users/1001")
+		lookup("carol@example.com", "users/1003")
+
+		err = db.Del("users/1001")
+		assert(err == nil, "%s: del: %s", name, err)
+		lookup("alice@example.com")
+
+		// an extractor error fails the write and leaves nothing behind
+		err = db.Set("users/1005", []byte("not json"))
+		assert(err != nil, "%s: set: extractor error ignored", name)
+		_, err = db.Get("users/1005")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: get after failed set: %v", name, err)
+
+		_, err = db.Lookup("phone", "555")
+		assert(errors.Is(err, ebolt.ErrIndexNotFound), "%s: lookup undeclared: %v", name, err)
+
+		// the entries follow records that move
+		err = db.Rename("users/1002", "users/2002")
+		assert(err == nil, "%s: rename: %s", name, err)
+		lookup("bob@example.com", "users/2002")
+
+		err = db.DelDir("users", true)
+		assert(err == nil, "%s: del-dir: %s", name, err)
+		lookup("bob@example.com")
+		lookup("carol@example.com")
+
+		for i := range 20 {
+			put(fmt.Sprintf("%d", i), user{fmt.Sprintf("u%d@example.com", i%5), "x"})
+		}
+		lookup("u3@example.com", "users/13", "users/18", "users/3", "users/8")
+
+		// the index survives a rekey
+		nk := sha3.Sum256([]byte("new"))
+		err = db.Rekey(nk[:])
+		assert(err == nil, "%s: rekey: %s", name, err)
+		lookup("u3@example.com", "users/13", "users/18", "users/3", "users/8")
+
+		// the index bucket isn't visible
+		err = db.View(func(tx ebolt.Tx) error {
+			return tx.Walk("", ebolt.WalkOptions{NoValues: true}, func(p string, isDir bool, _ []byte) error {
+				assert(p != ".blind", "%s: walk: saw the index bucket", name)
+				return nil
+			})
+		})
+		assert(err == nil, "%s: walk: %s", name, err)
+		db.Close()
+
+		// values never show up in the file
+		raw, err := os.ReadFile(fn)
+		assert(err == nil, "%s: read: %s", name, err)
+		assert(!bytes.Contains(raw, []byte("example.com")), "%s: raw: indexed value in plaintext", name)
+
+		// a new index is built over existing records
+		byName := ebolt.Index{
+			Name:    "name",
+			Pattern: "users/*",
+			Extract: func(p string, val []byte) ([]string, error) {
+				var u user
+				err := json.Unmarshal(val, &u)
+				return []string{u.Name}, err
+			},
+		}
+		opt.Indexes = append(opt.Indexes, byName)
+		db, err = ebolt.OpenWithConfig(fn, nk[:], opt)
+		assert(err == nil, "%s: reopen: %s", name, err)
+
+		got, err := db.Lookup("name", "x")
+		assert(err == nil && len(got) == 20, "%s: lookup built: %d, %v", name, len(got), err)
+		lookup("u0@example.com", "users/0", "users/10", "users/15", "users/5")
+		db.Close()
+	}
+}
+
+func TestIndexStale(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "stale.db")
+
+	indexed := &ebolt.Config{Indexes: []ebolt.Index{emailIndex()}}
+	readOnly := &ebolt.Config{
+		Indexes: indexed.Indexes,
+		Bolt:    &ebolt.Options{ReadOnly: true},
+	}
+
+	set := func(db ebolt.DB, id string, u user) {
+		b, _ := json.Marshal(&u)
+		err := db.Set("users/"+id, b)
+		assert(err == nil, "set %s: %s", id, err)
+	}
+	lookup := func(cfg *ebolt.Config, email string, exp ...string) {
+		db, err := newBoltOpt(fn, "key", cfg)
+		assert(err == nil, "open: %s", err)
+		defer db.Close()
+
+		got, err := db.Lookup("email", email)
+		assert(err == nil, "lookup %s: %s", email, err)
+		assert(slices.Equal(got, exp), "lookup %s: exp %v, saw %v", email, exp, got)
+	}
+
+	db, err := newBoltOpt(fn, "key", indexed)
+	assert(err == nil, "open: %s", err)
+	set(db, "1", user{"alice@example.com", "alice"})
+	db.Close()
+
+	// reads by a handle without the index leave it alone
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	_, err = db.Get("users/1")
+	assert(err == nil, "get: %s", err)
+	db.Close()
+
+	lookup(readOnly, "alice@example.com", "users/1")
+
+	// writes by a handle without the index make it stale
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	set(db, "2", user{"bob@example.com", "bob"})
+	err = db.Del("users/1")
+	assert(err == nil, "del: %s", err)
+	db.Close()
+
+	db, err = newBoltOpt(fn, "key", readOnly)
+	assert(err == nil, "open read-only: %s", err)
+	_, err = db.Lookup("email", "bob@example.com")
+	assert(errors.Is(err, ebolt.ErrIndexNotFound), "lookup stale: exp index not found, saw %v", err)
+	db.Close()
+
+	// and the next handle that declares it rebuilds it
+	lookup(indexed, "bob@example.com", "users/2")
+	lookup(indexed, "alice@example.com")
+	lookup(readOnly, "bob@example.com", "users/2")
+}
@@ -0,0 +1,89 @@
+// iter.go -- streaming iterators over the records of a bucket
+
+package ebolt
+
+import (
+	"errors"
+	"iter"
+)
+
+// Iter returns an iterator over the key-paths and values of the records
+// in bucket 'p'; values are decrypted one at a time as the iterator
+// advances. An error ends the iteration and is returned by Err().
+// The bucket must not be modified while it's iterated.
+func (t *xact) Iter(p string) iter.Seq2[string, []byte] {
+	return func(yield func(string, []byte) bool) {
+		t.errs = t.errs[:0]
+		if err := t.iter("iter", p, true, yield); err != nil {
+			t.errs = append(t.errs, err)
+		}
+	}
+}
+
+// Keys returns an iterator over the key-paths of the records in bucket
+// 'p'; the values aren't returned. An error ends the iteration and is
+// returned by Err().
+func (t *xact) Keys(p string) iter.Seq[string] {
+	return func(yield func(string) bool) {
+		t.errs = t.errs[:0]
+		err := t.iter("keys", p, false, func(nm string, _ []byte) bool {
+			return yield(nm)
+		})
+		if err != nil {
+			t.errs = append(t.errs, err)
+		}
+	}
+}
+
+// Err returns the error that ended the last Iter() or Keys(); nil if
+// it ran to completion or was stopped by the caller.
+func (t *xact) Err() error {
+	return errors.Join(t.errs...)
+}
+
+// call 'yield' for every record in bucket 'p' until it returns false;
+// values are passed on only if 'vals' is true.
+func (t *xact) iter(op, p string, vals bool, yield func(string, []byte) bool) error {
+	if t.c.flat {
+		return t.flatIter(op, p, vals, yield)
+	}
+
+	bu, c, err := t.dir2bucket(p)
+	if err != nil {
+		return &StorageError{op, p, boltErr(err)}
+	}
+	if bu == nil {
+		return &StorageError{op, p, ErrBucketNotFound}
+	}
+
+	dir := splitBucket(p)
+
+	cur := bu.Cursor()
+	for k, v := cur.First(); k != nil; k, v = cur.Next() {
+		// sub-buckets have no value
+		if v == nil || isReserved(k) {
+			continue
+		}
+
+		// the key-path is in the sealed record; it's verified even if
+		// the caller doesn't want the value.
+		nm, val, exp, err := c.decryptRec(v)
+		if err != nil {
+			return &StorageError{op, p, err}
+		}
+		if err = verifyLoc(c, dir, k, nm); err != nil {
+			return &StorageError{op, p, err}
+		}
+		if expired(exp) {
+			continue
+		}
+		if !vals {
+			val = nil
+		}
+
+		if !yield(userPath(canonical(nm)), val) {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// iter_test.go -- streaming iterator tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestIter(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	for _, flat := range []bool{false, true} {
+		fn := path.Join(tmp, fmt.Sprintf("iter-%v.db", flat))
+
+		db, err := newBoltOpt(fn, "key", &ebolt.Config{Flat: flat})
+		assert(err == nil, "open: %s", err)
+
+		m := make(map[string][]byte)
+		for i := range 100 {
+			k := fmt.Sprintf("a/%03d", i)
+			m[k] = randbytes()
+		}
+
+		kv := make([]ebolt.KV, 0, len(m))
+		for k, v := range m {
+			kv = append(kv, ebolt.KV{Key: k, Val: v})
+		}
+
+		// sub-buckets aren't records
+		kv = append(kv, ebolt.KV{Key: "a/sub/x", Val: randbytes()})
+		kv = append(kv, ebolt.KV{Key: "top", Val: randbytes()})
+
+		err = db.SetMany(kv)
+		assert(err == nil, "set-many: %s", err)
+
+		err = db.View(func(tx ebolt.Tx) error {
+			seen := make(map[string]bool)
+			for k, v := range tx.Iter("a") {
+				assert(bytes.Equal(v, m[k]), "%v: iter %s: content mismatch", flat, k)
+				seen[k] = true
+			}
+			assert(tx.Err() == nil, "%v: iter: %s", flat, tx.Err())
+			assert(len(seen) == len(m), "%v: iter: exp %d, saw %d", flat, len(m), len(seen))
+
+			n := 0
+			for k := range tx.Keys("a") {
+				_, ok := m[k]
+				assert(ok, "%v: keys: unknown key %s", flat, k)
+				n++
+			}
+			assert(tx.Err() == nil, "%v: keys: %s", flat, tx.Err())
+			assert(n == len(m), "%v: keys: exp %d, saw %d", flat, len(m), n)
+
+			// stop early
+			n = 0
+			for range tx.Iter("a") {
+				if n++; n == 10 {
+					break
+				}
+			}
+			assert(n == 10 && tx.Err() == nil, "%v: break: saw %d, %v", flat, n, tx.Err())
+
+			var top []string
+			for k := range tx.Keys("") {
+				top = append(top, k)
+			}
+			assert(len(top) == 1 && top[0] == "top", "%v: keys root: saw %v", flat, top)
+
+			for range tx.Iter("nope") {
+				assert(false, "%v: iterated a missing bucket", flat)
+			}
+			err := tx.Err()
+			assert(errors.Is(err, ebolt.ErrBucketNotFound), "%v: iter missing: exp bucket not-found, saw %v", flat, err)
+			return nil
+		})
+		assert(err == nil, "view: %s", err)
+
+		// All and AllKeys skip sub-buckets too
+		all, err := db.All("a")
+		assert(err == nil, "%v: all: %s", flat, err)
+		assert(len(all) == len(m), "%v: all: exp %d, saw %d", flat, len(m), len(all))
+
+		keys, err := db.AllKeys("a")
+		assert(err == nil, "%v: all-keys: %s", flat, err)
+		assert(len(keys) == len(m), "%v: all-keys: exp %d, saw %d", flat, len(m), len(keys))
+		db.Close()
+	}
+}
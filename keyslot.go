@@ -0,0 +1,219 @@
+// keyslot.go -- unlocking one db with any of several keys
+
+package ebolt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The data key of a db can be wrapped by several KeyWrappers; each
+// wrapped copy lives in a named key slot in the format header. Open()
+// tries every slot whose wrapper name matches the KeyWrapper it was
+// given - so each holder of a slot can open the db independently of the
+// others. Adding or removing a slot rewrites only the header; the data
+// is never re-encrypted.
+//
+// A slot is stored as a record in the "slots" bucket of the header,
+// keyed by its name:
+//
+//	len(wrapper) [4] || wrapper || wrapped data key
+
+// the slot created along with the db
+const defaultSlot = "default"
+
+var (
+	// ErrKeySlotExists is returned when adding a key slot whose
+	// name is already in use.
+	ErrKeySlotExists = errors.New("key slot exists")
+
+	// ErrKeySlotNotFound is returned when removing a key slot
+	// that doesn't exist.
+	ErrKeySlotNotFound = errors.New("key slot not found")
+
+	// ErrLastKeySlot is returned when removing the only key slot
+	// of a db; doing so would make the db impossible to open.
+	ErrLastKeySlot = errors.New("can't remove the last key slot")
+)
+
+// KeySlot describes a key slot of a db
+type KeySlot struct {
+	// Name of the slot
+	Name string
+
+	// Wrapper is the Name() of the KeyWrapper protecting the slot
+	Wrapper string
+}
+
+// keySlot is a key slot as recorded in the header
+type keySlot struct {
+	name string
+	wrap string
+	dek  []byte
+}
+
+func (k *keySlot) marshal() []byte {
+	b := make([]byte, 4+len(k.wrap)+len(k.dek))
+	z := enc32(b, len(k.wrap))
+	z = xcopy(z, k.wrap)
+	copy(z, k.dek)
+	return b
+}
+
+func decodeSlot(k, v []byte) (keySlot, error) {
+	dek, wrap, ok := decField(v)
+	if !ok {
+		return keySlot{}, fmt.Errorf("%w: malformed key slot %q", ErrFormat, k)
+	}
+
+	ks := keySlot{
+		name: string(k),
+		wrap: string(wrap),
+		dek:  append([]byte{}, dek...),
+	}
+	return ks, nil
+}
+
+// unwrap the data key with 'w' from the first slot it opens; return
+// the data key and the name of the slot.
+func (h *header) unwrap(w KeyWrapper) ([]byte, string, error) {
+	err := fmt.Errorf("%w: no key slot is wrapped by %q", ErrWrongKey, w.Name())
+	for i := range h.slots {
+		ks := &h.slots[i]
+		if ks.wrap != w.Name() {
+			continue
+		}
+
+		var dek []byte
+		if dek, err = unwrap(w, ks.wrap, ks.dek); err == nil {
+			return dek, ks.name, nil
+		}
+	}
+	return nil, "", err
+}
+
+// return a copy of 'slots' with the slot named 'ks.name' replaced by 'ks'
+func replaceSlot(slots []keySlot, ks keySlot) []keySlot {
+	v := slices.Clone(slots)
+	for i := range v {
+		if v[i].name == ks.name {
+			v[i] = ks
+			return v
+		}
+	}
+
+	v = append(v, ks)
+	slices.SortFunc(v, func(a, b keySlot) int {
+		return strings.Compare(a.name, b.name)
+	})
+	return v
+}
+
+// write 'slots' into the header bucket 'm', replacing the ones there
+func writeSlots(m *bolt.Bucket, slots []keySlot) error {
+	if m.Bucket(metaSlots) != nil {
+		if err := m.DeleteBucket(metaSlots); err != nil {
+			return fmt.Errorf("header: %w", err)
+		}
+	}
+
+	sb, err := m.CreateBucket(metaSlots)
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+
+	for i := range slots {
+		ks := &slots[i]
+		if err = sb.Put([]byte(ks.name), ks.marshal()); err != nil {
+			return fmt.Errorf("header: %w", err)
+		}
+	}
+	return nil
+}
+
+// AddKeySlot wraps the data key with 'w' and stores it in a new key
+// slot called 'name'. The db can then be opened with 'w' as well as
+// with any of the existing slots.
+func (b *bdb) AddKeySlot(name string, w KeyWrapper) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db.IsReadOnly() {
+		return &StorageError{"add-key-slot", name, ErrReadOnly}
+	}
+
+	if len(name) == 0 {
+		return &StorageError{"add-key-slot", name, fmt.Errorf("empty slot name")}
+	}
+
+	if slices.ContainsFunc(b.h.slots, func(ks keySlot) bool { return ks.name == name }) {
+		return &StorageError{"add-key-slot", name, ErrKeySlotExists}
+	}
+
+	blob, err := w.Wrap(b.dek)
+	if err != nil {
+		return &StorageError{"add-key-slot", name, err}
+	}
+
+	h := *b.h
+	h.slots = replaceSlot(h.slots, keySlot{name, w.Name(), blob})
+	if err = b.writeHeader(&h); err != nil {
+		return &StorageError{"add-key-slot", name, err}
+	}
+	return nil
+}
+
+// RemoveKeySlot removes the key slot called 'name'; the db can no
+// longer be opened with the KeyWrapper of that slot. The last slot
+// of a db can't be removed.
+func (b *bdb) RemoveKeySlot(name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db.IsReadOnly() {
+		return &StorageError{"remove-key-slot", name, ErrReadOnly}
+	}
+
+	i := slices.IndexFunc(b.h.slots, func(ks keySlot) bool { return ks.name == name })
+	if i < 0 {
+		return &StorageError{"remove-key-slot", name, ErrKeySlotNotFound}
+	}
+	if len(b.h.slots) == 1 {
+		return &StorageError{"remove-key-slot", name, ErrLastKeySlot}
+	}
+
+	h := *b.h
+	h.slots = slices.Delete(slices.Clone(h.slots), i, i+1)
+	if err := b.writeHeader(&h); err != nil {
+		return &StorageError{"remove-key-slot", name, err}
+	}
+	return nil
+}
+
+// ListKeySlots returns the key slots of the db sorted by name
+func (b *bdb) ListKeySlots() ([]KeySlot, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	v := make([]KeySlot, 0, len(b.h.slots))
+	for i := range b.h.slots {
+		ks := &b.h.slots[i]
+		v = append(v, KeySlot{ks.name, ks.wrap})
+	}
+	return v, nil
+}
+
+// persist the header 'h' and start using it
+func (b *bdb) writeHeader(h *header) error {
+	err := b.db.Update(func(tx *bolt.Tx) error {
+		return writeHeader(tx, h)
+	})
+	if err == nil {
+		b.h = h
+	}
+	return err
+}
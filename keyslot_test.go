@@ -0,0 +1,125 @@
+// keyslot_test.go -- key slot tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestKeySlots(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "slots.db")
+
+	db, err := newBolt(fn, "owner")
+	assert(err == nil, "open: %s", err)
+
+	val := randbytes()
+	err = db.Set("a/b/c", val)
+	assert(err == nil, "set: %s", err)
+
+	ops := sha3.Sum256([]byte("ops"))
+	pass := []byte("correct horse")
+
+	err = db.AddKeySlot("ops", ebolt.NewKeyWrapper(ops[:]))
+	assert(err == nil, "add ops: %s", err)
+	err = db.AddKeySlot("svc", ebolt.NewPassphraseWrapper(pass))
+	assert(err == nil, "add svc: %s", err)
+
+	err = db.AddKeySlot("ops", newKMS("key-1"))
+	assert(errors.Is(err, ebolt.ErrKeySlotExists), "dup slot: exp exists, saw %v", err)
+
+	slots, err := db.ListKeySlots()
+	assert(err == nil, "list: %s", err)
+
+	exp := []ebolt.KeySlot{
+		{Name: "default", Wrapper: "aes-kw"},
+		{Name: "ops", Wrapper: "aes-kw"},
+		{Name: "svc", Wrapper: "argon2id"},
+	}
+	assert(len(slots) == len(exp), "list: exp %d slots, saw %d", len(exp), len(slots))
+	for i := range exp {
+		assert(slots[i] == exp[i], "list %d: exp %v, saw %v", i, exp[i], slots[i])
+	}
+	db.Close()
+
+	// every slot opens the db on its own
+	open := func(nm string, fp func() (ebolt.DB, error)) {
+		db, err := fp()
+		assert(err == nil, "%s: open: %s", nm, err)
+		defer db.Close()
+
+		v, err := db.Get("a/b/c")
+		assert(err == nil, "%s: get: %s", nm, err)
+		assert(bytes.Equal(v, val), "%s: content mismatch", nm)
+	}
+
+	open("owner", func() (ebolt.DB, error) { return newBolt(fn, "owner") })
+	open("ops", func() (ebolt.DB, error) { return ebolt.Open(fn, ops[:], nil) })
+	open("svc", func() (ebolt.DB, error) {
+		return ebolt.OpenWithWrapper(fn, ebolt.NewPassphraseWrapper(pass), nil)
+	})
+
+	_, err = newBolt(fn, "nobody")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "exp wrong-key, saw %v", err)
+
+	// revoke ops from the service's slot
+	db, err = ebolt.OpenWithWrapper(fn, ebolt.NewPassphraseWrapper(pass), nil)
+	assert(err == nil, "svc: open: %s", err)
+
+	err = db.RemoveKeySlot("ops")
+	assert(err == nil, "remove ops: %s", err)
+	err = db.RemoveKeySlot("ops")
+	assert(errors.Is(err, ebolt.ErrKeySlotNotFound), "remove ops: exp not-found, saw %v", err)
+	err = db.RemoveKeySlot("default")
+	assert(err == nil, "remove default: %s", err)
+	err = db.RemoveKeySlot("svc")
+	assert(errors.Is(err, ebolt.ErrLastKeySlot), "remove svc: exp last-slot, saw %v", err)
+	db.Close()
+
+	_, err = ebolt.Open(fn, ops[:], nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "revoked ops: exp wrong-key, saw %v", err)
+	_, err = newBolt(fn, "owner")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "revoked owner: exp wrong-key, saw %v", err)
+
+	open("svc", func() (ebolt.DB, error) {
+		return ebolt.OpenWithWrapper(fn, ebolt.NewPassphraseWrapper(pass), nil)
+	})
+}
+
+func TestKeySlotsRekey(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "slots-rekey.db")
+
+	db, err := newBolt(fn, "owner")
+	assert(err == nil, "open: %s", err)
+
+	err = db.AddKeySlot("kms", newKMS("key-1"))
+	assert(err == nil, "add: %s", err)
+
+	// a rekey leaves a single slot for the new key
+	key := sha3.Sum256([]byte("new"))
+	err = db.Rekey(key[:])
+	assert(err == nil, "rekey: %s", err)
+
+	slots, err := db.ListKeySlots()
+	assert(err == nil, "list: %s", err)
+	assert(len(slots) == 1 && slots[0].Name == "default", "rekey: slots %v", slots)
+	db.Close()
+
+	_, err = ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "kms: exp wrong-key, saw %v", err)
+
+	db, err = ebolt.Open(fn, key[:], nil)
+	assert(err == nil, "reopen: %s", err)
+	db.Close()
+}
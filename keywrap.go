@@ -0,0 +1,292 @@
+// keywrap.go -- protecting the data key with a KeyWrapper
+
+package ebolt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// KeyWrapper protects the random data-encryption key (DEK) of a
+// database. The DEK is wrapped once when the database is created and
+// the resulting blob is stored in the format header; every Open()
+// unwraps it. Rotating the secret behind a KeyWrapper only rewraps
+// this one blob (see DB.Rewrap). A KeyWrapper can be backed by a
+// local key, a passphrase or a remote KMS.
+type KeyWrapper interface {
+	// Name identifies the kind of wrapper; it is recorded along with
+	// the wrapped key so that Open() can fail fast on a mismatch.
+	Name() string
+
+	// Wrap encrypts and authenticates 'dek' and returns an opaque blob.
+	Wrap(dek []byte) ([]byte, error)
+
+	// Unwrap returns the key wrapped in 'blob'. It must return an
+	// error if 'blob' wasn't wrapped with the same secret.
+	Unwrap(blob []byte) ([]byte, error)
+}
+
+var errUnwrap = errors.New("key unwrap failed")
+
+// aesKeyWrap implements RFC 3394 AES key wrap
+type aesKeyWrap struct {
+	blk cipher.Block
+}
+
+var _ KeyWrapper = &aesKeyWrap{}
+
+// NewAESKeyWrap returns a KeyWrapper that wraps keys with RFC 3394 AES
+// key wrap under the key-encryption key 'kek'; 'kek' must be 16, 24
+// or 32 bytes long.
+func NewAESKeyWrap(kek []byte) (KeyWrapper, error) {
+	blk, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("aes-kw: %w", err)
+	}
+	return &aesKeyWrap{blk}, nil
+}
+
+// RFC 3394 default initial value
+var kwIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+func (w *aesKeyWrap) Name() string {
+	return "aes-kw"
+}
+
+func (w *aesKeyWrap) Wrap(dek []byte) ([]byte, error) {
+	if len(dek) < 16 || len(dek)%8 != 0 {
+		return nil, fmt.Errorf("aes-kw: invalid key length %d", len(dek))
+	}
+
+	n := len(dek) / 8
+	out := make([]byte, 8+len(dek))
+	a, r := out[:8], out[8:]
+
+	copy(a, kwIV)
+	copy(r, dek)
+
+	var buf [16]byte
+	for j := range 6 {
+		for i := range n {
+			copy(buf[:8], a)
+			copy(buf[8:], r[8*i:])
+			w.blk.Encrypt(buf[:], buf[:])
+
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(a, binary.BigEndian.Uint64(buf[:8])^t)
+			copy(r[8*i:], buf[8:])
+		}
+	}
+	return out, nil
+}
+
+func (w *aesKeyWrap) Unwrap(blob []byte) ([]byte, error) {
+	if len(blob) < 24 || len(blob)%8 != 0 {
+		return nil, fmt.Errorf("aes-kw: %w", errUnwrap)
+	}
+
+	n := len(blob)/8 - 1
+	a := make([]byte, 8)
+	r := make([]byte, len(blob)-8)
+
+	copy(a, blob[:8])
+	copy(r, blob[8:])
+
+	var buf [16]byte
+	for j := 5; j >= 0; j-- {
+		for i := n - 1; i >= 0; i-- {
+			t := uint64(n*j + i + 1)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], r[8*i:])
+			w.blk.Decrypt(buf[:], buf[:])
+
+			copy(a, buf[:8])
+			copy(r[8*i:], buf[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, kwIV) != 1 {
+		clear(r)
+		return nil, fmt.Errorf("aes-kw: %w", errUnwrap)
+	}
+	return r, nil
+}
+
+// keyWrapper is what Open() uses: it wraps the DEK with AES key wrap
+// under a key-encryption key derived from the caller's key.
+type keyWrapper struct {
+	*aesKeyWrap
+
+	// the DEK of a db that predates envelope encryption
+	legacy []byte
+}
+
+// NewKeyWrapper returns the KeyWrapper that Open() uses for 'key'; use
+// it to add a key slot that can be opened with Open(fn, key, ..).
+func NewKeyWrapper(key []byte) KeyWrapper {
+	return newKeyWrapper(key)
+}
+
+func newKeyWrapper(key []byte) *keyWrapper {
+	dek := legacyDEK(key)
+	kek := expand(32, dek, "DB Key Wrap")
+	defer clear(kek)
+
+	blk, err := aes.NewCipher(kek)
+	if err != nil {
+		panic(fmt.Sprintf("aes: %s", err))
+	}
+
+	w := &keyWrapper{
+		aesKeyWrap: &aesKeyWrap{blk},
+		legacy:     dek,
+	}
+	return w
+}
+
+// Argon2Params are the Argon2id cost parameters used to derive a
+// key-encryption key from a passphrase. The parameters are stored in
+// the db; to keep a hostile file from exhausting memory or CPU when it
+// is opened, they are capped at maxArgonTime passes and maxArgonMemory.
+type Argon2Params struct {
+	// number of passes over the memory
+	Time uint32
+
+	// memory in KiB
+	Memory uint32
+
+	// degree of parallelism
+	Threads uint8
+}
+
+// DefaultArgon2Params are used for a passphrase when no other
+// parameters are given.
+var DefaultArgon2Params = Argon2Params{
+	Time:    3,
+	Memory:  64 * 1024,
+	Threads: 4,
+}
+
+// upper bounds of the Argon2id parameters we accept
+const (
+	maxArgonTime   = 64
+	maxArgonMemory = 4 * 1024 * 1024 // KiB: 4 GiB
+)
+
+func (p *Argon2Params) valid() bool {
+	return p.Time > 0 && p.Time <= maxArgonTime &&
+		p.Threads > 0 &&
+		p.Memory >= 8*uint32(p.Threads) && p.Memory <= maxArgonMemory
+}
+
+const argonSaltLen = 32
+
+// passphraseWrapper derives a key-encryption key from a passphrase
+// with Argon2id and wraps the DEK with AES key wrap. The salt and the
+// Argon2id parameters are stored in the wrapped blob:
+//
+//	salt [32] || time [4] || memory [4] || threads [1] || aes-kw(kek, dek)
+type passphraseWrapper struct {
+	pass []byte
+
+	// parameters for wrapping
+	params Argon2Params
+
+	// parameters of the last blob we unwrapped
+	seen Argon2Params
+}
+
+var _ KeyWrapper = &passphraseWrapper{}
+
+// NewPassphraseWrapper returns a KeyWrapper that protects the DEK with
+// a key derived from the passphrase 'pass' with Argon2id under
+// DefaultArgon2Params. A fresh salt is chosen every time the DEK is
+// wrapped.
+func NewPassphraseWrapper(pass []byte) KeyWrapper {
+	return newPassphraseWrapper(pass, DefaultArgon2Params)
+}
+
+func newPassphraseWrapper(pass []byte, p Argon2Params) *passphraseWrapper {
+	w := &passphraseWrapper{
+		pass:   append([]byte{}, pass...),
+		params: p,
+	}
+	return w
+}
+
+func (w *passphraseWrapper) Name() string {
+	return "argon2id"
+}
+
+func (w *passphraseWrapper) Wrap(dek []byte) ([]byte, error) {
+	var salt [argonSaltLen]byte
+
+	randfill(salt[:])
+
+	p := w.params
+	kw, err := w.kek(salt[:], p)
+	if err != nil {
+		return nil, err
+	}
+
+	wrapped, err := kw.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, argonSaltLen+9+len(wrapped))
+	z := xcopy(b, salt[:])
+	z = enc32(z, p.Time)
+	z = enc32(z, p.Memory)
+	z[0] = p.Threads
+	copy(z[1:], wrapped)
+	return b, nil
+}
+
+func (w *passphraseWrapper) Unwrap(blob []byte) ([]byte, error) {
+	if len(blob) < argonSaltLen+9 {
+		return nil, fmt.Errorf("argon2id: %w", errUnwrap)
+	}
+
+	var p Argon2Params
+
+	salt, z := blob[:argonSaltLen], blob[argonSaltLen:]
+	z, p.Time = dec32[uint32](z)
+	z, p.Memory = dec32[uint32](z)
+	p.Threads, z = z[0], z[1:]
+
+	kw, err := w.kek(salt, p)
+	if err != nil {
+		return nil, err
+	}
+
+	dek, err := kw.Unwrap(z)
+	if err != nil {
+		return nil, err
+	}
+
+	w.seen = p
+	return dek, nil
+}
+
+// derive the key-encryption key
+func (w *passphraseWrapper) kek(salt []byte, p Argon2Params) (*aesKeyWrap, error) {
+	if !p.valid() {
+		return nil, fmt.Errorf("argon2id: invalid parameters %+v", p)
+	}
+
+	kek := argon2.IDKey(w.pass, salt, p.Time, p.Memory, p.Threads, 32)
+	defer clear(kek)
+
+	blk, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, fmt.Errorf("aes: %w", err)
+	}
+	return &aesKeyWrap{blk}, nil
+}
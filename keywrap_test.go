@@ -0,0 +1,281 @@
+// keywrap_test.go -- envelope encryption tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func unhex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// RFC 3394, Section 4
+func TestAESKeyWrapVectors(t *testing.T) {
+	assert := newAsserter(t)
+
+	tests := []struct {
+		kek, key, out string
+	}{
+		{
+			"000102030405060708090A0B0C0D0E0F",
+			"00112233445566778899AABBCCDDEEFF",
+			"1FA68B0A8112B447AEF34BD8FB5A7B829D3E862371D2CFE5",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F1011121314151617",
+			"00112233445566778899AABBCCDDEEFF0001020304050607",
+			"031D33264E15D33268F24EC260743EDCE1C6C7DDEE725A936BA814915C6762D2",
+		},
+		{
+			"000102030405060708090A0B0C0D0E0F101112131415161718191A1B1C1D1E1F",
+			"00112233445566778899AABBCCDDEEFF000102030405060708090A0B0C0D0E0F",
+			"28C9F404C4B810F4CBCCB35CFB87F8263F5786E2D80ED326CBC7F0E71A99F43BFB988B9B7A02DD21",
+		},
+	}
+
+	for i, x := range tests {
+		w, err := ebolt.NewAESKeyWrap(unhex(x.kek))
+		assert(err == nil, "%d: kw: %s", i, err)
+
+		ct, err := w.Wrap(unhex(x.key))
+		assert(err == nil, "%d: wrap: %s", i, err)
+		assert(bytes.Equal(ct, unhex(x.out)), "%d: wrap mismatch:\nexp %s\nsaw %x", i, x.out, ct)
+
+		pt, err := w.Unwrap(ct)
+		assert(err == nil, "%d: unwrap: %s", i, err)
+		assert(bytes.Equal(pt, unhex(x.key)), "%d: unwrap mismatch", i)
+
+		ct[3] ^= 1
+		_, err = w.Unwrap(ct)
+		assert(err != nil, "%d: unwrapped corrupt blob", i)
+	}
+}
+
+// fakeKMS is a local stand-in for a remote key management service
+type fakeKMS struct {
+	id  string
+	kek []byte
+}
+
+func newKMS(id string) *fakeKMS {
+	k := sha3.Sum256([]byte(id))
+	return &fakeKMS{id, k[:]}
+}
+
+func (k *fakeKMS) Name() string {
+	return "kms"
+}
+
+func (k *fakeKMS) Wrap(dek []byte) ([]byte, error) {
+	w, err := ebolt.NewAESKeyWrap(k.kek)
+	if err != nil {
+		return nil, err
+	}
+	b, err := w.Wrap(dek)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(k.id+":"), b...), nil
+}
+
+func (k *fakeKMS) Unwrap(blob []byte) ([]byte, error) {
+	pref := []byte(k.id + ":")
+	if !bytes.HasPrefix(blob, pref) {
+		return nil, fmt.Errorf("kms: unknown key id")
+	}
+
+	w, err := ebolt.NewAESKeyWrap(k.kek)
+	if err != nil {
+		return nil, err
+	}
+	return w.Unwrap(blob[len(pref):])
+}
+
+func TestWrapperKMS(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "kms.db")
+
+	db, err := ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(err == nil, "open: %s", err)
+
+	err = db.Set("a/b/c", []byte("secret"))
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	_, err = ebolt.OpenWithWrapper(fn, newKMS("key-2"), nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "kms: exp wrong-key, saw %v", err)
+
+	_, err = newBolt(fn, "key-1")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "open: exp wrong-key, saw %v", err)
+
+	db, err = ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	v, err := db.Get("a/b/c")
+	assert(err == nil, "get: %s", err)
+	assert(string(v) == "secret", "get: content mismatch")
+}
+
+func TestRewrap(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "rewrap.db")
+
+	db, err := newBolt(fn, "master")
+	assert(err == nil, "open: %s", err)
+
+	m := map[string][]byte{
+		"a/b/c": randbytes(),
+		"a/d":   randbytes(),
+		"e":     randbytes(),
+	}
+	for k, v := range m {
+		err = db.Set(k, v)
+		assert(err == nil, "set %s: %s", k, err)
+	}
+
+	// move to the KMS and then to a passphrase
+	err = db.Rewrap(newKMS("key-1"))
+	assert(err == nil, "rewrap: %s", err)
+	db.Close()
+
+	_, err = newBolt(fn, "master")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "old key: exp wrong-key, saw %v", err)
+
+	db, err = ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(err == nil, "kms: %s", err)
+
+	err = db.Rewrap(ebolt.NewPassphraseWrapper([]byte("correct horse")))
+	assert(err == nil, "rewrap: %s", err)
+	db.Close()
+
+	_, err = ebolt.OpenWithWrapper(fn, ebolt.NewPassphraseWrapper([]byte("battery staple")), nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "passphrase: exp wrong-key, saw %v", err)
+
+	db, err = ebolt.OpenWithWrapper(fn, ebolt.NewPassphraseWrapper([]byte("correct horse")), nil)
+	assert(err == nil, "passphrase: %s", err)
+	defer db.Close()
+
+	for k, v := range m {
+		z, err := db.Get(k)
+		assert(err == nil, "get %s: %s", k, err)
+		assert(bytes.Equal(z, v), "get %s: content mismatch", k)
+	}
+}
+
+func TestWrapperLegacy(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "v0.db")
+
+	key := sha3.Sum256([]byte("legacy"))
+	err := ebolt.WriteV0(fn, key[:], []ebolt.KV{{Key: "a/b", Val: []byte("c")}})
+	assert(err == nil, "write v0: %s", err)
+
+	// the data key of an old db is derived from the caller's key
+	_, err = ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(errors.Is(err, ebolt.ErrFormat), "exp format error, saw %v", err)
+
+	db, err := ebolt.Open(fn, key[:], nil)
+	assert(err == nil, "open: %s", err)
+
+	err = db.Rewrap(newKMS("key-1"))
+	assert(err == nil, "rewrap: %s", err)
+	db.Close()
+
+	db, err = ebolt.OpenWithWrapper(fn, newKMS("key-1"), nil)
+	assert(err == nil, "kms: %s", err)
+	defer db.Close()
+
+	v, err := db.Get("a/b")
+	assert(err == nil, "get: %s", err)
+	assert(string(v) == "c", "get: content mismatch")
+}
+
+func TestOpenWithPassphrase(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "pass.db")
+
+	pass := []byte("correct horse")
+	weak := &ebolt.Argon2Params{Time: 1, Memory: 8 * 1024, Threads: 1}
+
+	db, err := ebolt.OpenWithPassphrase(fn, pass, weak, nil)
+	assert(err == nil, "open: %s", err)
+
+	val := randbytes()
+	err = db.Set("a/b/c", val)
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	p, err := ebolt.PassphraseParams(fn, "default")
+	assert(err == nil, "params: %s", err)
+	assert(p == *weak, "params: exp %+v, saw %+v", *weak, p)
+
+	_, err = ebolt.OpenWithPassphrase(fn, []byte("battery staple"), nil, nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "exp wrong-key, saw %v", err)
+
+	_, err = ebolt.OpenWithPassphrase(fn, pass, &ebolt.Argon2Params{}, nil)
+	assert(errors.Is(err, ebolt.ErrConfig), "invalid params: exp config error, saw %v", err)
+
+	huge := &ebolt.Argon2Params{Time: 1, Memory: 8 * 1024 * 1024, Threads: 1}
+	_, err = ebolt.OpenWithPassphrase(fn, pass, huge, nil)
+	assert(err != nil, "opened with excessive params")
+
+	// stored parameters are bounded too: a tampered blob fails fast
+	w := ebolt.NewPassphraseWrapper(pass)
+	blob, err := w.Wrap(randbytes()[:32])
+	assert(err == nil, "wrap: %s", err)
+	for _, off := range []int{32, 36} {
+		bad := bytes.Clone(blob)
+		copy(bad[off:off+4], []byte{0xff, 0xff, 0xff, 0xff})
+		_, err = w.Unwrap(bad)
+		assert(err != nil, "unwrap: accepted excessive params at %d", off)
+	}
+
+	// no params: keep the stored ones
+	db, err = ebolt.OpenWithPassphrase(fn, pass, nil, nil)
+	assert(err == nil, "reopen: %s", err)
+	db.Close()
+
+	p, err = ebolt.PassphraseParams(fn, "default")
+	assert(err == nil, "params: %s", err)
+	assert(p == *weak, "params: exp %+v, saw %+v", *weak, p)
+
+	// stronger params: rewrap without touching the data
+	strong := &ebolt.Argon2Params{Time: 2, Memory: 16 * 1024, Threads: 2}
+	db, err = ebolt.OpenWithPassphrase(fn, pass, strong, nil)
+	assert(err == nil, "upgrade: %s", err)
+	db.Close()
+
+	p, err = ebolt.PassphraseParams(fn, "default")
+	assert(err == nil, "params: %s", err)
+	assert(p == *strong, "params: exp %+v, saw %+v", *strong, p)
+
+	db, err = ebolt.OpenWithPassphrase(fn, pass, nil, nil)
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	v, err := db.Get("a/b/c")
+	assert(err == nil, "get: %s", err)
+	assert(bytes.Equal(v, val), "get: content mismatch")
+}
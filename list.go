@@ -0,0 +1,227 @@
+// list.go -- sorted, paginated listings of a bucket
+
+package ebolt
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ListOptions control the records returned by List()
+type ListOptions struct {
+	// After starts the listing after the record with this leaf name -
+	// or before it if Reverse is set. An empty After starts at the
+	// first (or last) record. It's ignored if Token is set.
+	After string
+
+	// Token continues a listing where a previous List() stopped
+	Token string
+
+	// Limit is the most records to return; 0 returns all of them
+	Limit int
+
+	// Reverse lists the records in descending order
+	Reverse bool
+}
+
+// List returns the records in bucket 'p' sorted by leaf name, as
+// selected by 'opt'. If there are more records than opt.Limit, it also
+// returns an opaque token that continues the listing. The sorted index
+// alone decides that: when the records left have all expired, the token
+// leads to an empty page.
+func (t *xact) List(p string, opt ListOptions) ([]KV, string, error) {
+	dir := splitBucket(p)
+
+	var after *string
+	switch {
+	case len(opt.Token) > 0:
+		nm, err := t.readToken(dir, opt)
+		if err != nil {
+			return nil, "", &StorageError{"list", p, err}
+		}
+		after = &nm
+	case len(opt.After) > 0:
+		after = &opt.After
+	}
+
+	var kv []KV
+	var last string
+
+	more, err := t.sorted("list", p, after, opt.Reverse, opt.Limit, func(nm string, val []byte) bool {
+		kv = append(kv, KV{userPath(dirPath(dir) + "/" + nm), val})
+		last = nm
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !more {
+		return kv, "", nil
+	}
+	return kv, t.makeToken(dir, opt.Reverse, last), nil
+}
+
+// call 'fn' with the leaf name and value of every record in bucket 'p'
+// after 'after' in sorted order - or before it in reverse order - until
+// it returns false or it has seen 'limit' records. Return true if the
+// index has names past the limit; they're neither read nor decrypted,
+// so some of them may have expired.
+func (t *xact) sorted(op, p string, after *string, rev bool, limit int, fn func(string, []byte) bool) (bool, error) {
+	var x *sortedIndex
+	var read func(nm string) ([]byte, recMeta, error)
+
+	dir := splitBucket(p)
+	if t.c.flat {
+		bu, fx, err := t.flatDir2Index(dir)
+		if err != nil {
+			return false, &StorageError{op, p, boltErr(err)}
+		}
+		if fx == nil {
+			return false, &StorageError{op, p, ErrBucketNotFound}
+		}
+
+		// the index of a directory is sorted already
+		var leaves []string
+		for _, e := range fx.ents {
+			if !e.dir {
+				leaves = append(leaves, e.name)
+			}
+		}
+
+		x = &sortedIndex{mem: map[uint32][]string{1: leaves}}
+		if len(leaves) > 0 {
+			x.chunks = []chunkRef{{1, leaves[0]}}
+		}
+
+		read = func(nm string) ([]byte, recMeta, error) {
+			return t.flatRead(bu, fx.path+"/"+nm)
+		}
+	} else {
+		bu, c, err := t.dir2bucket(p)
+		if err != nil {
+			return false, &StorageError{op, p, boltErr(err)}
+		}
+		if bu == nil {
+			return false, &StorageError{op, p, ErrBucketNotFound}
+		}
+
+		if x, err = readSorted(bu, c, dirPath(dir)); err != nil {
+			return false, &StorageError{op, p, err}
+		}
+
+		// a bucket written by an older version is sorted in memory
+		if x == nil {
+			if x, err = buildSorted(bu, c, dirPath(dir), true); err != nil {
+				return false, &StorageError{op, p, err}
+			}
+		}
+
+		read = func(nm string) ([]byte, recMeta, error) {
+			return t.readLeaf(bu, c, dir, nm)
+		}
+	}
+
+	var rerr error
+	var n int
+
+	more := false
+	err := x.scan(after, rev, func(nm string) bool {
+		if limit > 0 && n == limit {
+			more = true
+			return false
+		}
+
+		val, _, err := read(nm)
+		if err == errExpired {
+			return true
+		}
+		if err == nil && val == nil {
+			err = fmt.Errorf("%w: record %s is missing", ErrIntegrity, nm)
+		}
+		if err != nil {
+			rerr = err
+			return false
+		}
+		n++
+		return fn(nm, val)
+	})
+	if err == nil {
+		err = rerr
+	}
+	if err != nil {
+		return false, &StorageError{op, p, err}
+	}
+	return more, nil
+}
+
+// read and verify the record 'nm' in the bucket 'bu' at 'dir' whose
+// contents are encrypted by 'c'; return its value and expiry, nil if it
+// doesn't exist and errExpired if it has expired.
+func (t *xact) readLeaf(bu *bolt.Bucket, c *encryptor, dir []string, nm string) ([]byte, recMeta, error) {
+	var m recMeta
+
+	v := bu.Get(c.encSegment(nm))
+	if v == nil {
+		return nil, m, nil
+	}
+
+	k, val, m, err := c.openRec(v)
+	if err != nil {
+		return nil, m, err
+	}
+
+	if canonical(k) != dirPath(dir)+"/"+nm {
+		return nil, m, fmt.Errorf("%w: record belongs to %s", ErrIntegrity, k)
+	}
+	if expired(m.exp) {
+		return nil, m, errExpired
+	}
+	return val, m, nil
+}
+
+// return a token that continues a listing of 'dir' after 'nm'. It's
+// sealed: the caller learns nothing from it.
+func (t *xact) makeToken(dir []string, rev bool, nm string) string {
+	var flag byte
+	if rev {
+		flag = 1
+	}
+
+	b := appendField(nil, dirPath(dir))
+	b = append(b, flag)
+	b = appendField(b, nm)
+	return base64.RawURLEncoding.EncodeToString(t.c.sealPadded(b))
+}
+
+// return the leaf name in the token of 'opt'; the token must have been
+// made for a listing of 'dir' in the same order.
+func (t *xact) readToken(dir []string, opt ListOptions) (string, error) {
+	ct, err := base64.RawURLEncoding.DecodeString(opt.Token)
+	if err != nil {
+		return "", fmt.Errorf("list: invalid token: %w", err)
+	}
+
+	b, err := t.c.unsealPadded(ct)
+	if err != nil {
+		return "", fmt.Errorf("list: invalid token: %w", err)
+	}
+
+	b, d, ok := decField(b)
+	if !ok || len(b) < 1 {
+		return "", fmt.Errorf("list: invalid token")
+	}
+
+	rev := b[0] == 1
+	_, nm, ok := decField(b[1:])
+	if !ok {
+		return "", fmt.Errorf("list: invalid token")
+	}
+
+	if string(d) != dirPath(dir) || rev != opt.Reverse {
+		return "", fmt.Errorf("list: token belongs to another listing")
+	}
+	return string(nm), nil
+}
@@ -0,0 +1,220 @@
+// list_test.go -- sorted listing tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"fmt"
+	"math/rand/v2"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// list every record of 'p' in pages of 'n'
+func listAll(t *testing.T, db ebolt.DB, p string, n int, rev bool) []string {
+	assert := newAsserter(t)
+
+	var keys []string
+
+	opt := ebolt.ListOptions{Limit: n, Reverse: rev}
+	for {
+		kv, tok, err := db.List(p, opt)
+		assert(err == nil, "list %s: %s", p, err)
+		assert(len(tok) == 0 || len(kv) == n, "list %s: short page of %d", p, len(kv))
+		for i := range kv {
+			keys = append(keys, kv[i].Key)
+		}
+		if len(tok) == 0 {
+			return keys
+		}
+		opt.Token = tok
+	}
+}
+
+func TestList(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  nil,
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		// enough to split the index several times; written in random
+		// order
+		var keys []string
+		m := make(map[string][]byte)
+		for i := range 1000 {
+			k := fmt.Sprintf("users/user-%04d", i)
+			keys = append(keys, k)
+			m[k] = []byte(k)
+		}
+
+		for _, i := range rand.Perm(len(keys)) {
+			k := keys[i]
+			err = db.Set(k, m[k])
+			assert(err == nil, "%s: set %s: %s", name, k, err)
+		}
+
+		err = db.Set("users/sub/x", []byte("x"))
+		assert(err == nil, "%s: set: %s", name, err)
+
+		got := listAll(t, db, "users", 100, false)
+		assert(slices.Equal(got, keys), "%s: list: not sorted", name)
+
+		got = listAll(t, db, "users", 7, true)
+		rev := slices.Clone(keys)
+		slices.Reverse(rev)
+		assert(slices.Equal(got, rev), "%s: list reverse: not sorted", name)
+
+		kv, tok, err := db.List("users", ebolt.ListOptions{After: "user-0500", Limit: 10})
+		assert(err == nil, "%s: list after: %s", name, err)
+		assert(len(kv) == 10 && len(tok) > 0, "%s: list after: saw %d", name, len(kv))
+		assert(kv[0].Key == "users/user-0501", "%s: list after: saw %s", name, kv[0].Key)
+		assert(bytes.Equal(kv[0].Val, m[kv[0].Key]), "%s: list after: content mismatch", name)
+
+		kv, _, err = db.List("users", ebolt.ListOptions{After: "user-0500", Limit: 2, Reverse: true})
+		assert(err == nil, "%s: list before: %s", name, err)
+		assert(len(kv) == 2 && kv[0].Key == "users/user-0499", "%s: list before: saw %v", name, kv)
+
+		// a token only continues its own listing
+		_, _, err = db.List("users", ebolt.ListOptions{Token: tok, Reverse: true})
+		assert(err != nil, "%s: list: reversed a token", name)
+		_, _, err = db.List("users/sub", ebolt.ListOptions{Token: tok})
+		assert(err != nil, "%s: list: token of another bucket", name)
+		_, _, err = db.List("users", ebolt.ListOptions{Token: "garbage"})
+		assert(err != nil, "%s: list: garbage token", name)
+
+		// deleted records are gone from the index
+		var del []string
+		for i := 0; i < len(keys); i += 3 {
+			del = append(del, keys[i])
+		}
+		err = db.DelMany(del)
+		assert(err == nil, "%s: del-many: %s", name, err)
+
+		got = listAll(t, db, "users", 64, false)
+		left := slices.DeleteFunc(slices.Clone(keys), func(k string) bool {
+			return slices.Contains(del, k)
+		})
+		assert(slices.Equal(got, left), "%s: list after del: mismatch", name)
+
+		// the index survives a rekey
+		nk := sha3.Sum256([]byte("new"))
+		err = db.Rekey(nk[:])
+		assert(err == nil, "%s: rekey: %s", name, err)
+
+		got = listAll(t, db, "users", 64, false)
+		assert(slices.Equal(got, left), "%s: list after rekey: mismatch", name)
+		db.Close()
+	}
+}
+
+// buckets written before the sorted index existed
+func TestListUnindexed(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "unindexed.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+
+	var keys []string
+	for i := range 300 {
+		k := fmt.Sprintf("a/%03d", i)
+		keys = append(keys, k)
+	}
+	for _, i := range rand.Perm(len(keys)) {
+		err = db.Set(keys[i], []byte(keys[i]))
+		assert(err == nil, "set: %s", err)
+	}
+	db.Close()
+
+	// drop the index
+	raw, err := bolt.Open(fn, 0600, nil)
+	assert(err == nil, "raw open: %s", err)
+	err = raw.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+
+			var idx [][]byte
+			bu.ForEach(func(k, _ []byte) error {
+				if len(k) <= 8 {
+					idx = append(idx, bytes.Clone(k))
+				}
+				return nil
+			})
+			assert(len(idx) > 1, "raw: no index")
+			for _, k := range idx {
+				if err := bu.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	})
+	assert(err == nil, "raw update: %s", err)
+	raw.Close()
+
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	got := listAll(t, db, "a", 50, false)
+	assert(slices.Equal(got, keys), "list: not sorted")
+
+	// the next write builds the index
+	err = db.Set("a/000x", []byte("x"))
+	assert(err == nil, "set: %s", err)
+	err = db.Del("a/001")
+	assert(err == nil, "del: %s", err)
+
+	keys = slices.Insert(keys, 1, "a/000x")
+	keys = slices.DeleteFunc(keys, func(k string) bool { return k == "a/001" })
+	got = listAll(t, db, "a", 50, false)
+	assert(slices.Equal(got, keys), "list after write: mismatch")
+}
+
+func TestListLimit(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "limit.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	defer db.Close()
+
+	err = db.Set("a/1", []byte("one"))
+	assert(err == nil, "set: %s", err)
+	err = db.SetWithTTL("a/2", []byte("two"), time.Millisecond)
+	assert(err == nil, "set-ttl: %s", err)
+	time.Sleep(5 * time.Millisecond)
+
+	// the name past the limit decides the token; its record isn't read
+	kv, tok, err := db.List("a", ebolt.ListOptions{Limit: 1})
+	assert(err == nil, "list: %s", err)
+	assert(len(kv) == 1 && kv[0].Key == "a/1", "list: saw %v", kv)
+	assert(len(tok) > 0, "list: no token")
+
+	kv, tok, err = db.List("a", ebolt.ListOptions{Limit: 1, Token: tok})
+	assert(err == nil, "list next: %s", err)
+	assert(len(kv) == 0 && len(tok) == 0, "list next: saw %v, %q", kv, tok)
+}
@@ -0,0 +1,457 @@
+// meta.go -- on-disk format header
+
+package ebolt
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The format header lives in a reserved top-level bucket whose name
+// is stored in plaintext. An encrypted path segment is never shorter
+// than the AEAD overhead - so this name can't collide with any bucket
+// created by a caller.
+//
+// The header records:
+//   - the on-disk format version
+//   - the cipher suite used for segments and values
+//   - the KDF used to turn the data key into encryption keys
+//   - one or more key slots, each holding the data key wrapped by a
+//     KeyWrapper along with the wrapper's name (see keyslot.go).
+//     Open() rejects a wrong key right away when no slot unwraps.
+//   - optional per-db features (e.g., key commitment); a field that
+//     isn't set is not recorded at all.
+//   - the padding policy, if any, sealed by the data key
+//   - a MAC over the version, suite, KDF and features with a key
+//     derived from the data key; this detects tampering with the
+//     header.
+
+var (
+	metaBucket = []byte(".ebolt")
+
+	metaVersion = []byte("version")
+	metaSuite   = []byte("suite")
+	metaKDF     = []byte("kdf")
+	metaCheck   = []byte("check")
+	metaSlots   = []byte("slots")
+	metaCommit  = []byte("commit")
+	metaDepth   = []byte("keydepth")
+	metaPadding = []byte("padding")
+	metaLayout  = []byte("layout")
+	metaRecMeta = []byte("recmeta")
+
+	// the padding policy sealed by the data key; the "padding"
+	// feature records that there is one.
+	metaPolicy = []byte("policy")
+
+	// formatV2 kept its only wrapped data key in the header itself
+	metaDEK  = []byte("dek")
+	metaWrap = []byte("wrap")
+
+	// journal of an in-progress Rekey(); not covered by the MAC
+	metaRekey = []byte("rekey")
+)
+
+const (
+	// formatV0 is the original format: each path segment is sealed
+	// under a single key-derived nonce. It has no header bucket.
+	formatV0 uint32 = iota
+
+	// formatV1 seals each path segment under a synthetic (SIV) nonce
+	formatV1
+
+	// formatV2 encrypts the db with a random data key that is stored
+	// in the header, wrapped by a KeyWrapper.
+	formatV2
+
+	// formatV3 stores the wrapped data key in one or more key slots
+	formatV3
+
+	// formatVersion is the format written by this version of ebolt
+	formatVersion = formatV3
+)
+
+const kdfSHA3 = "sha3-512+cshake256"
+
+var (
+	// ErrWrongKey is returned by Open when the supplied key is not
+	// the one the db was created with.
+	ErrWrongKey = errors.New("wrong key")
+
+	// ErrFormat is returned by Open when the format header is
+	// malformed or was written by a newer version of ebolt.
+	ErrFormat = errors.New("unsupported db format")
+
+	// ErrConfig is returned by Open when the Config - or the Argon2id
+	// parameters - it was given are invalid.
+	ErrConfig = errors.New("invalid config")
+)
+
+// header is the decoded format header
+type header struct {
+	ver   uint32
+	suite string
+	kdf   string
+	check []byte
+
+	// optional features
+	commit   string
+	keydepth string
+	padding  string
+	layout   string
+	recmeta  string
+
+	// the sealed padding policy and the policy itself once it's opened
+	policy []byte
+	pad    *Padding
+
+	// the data key wrapped in one or more key slots
+	slots []keySlot
+
+	// rekey journal, if any
+	rekey []byte
+}
+
+// return a header describing a db in the current format
+func newHeader() *header {
+	h := &header{
+		ver:   formatVersion,
+		suite: SuiteAES256GCM,
+		kdf:   kdfSHA3,
+	}
+	return h
+}
+
+// return a copy of 'h' for the on-disk format 'ver'
+func (h *header) as(ver uint32) *header {
+	z := *h
+	z.ver = ver
+	return &z
+}
+
+// return true if the top-level bucket 'nm' belongs to ebolt itself
+// rather than having an encrypted name
+func isSystem(nm []byte) bool {
+	return bytes.Equal(nm, metaBucket) || bytes.Equal(nm, blindBucket) || bytes.Equal(nm, keyTable)
+}
+
+// the optional fields of the header
+func (h *header) features() []struct {
+	k []byte
+	v *string
+} {
+	return []struct {
+		k []byte
+		v *string
+	}{
+		{metaCommit, &h.commit},
+		{metaDepth, &h.keydepth},
+		{metaPadding, &h.padding},
+		{metaLayout, &h.layout},
+		{metaRecMeta, &h.recmeta},
+	}
+}
+
+// encode the authenticated fields of the header
+func (h *header) marshal() []byte {
+	b := make([]byte, 4+4+len(h.suite)+4+len(h.kdf))
+
+	z := enc32(b, h.ver)
+	z = enc32(z, len(h.suite))
+	z = xcopy(z, h.suite)
+	z = enc32(z, len(h.kdf))
+	z = xcopy(z, h.kdf)
+
+	// features that are absent leave the encoding unchanged
+	var n [4]byte
+	for _, f := range h.features() {
+		if len(*f.v) == 0 {
+			continue
+		}
+
+		enc32(n[:], len(f.k))
+		b = append(append(b, n[:]...), f.k...)
+		enc32(n[:], len(*f.v))
+		b = append(append(b, n[:]...), *f.v...)
+	}
+	return b
+}
+
+// setup reads the format header of the db - creating it for a new db
+// with the options in 'opt' and migrating older formats to the current
+// one. It unwraps the data key with 'w', verifies the header and
+// initializes the encryptor for the format in use.
+func (b *bdb) setup(w KeyWrapper, opt *Config) error {
+	var h *header
+	var fresh bool
+
+	err := b.db.View(func(tx *bolt.Tx) error {
+		var err error
+		h, fresh, err = readHeader(tx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case h.ver > formatVersion:
+		return fmt.Errorf("%w: version %d", ErrFormat, h.ver)
+	case h.kdf != kdfSHA3:
+		return fmt.Errorf("%w: kdf %q", ErrFormat, h.kdf)
+	}
+
+	if _, err = h.keyDepth(); err != nil {
+		return err
+	}
+
+	switch {
+	case fresh:
+		return b.create(w, h, opt)
+	case h.ver < formatV2:
+		return b.upgrade(w, h)
+	case h.rekey != nil:
+		return b.resumeRekey(w, h)
+	}
+
+	if _, err = suiteByName(h.suite); err != nil {
+		return err
+	}
+
+	dek, slot, err := h.unwrap(w)
+	if err != nil {
+		return err
+	}
+
+	c, err := newEncryptor(dek, h)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(c.check(h.marshal()), h.check) != 1 {
+		return fmt.Errorf("%w: header check failed", ErrFormat)
+	}
+	if err = h.openPadding(c); err != nil {
+		return err
+	}
+
+	// formatV2 differs only in where the wrapped data key is kept
+	if h.ver < formatVersion && !b.db.IsReadOnly() {
+		h.ver = formatVersion
+		h.check = c.check(h.marshal())
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			return writeHeader(tx, h)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	b.use(dek, h, c)
+	b.slot = slot
+	return nil
+}
+
+// create the header of a new db with a fresh data key wrapped by 'w'
+func (b *bdb) create(w KeyWrapper, h *header, opt *Config) error {
+	if len(opt.Suite) > 0 {
+		if _, ok := suites[opt.Suite]; !ok {
+			return fmt.Errorf("%w: unknown cipher suite %q", ErrConfig, opt.Suite)
+		}
+		h.suite = opt.Suite
+	}
+	if opt.KeyCommit {
+		h.commit = commitCSHAKE
+	}
+	if opt.KeyDepth < 0 {
+		return fmt.Errorf("%w: invalid key depth %d", ErrConfig, opt.KeyDepth)
+	}
+	if opt.KeyDepth > 0 {
+		h.keydepth = strconv.Itoa(opt.KeyDepth)
+	}
+	if opt.Padding != nil {
+		if err := opt.Padding.validate(); err != nil {
+			return fmt.Errorf("%w: %w", ErrConfig, err)
+		}
+		pad := *opt.Padding
+		h.pad = &pad
+		h.padding = paddingSealed
+	}
+	if opt.Flat {
+		if opt.KeyDepth > 0 {
+			return fmt.Errorf("%w: the flat layout doesn't support per-bucket keys", ErrConfig)
+		}
+		h.layout = layoutFlat
+	}
+	h.recmeta = recmetaExpiry
+	if opt.Metadata {
+		h.recmeta = recmetaV1
+	}
+
+	dek := newDEK()
+	c, err := newEncryptor(dek, h)
+	if err != nil {
+		return err
+	}
+	if h.pad != nil {
+		h.policy = h.pad.seal(c)
+	}
+
+	// there's nothing to read in an empty, read-only db
+	if b.db.IsReadOnly() {
+		b.use(dek, h, c)
+		return nil
+	}
+
+	blob, err := w.Wrap(dek)
+	if err != nil {
+		return fmt.Errorf("wrap: %w", err)
+	}
+
+	h.slots = []keySlot{{defaultSlot, w.Name(), blob}}
+	h.check = c.check(h.marshal())
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return writeHeader(tx, h)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.use(dek, h, c)
+	b.slot = defaultSlot
+	return nil
+}
+
+// use the encryptor 'c' made from 'dek' for all future transactions
+func (b *bdb) use(dek []byte, h *header, c *encryptor) {
+	b.c = c
+	b.h = h
+	b.dek = dek
+	b.depth, _ = h.keyDepth()
+	b.keys.Clear()
+}
+
+// unwrap the data key in 'blob' that was wrapped by a KeyWrapper named
+// 'name'.
+func unwrap(w KeyWrapper, name string, blob []byte) ([]byte, error) {
+	if w.Name() != name {
+		return nil, fmt.Errorf("%w: db key is wrapped by %q, not %q", ErrWrongKey, name, w.Name())
+	}
+
+	dek, err := w.Unwrap(blob)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrWrongKey, err)
+	}
+	return dek, nil
+}
+
+// readHeader returns the format header of the db; fresh is true if
+// the db holds no data at all.
+func readHeader(tx *bolt.Tx) (*header, bool, error) {
+	m := tx.Bucket(metaBucket)
+	if m == nil {
+		// no header: either a new db or one written in formatV0
+		h := newHeader()
+		k, _ := tx.Cursor().First()
+		if k != nil {
+			h.ver = formatV0
+		}
+		return h, k == nil, nil
+	}
+
+	v := m.Get(metaVersion)
+	if len(v) != 4 {
+		return nil, false, fmt.Errorf("%w: malformed version", ErrFormat)
+	}
+
+	h := newHeader()
+	_, h.ver = dec32[uint32](v)
+
+	// the suite and kdf weren't recorded before the key-check was
+	if s := m.Get(metaSuite); s != nil {
+		h.suite = string(s)
+	}
+	if s := m.Get(metaKDF); s != nil {
+		h.kdf = string(s)
+	}
+	if s := m.Get(metaCheck); s != nil {
+		h.check = append([]byte{}, s...)
+	}
+	for _, f := range h.features() {
+		if s := m.Get(f.k); s != nil {
+			*f.v = string(s)
+		}
+	}
+	if h.ver == formatV2 {
+		if s := m.Get(metaDEK); s != nil {
+			h.slots = append(h.slots, keySlot{defaultSlot, string(m.Get(metaWrap)), append([]byte{}, s...)})
+		}
+	}
+	if sb := m.Bucket(metaSlots); sb != nil {
+		err := sb.ForEach(func(k, v []byte) error {
+			ks, err := decodeSlot(k, v)
+			if err == nil {
+				h.slots = append(h.slots, ks)
+			}
+			return err
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if s := m.Get(metaPolicy); s != nil {
+		h.policy = append([]byte{}, s...)
+	}
+	if s := m.Get(metaRekey); s != nil {
+		h.rekey = append([]byte{}, s...)
+	}
+	return h, false, nil
+}
+
+// writeHeader records the header 'h' in the db
+func writeHeader(tx *bolt.Tx, h *header) error {
+	m, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+
+	var b [4]byte
+	enc32(b[:], h.ver)
+
+	kv := []struct {
+		k, v []byte
+	}{
+		{metaVersion, b[:]},
+		{metaSuite, []byte(h.suite)},
+		{metaKDF, []byte(h.kdf)},
+		{metaCheck, h.check},
+	}
+
+	for _, f := range h.features() {
+		if len(*f.v) > 0 {
+			kv = append(kv, struct{ k, v []byte }{f.k, []byte(*f.v)})
+		}
+	}
+	if h.policy != nil {
+		kv = append(kv, struct{ k, v []byte }{metaPolicy, h.policy})
+	}
+
+	for _, x := range kv {
+		if err = m.Put(x.k, x.v); err != nil {
+			return fmt.Errorf("header: %w", err)
+		}
+	}
+
+	if err = m.Delete(metaDEK); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	if err = m.Delete(metaWrap); err != nil {
+		return fmt.Errorf("header: %w", err)
+	}
+	return writeSlots(m, h.slots)
+}
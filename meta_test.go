@@ -0,0 +1,109 @@
+// meta_test.go -- format header tests
+
+package ebolt_test
+
+import (
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// overwrite header field 'k' of the db in 'fn' with 'v'; 'k' may name
+// a field in a sub-bucket of the header ("slots/default").
+func poke(fn string, k string, v []byte) error {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bu := tx.Bucket([]byte(".ebolt"))
+		dir, nm := path.Split(k)
+		if dir != "" {
+			bu = bu.Bucket([]byte(path.Clean(dir)))
+		}
+		return bu.Put([]byte(nm), v)
+	})
+}
+
+// encode a key slot wrapped by 'wrap'
+func slotval(wrap string, dek []byte) []byte {
+	b := []byte{0, 0, 0, byte(len(wrap))}
+	b = append(b, wrap...)
+	return append(b, dek...)
+}
+
+func TestHeaderWrongKey(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "hdr.db")
+
+	// even an empty db must remember its key
+	db, err := newBolt(fn, "right")
+	assert(err == nil, "open: %s", err)
+	db.Close()
+
+	_, err = newBolt(fn, "wrong")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "exp wrong-key, saw %v", err)
+
+	db, err = newBolt(fn, "right")
+	assert(err == nil, "reopen: %s", err)
+	db.Close()
+
+	// a v0 db has no key-check; the key is verified against the data
+	fn = path.Join(tmp, "v0.db")
+	key := sha3.Sum256([]byte("legacy"))
+	err = ebolt.WriteV0(fn, key[:], []ebolt.KV{{Key: "a/b", Val: []byte("c")}})
+	assert(err == nil, "write v0: %s", err)
+
+	bad := sha3.Sum256([]byte("not legacy"))
+	_, err = ebolt.Open(fn, bad[:], nil)
+	assert(errors.Is(err, ebolt.ErrWrongKey), "v0: exp wrong-key, saw %v", err)
+
+	ver, err := ebolt.Version(fn)
+	assert(err == nil, "version: %s", err)
+	assert(ver == ebolt.FormatV0, "v0: migrated with the wrong key")
+}
+
+func TestHeaderTamper(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	tests := []struct {
+		field string
+		val   []byte
+		err   error
+	}{
+		{"version", []byte{0, 0, 0, 99}, ebolt.ErrFormat},
+		{"version", []byte{1}, ebolt.ErrFormat},
+		{"suite", []byte("rot13"), ebolt.ErrFormat},
+		{"kdf", []byte("md5"), ebolt.ErrFormat},
+		{"check", make([]byte, 32), ebolt.ErrFormat},
+		{"slots/default", slotval("aes-kw", make([]byte, 72)), ebolt.ErrWrongKey},
+		{"slots/default", slotval("kms", make([]byte, 72)), ebolt.ErrWrongKey},
+		{"slots/default", []byte{1}, ebolt.ErrFormat},
+	}
+
+	for i, x := range tests {
+		fn := path.Join(tmp, fmt.Sprintf("%s-%d.db", path.Base(x.field), i))
+		db, err := newBolt(fn, "key")
+		assert(err == nil, "open: %s", err)
+		err = db.Set("a/b", []byte("c"))
+		assert(err == nil, "set: %s", err)
+		db.Close()
+
+		err = poke(fn, x.field, x.val)
+		assert(err == nil, "poke %s: %s", x.field, err)
+
+		_, err = newBolt(fn, "key")
+		assert(errors.Is(err, x.err), "%s: exp %v, saw %v", x.field, x.err, err)
+	}
+}
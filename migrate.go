@@ -0,0 +1,384 @@
+// migrate.go -- re-encrypting the db from one encoding to another
+
+package ebolt
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// max number of records moved in a single write transaction
+const reencryptBatch = 1024
+
+// upgrade a db described by 'h' that predates envelope encryption to
+// formatVersion: its data key is derived from the caller's key, so it
+// can only be opened with Open().
+func (b *bdb) upgrade(w KeyWrapper, h *header) error {
+	kw, ok := w.(*keyWrapper)
+	if !ok {
+		return fmt.Errorf("%w: a v%d db must be opened with Open()", ErrFormat, h.ver)
+	}
+
+	dek := kw.legacy
+	c, err := newEncryptor(dek, h)
+	if err != nil {
+		return err
+	}
+
+	if err = b.verifyLegacy(dek, h, c); err != nil {
+		return err
+	}
+
+	// a read-only db is served in its original format
+	if b.db.IsReadOnly() {
+		b.use(dek, h, c)
+		return nil
+	}
+
+	// formatV1 and formatV2 differ only in the header
+	if h.ver == formatV0 {
+		dst, err := newEncryptor(dek, h.as(formatV1))
+		if err != nil {
+			return err
+		}
+
+		if err = b.reencrypt(h, c, dst, reencryptBatch); err != nil {
+			return fmt.Errorf("migrate v%d: %w", h.ver, err)
+		}
+	}
+
+	h.ver = formatVersion
+	if c, err = newEncryptor(dek, h); err != nil {
+		return err
+	}
+
+	blob, err := w.Wrap(dek)
+	if err != nil {
+		return fmt.Errorf("wrap: %w", err)
+	}
+
+	h.slots = []keySlot{{defaultSlot, w.Name(), blob}}
+	h.check = c.check(h.marshal())
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return writeHeader(tx, h)
+	})
+	if err != nil {
+		return err
+	}
+
+	b.use(dek, h, c)
+	b.slot = defaultSlot
+	return nil
+}
+
+// verify that 'dek' - the key behind 'c' - is the one used to write a
+// db that predates envelope encryption.
+func (b *bdb) verifyLegacy(dek []byte, h *header, c *encryptor) error {
+	if h.check != nil {
+		if subtle.ConstantTimeCompare(c.check(h.marshal()), h.check) != 1 {
+			return ErrWrongKey
+		}
+		return nil
+	}
+
+	// No key-check was recorded; some bucket name must decrypt. An
+	// interrupted migration leaves names in both the v0 and the v1
+	// encoding.
+	v1, err := newEncryptor(dek, h.as(formatV1))
+	if err != nil {
+		return err
+	}
+
+	return b.db.View(func(tx *bolt.Tx) error {
+		var n int
+		cu := tx.Cursor()
+		for k, _ := cu.First(); k != nil; k, _ = cu.Next() {
+			if isSystem(k) {
+				continue
+			}
+			if _, err := c.decSegment(k); err == nil {
+				return nil
+			}
+			if _, err := v1.decSegment(k); err == nil {
+				return nil
+			}
+			n++
+		}
+		if n > 0 {
+			return ErrWrongKey
+		}
+		return nil
+	})
+}
+
+// reencrypt moves every bucket and record from the encoding of 'src'
+// to that of 'dst' for a db described by 'h'. The work is split into
+// write transactions of at most 'n' records each. Since the two
+// encodings never produce the same bucket names, both trees coexist
+// while the move is in progress; a crash between transactions leaves
+// every record intact under exactly one of them and calling reencrypt
+// again resumes the move.
+func (b *bdb) reencrypt(h *header, src, dst *encryptor, n int) error {
+	for {
+		var moved int
+
+		err := b.db.Update(func(tx *bolt.Tx) error {
+			var err error
+
+			moved, err = reencryptTx(tx, h, src, dst, n)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			return nil
+		}
+	}
+}
+
+// a record that has been copied to its new home and must be removed
+// from the source tree.
+type moved struct {
+	bu  *bolt.Bucket
+	key []byte
+}
+
+// reencryptTx moves up to 'n' records from 'src' to 'dst' and returns
+// the amount of work done.
+func reencryptTx(tx *bolt.Tx, h *header, src, dst *encryptor, n int) (int, error) {
+	var top [][]byte
+
+	err := tx.ForEach(func(nm []byte, _ *bolt.Bucket) error {
+		if !isSystem(nm) {
+			top = append(top, nm)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	depth, err := h.keyDepth()
+	if err != nil {
+		return 0, err
+	}
+
+	r := &reencryptor{
+		src: src,
+		dst: dst,
+		h:   h,
+		tx:  tx,
+		n:   n,
+	}
+
+	var work int
+	for _, nm := range top {
+		if _, err := dst.decSegment(nm); err == nil {
+			continue
+		}
+
+		seg, err := src.decSegment(nm)
+		if err != nil {
+			return 0, fmt.Errorf("bucket %x: can't decrypt name: %w", nm, err)
+		}
+
+		to, err := tx.CreateBucketIfNotExists(dst.encSegment(seg))
+		if err != nil {
+			return 0, err
+		}
+
+		var done bool
+		if src.flat && seg == flatBucket {
+			done, err = r.moveFlat(tx.Bucket(nm), to)
+		} else {
+			done, err = r.move(tx.Bucket(nm), to, src, dst)
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		for _, m := range r.moved {
+			if err := m.bu.Delete(m.key); err != nil {
+				return 0, err
+			}
+		}
+		work += len(r.moved)
+		r.moved = r.moved[:0]
+
+		// the source tree is empty once everything under it is moved;
+		// the keys of its buckets go with it.
+		if done {
+			ids := keyIDs(nil, tx.Bucket(nm), 1, depth)
+			if err := tx.DeleteBucket(nm); err != nil {
+				return 0, err
+			}
+			for _, id := range ids {
+				if err := r.tab.Delete(id); err != nil {
+					return 0, err
+				}
+			}
+			work++
+		}
+
+		if r.n == 0 {
+			break
+		}
+	}
+	return work, nil
+}
+
+type reencryptor struct {
+	src, dst *encryptor
+	h        *header
+	tx       *bolt.Tx
+
+	// the key table and the encryptors for its entries under 'src' and
+	// 'dst'; loaded when the first keyed bucket is moved.
+	tab      *bolt.Bucket
+	stk, dtk *encryptor
+
+	// remaining budget for this transaction
+	n     int
+	moved []moved
+}
+
+// move the records and sub-buckets of 'from' - whose contents are
+// encrypted by 'src' - to 'to', where 'dst' encrypts them. Return true
+// if everything was moved within the budget.
+func (r *reencryptor) move(from, to *bolt.Bucket, src, dst *encryptor) (bool, error) {
+	if id := from.Get(bucketKey); id != nil {
+		var err error
+		if src, dst, err = r.keys(to, id); err != nil {
+			return false, err
+		}
+	}
+
+	done := true
+	err := from.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return r.moveBucket(from, to, k, src, dst, &done)
+		}
+		if bytes.Equal(k, bucketKey) {
+			return nil
+		}
+
+		// the sorted index goes away with the bucket; it's resealed
+		// every time the bucket is visited.
+		if isIndex(k) {
+			pt, err := src.unsealPadded(v)
+			if err != nil {
+				return fmt.Errorf("sorted index %x: %w", k, err)
+			}
+			return to.Put(k, dst.sealPadded(pt))
+		}
+
+		if r.n == 0 {
+			done = false
+			return nil
+		}
+
+		nm, err := src.decSegment(k)
+		if err != nil {
+			return fmt.Errorf("key %x: %w", k, err)
+		}
+
+		kp, val, exp, err := src.decryptRec(v)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kp, err)
+		}
+
+		ct, err := r.reencrypt(src, dst, kp, val, exp, v)
+		if err != nil {
+			return fmt.Errorf("key %s: %w", kp, err)
+		}
+		if err = to.Put(dst.encSegment(nm), ct); err != nil {
+			return err
+		}
+
+		r.moved = append(r.moved, moved{from, k})
+		r.n--
+		return nil
+	})
+	return done, err
+}
+
+// return the encryptors for the contents of a keyed bucket whose key
+// has the id 'id' and of its new home 'to'. The first visit gives 'to'
+// a new key of its own.
+func (r *reencryptor) keys(to *bolt.Bucket, id []byte) (*encryptor, *encryptor, error) {
+	if r.tab == nil {
+		r.tab = r.tx.Bucket(keyTable)
+		if r.tab == nil {
+			return nil, nil, fmt.Errorf("%w: key table is missing", ErrIntegrity)
+		}
+
+		var err error
+		salt := r.tab.Get(tableSalt)
+		if r.stk, err = tableKey(r.src, r.h, salt); err != nil {
+			return nil, nil, err
+		}
+		if r.dtk, err = tableKey(r.dst, r.h, salt); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	src, err := openKey(r.tab, r.stk, r.h, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if nid := to.Get(bucketKey); nid != nil {
+		dst, err := openKey(r.tab, r.dtk, r.h, nid)
+		return src, dst, err
+	}
+
+	nid, dst, err := addKey(r.tab, r.dtk, r.h)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = to.Put(bucketKey, nid); err != nil {
+		return nil, nil, err
+	}
+	return src, dst, nil
+}
+
+// re-encrypt the record 'ct' from 'src' to 'dst' for the key-path 'k'
+// whose value is 'val' and expiry is 'exp'; it keeps its modification
+// time.
+func (r *reencryptor) reencrypt(src, dst *encryptor, k string, val []byte, exp time.Time, ct []byte) ([]byte, error) {
+	m, err := src.readMeta(k, ct)
+	if err != nil {
+		return nil, err
+	}
+
+	mtime := time.Now()
+	if m != nil {
+		mtime = m.mtime
+	}
+	return dst.encryptRec(k, val, mtime, exp), nil
+}
+
+// move the sub-bucket 'k' of 'from' to 'to'. Empty buckets are
+// recreated too: they are visible to Dir().
+func (r *reencryptor) moveBucket(from, to *bolt.Bucket, k []byte, src, dst *encryptor, done *bool) error {
+	nm, err := src.decSegment(k)
+	if err != nil {
+		return fmt.Errorf("bucket %x: %w", k, err)
+	}
+
+	sub, err := to.CreateBucketIfNotExists(dst.encSegment(nm))
+	if err != nil {
+		return err
+	}
+
+	ok, err := r.move(from.Bucket(k), sub, src, dst)
+	if !ok {
+		*done = false
+	}
+	return err
+}
@@ -0,0 +1,102 @@
+// migrate_test.go -- segment encryption and format migration tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func xor(a, b []byte) []byte {
+	z := make([]byte, min(len(a), len(b)))
+	for i := range z {
+		z[i] = a[i] ^ b[i]
+	}
+	return z
+}
+
+func TestSegmentSIV(t *testing.T) {
+	assert := newAsserter(t)
+
+	key := []byte("segment key")
+	a, b := "users", "token"
+
+	// the original format reused one nonce for every segment and
+	// leaked the xor of the plaintexts
+	ca := ebolt.EncSegment(key, ebolt.FormatV0, a)
+	cb := ebolt.EncSegment(key, ebolt.FormatV0, b)
+	n := len(a)
+	assert(bytes.Equal(xor(ca[:n], cb[:n]), xor([]byte(a), []byte(b))), "v0: expected xor leak")
+
+	ca = ebolt.EncSegment(key, ebolt.FormatVersion, a)
+	cb = ebolt.EncSegment(key, ebolt.FormatVersion, b)
+	assert(!bytes.Equal(ca[:12], cb[:12]), "siv: nonce reused across segments")
+	assert(!bytes.Equal(xor(ca[12:12+n], cb[12:12+n]), xor([]byte(a), []byte(b))), "siv: xor leak")
+
+	// deterministic encryption is what lets us find buckets by name
+	z := ebolt.EncSegment(key, ebolt.FormatVersion, a)
+	assert(bytes.Equal(ca, z), "siv: not deterministic")
+}
+
+func TestMigrateV0(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "v0.db")
+
+	key := sha3.Sum256([]byte("legacy"))
+	kv := []ebolt.KV{
+		{Key: "a/b/c/001", Val: randbytes()},
+		{Key: "a/b/c/002", Val: randbytes()},
+		{Key: "a/b/d/001", Val: randbytes()},
+		{Key: "a/x", Val: randbytes()},
+		{Key: "top", Val: randbytes()},
+	}
+
+	// more than one migration batch worth of records
+	for i := range 1500 {
+		k := fmt.Sprintf("bulk/%04d", i)
+		kv = append(kv, ebolt.KV{Key: k, Val: []byte(k)})
+	}
+
+	err := ebolt.WriteV0(fn, key[:], kv)
+	assert(err == nil, "write v0: %s", err)
+
+	ver, err := ebolt.Version(fn)
+	assert(err == nil, "version: %s", err)
+	assert(ver == ebolt.FormatV0, "version: exp %d, saw %d", ebolt.FormatV0, ver)
+
+	db, err := ebolt.Open(fn, key[:], nil)
+	assert(err == nil, "open: %s", err)
+
+	for _, x := range kv {
+		v, err := db.Get(x.Key)
+		assert(err == nil, "get %s: %s", x.Key, err)
+		assert(bytes.Equal(v, x.Val), "get %s: content mismatch", x.Key)
+	}
+
+	dirs, err := db.Dir("a/b")
+	assert(err == nil, "dir: %s", err)
+	assert(len(dirs) == 2, "dir: exp 2 subdirs, saw %d", len(dirs))
+
+	err = db.Close()
+	assert(err == nil, "close: %s", err)
+
+	ver, err = ebolt.Version(fn)
+	assert(err == nil, "version: %s", err)
+	assert(ver == ebolt.FormatVersion, "version: exp %d, saw %d", ebolt.FormatVersion, ver)
+
+	// and it must reopen cleanly in the new format
+	db, err = ebolt.Open(fn, key[:], nil)
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	m, err := db.All("a/b/c")
+	assert(err == nil, "all: %s", err)
+	assert(len(m) == 2, "all: exp 2 entries, saw %d", len(m))
+}
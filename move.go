@@ -0,0 +1,246 @@
+// move.go -- deleting, renaming and copying whole buckets
+
+package ebolt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Every value embeds the key-path it was written for (see encryptKV()):
+// a record can't simply be moved to another bucket. Rename() and Copy()
+// decrypt each record and write it afresh under its new key-path;
+// buckets made on the way get new keys of their own (see
+// Config.KeyDepth).
+
+// DelDir deletes the bucket 'p'. A bucket that has records or buckets
+// in it is deleted - along with its contents - only if 'recursive' is
+// true.
+func (t *xact) DelDir(p string, recursive bool) error {
+	if len(p) == 0 {
+		return &StorageError{"del-dir", p, fmt.Errorf("can't delete the top of the db")}
+	}
+
+	v := strings.Split(p, "/")
+	n, err := t.nodeAt(v)
+	if err != nil {
+		return &StorageError{"del-dir", p, boltErr(err)}
+	}
+	if n == nil {
+		return &StorageError{"del-dir", p, ErrBucketNotFound}
+	}
+
+	if !recursive {
+		empty, err := isEmpty(n)
+		if err != nil {
+			return &StorageError{"del-dir", p, err}
+		}
+		if !empty {
+			return &StorageError{"del-dir", p, ErrNotEmpty}
+		}
+	}
+
+	if err = t.unindexDir(v); err != nil {
+		return &StorageError{"del-dir", p, boltErr(err)}
+	}
+
+	if t.c.flat {
+		err = t.flatDelDir(v)
+	} else {
+		err = t.shred(v)
+	}
+	if err != nil {
+		return &StorageError{"del-dir", p, boltErr(err)}
+	}
+	return nil
+}
+
+// Rename moves the record or bucket 'src' to 'dst'; a bucket is moved
+// with everything under it. 'dst' must not exist. If 'src' names both a
+// record and a bucket, the record is moved.
+func (t *xact) Rename(src, dst string) error {
+	return t.move("rename", src, dst, true)
+}
+
+// Copy copies the record or bucket 'src' to 'dst'; a bucket is copied
+// with everything under it. 'dst' must not exist. If 'src' names both a
+// record and a bucket, the record is copied.
+func (t *xact) Copy(src, dst string) error {
+	return t.move("copy", src, dst, false)
+}
+
+// copy 'src' to 'dst' and delete it if 'del' is true
+func (t *xact) move(op, src, dst string, del bool) error {
+	if len(src) == 0 || len(dst) == 0 {
+		return &StorageError{op, src, fmt.Errorf("can't %s the top of the db", op)}
+	}
+	if canonical(src) == canonical(dst) {
+		return &StorageError{op, src, fmt.Errorf("%w: %s is the same as the source", ErrExists, dst)}
+	}
+
+	val, err := t.Get(src)
+	switch {
+	case err == nil:
+		return t.moveLeaf(op, src, dst, val, del)
+	case !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrBucketNotFound):
+		return err
+	}
+
+	sv := strings.Split(src, "/")
+	dv := strings.Split(dst, "/")
+	if len(dv) > len(sv) && slices.Equal(dv[:len(sv)], sv) {
+		return &StorageError{op, src, fmt.Errorf("can't %s a bucket into itself", op)}
+	}
+
+	n, err := t.nodeAt(sv)
+	if err != nil {
+		return &StorageError{op, src, boltErr(err)}
+	}
+	if n == nil {
+		return &StorageError{op, src, ErrNotFound}
+	}
+
+	d, err := t.nodeAt(dv)
+	if err != nil {
+		return &StorageError{op, dst, boltErr(err)}
+	}
+	if d != nil {
+		return &StorageError{op, dst, ErrExists}
+	}
+
+	// read everything before writing: dst may be a sibling in the same
+	// bucket.
+	var dirs [][]string
+	var kv []KV
+	var meta []recMeta
+	if err = collect(n, nil, &dirs, &kv, &meta); err != nil {
+		return &StorageError{op, src, boltErr(err)}
+	}
+
+	if err = t.mkdir(dv); err != nil {
+		return &StorageError{op, dst, boltErr(err)}
+	}
+	for _, rel := range dirs {
+		if err = t.mkdir(append(slices.Clip(dv), rel...)); err != nil {
+			return &StorageError{op, dst, boltErr(err)}
+		}
+	}
+	var gone map[string]bool
+	if del {
+		gone = make(map[string]bool, len(kv))
+	}
+	for i := range kv {
+		r := &kv[i]
+		if del {
+			gone[canonical(src+"/"+r.Key)] = true
+		}
+		r.Key = dst + "/" + r.Key
+	}
+
+	if err = t.putMany(op, kv, meta, gone); err != nil {
+		return err
+	}
+	if del {
+		return t.DelDir(src, true)
+	}
+	return nil
+}
+
+// move or copy the record 'src' whose value is 'val' to 'dst'
+func (t *xact) moveLeaf(op, src, dst string, val []byte, del bool) error {
+	_, err := t.Get(dst)
+	switch {
+	case err == nil:
+		return &StorageError{op, dst, ErrExists}
+	case !errors.Is(err, ErrNotFound) && !errors.Is(err, ErrBucketNotFound):
+		return err
+	}
+
+	// a move isn't a modification: the record keeps its times
+	m, err := t.meta(src)
+	if err != nil {
+		return &StorageError{op, src, boltErr(err)}
+	}
+
+	var gone map[string]bool
+	if del {
+		gone = map[string]bool{canonical(src): true}
+	}
+
+	if err = t.putMany(op, []KV{{dst, val}}, []recMeta{m}, gone); err != nil {
+		return err
+	}
+	if del {
+		return t.del(src)
+	}
+	return nil
+}
+
+// make the bucket named by 'v' and its parents
+func (t *xact) mkdir(v []string) error {
+	if t.c.flat {
+		return t.flatMkdir(v)
+	}
+	_, _, err := t.walk(v, true)
+	return err
+}
+
+// return true if the bucket 'n' has neither records nor buckets
+func isEmpty(n findNode) (bool, error) {
+	for _, dirs := range []bool{false, true} {
+		names, err := n.names(dirs)
+		if len(names) > 0 || err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// gather the buckets and records - with their metadata - under the
+// bucket 'n' at 'rel' - a path relative to the start of the gathering.
+// Records that have expired are left behind.
+func collect(n findNode, rel []string, dirs *[][]string, kv *[]KV, meta *[]recMeta) error {
+	leaves, err := n.names(false)
+	if err != nil {
+		return err
+	}
+
+	for _, nm := range leaves {
+		val, m, err := n.read(nm)
+		if err == errExpired {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			return fmt.Errorf("%w: record %s is missing", ErrIntegrity, nm)
+		}
+		*kv = append(*kv, KV{dirPath(append(slices.Clip(rel), nm)), val})
+		*meta = append(*meta, m)
+	}
+
+	subs, err := n.names(true)
+	if err != nil {
+		return err
+	}
+
+	for _, nm := range subs {
+		sub, err := n.sub(nm)
+		if err != nil {
+			return err
+		}
+		if sub == nil {
+			continue
+		}
+
+		d := append(slices.Clip(rel), nm)
+		*dirs = append(*dirs, d)
+		if err = collect(sub, d, dirs, kv, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+// move_test.go -- tests for deleting, renaming and copying buckets
+
+package ebolt_test
+
+import (
+	"bytes"
+	"errors"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestMove(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  nil,
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 2},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		m := map[string][]byte{
+			"top":               randbytes(),
+			"tmp/upload-1/a":    randbytes(),
+			"tmp/upload-1/b":    randbytes(),
+			"tmp/upload-1/c/d":  randbytes(),
+			"sessions/2024/s1":  randbytes(),
+			"sessions/2024/s2":  randbytes(),
+			"sessions/2025/s3":  randbytes(),
+			"sessions/2024/x/y": randbytes(),
+		}
+		for k, v := range m {
+			err = db.Set(k, v)
+			assert(err == nil, "%s: set %s: %s", name, k, err)
+		}
+
+		expect := func(k string, v []byte) {
+			val, err := db.Get(k)
+			assert(err == nil, "%s: get %s: %s", name, k, err)
+			assert(bytes.Equal(val, v), "%s: get %s: content mismatch", name, k)
+		}
+		missing := func(k string) {
+			_, err := db.Get(k)
+			assert(err != nil, "%s: get %s: still exists", name, k)
+		}
+
+		// records
+		err = db.Rename("top", "files/top")
+		assert(err == nil, "%s: rename leaf: %s", name, err)
+		expect("files/top", m["top"])
+		missing("top")
+
+		err = db.Copy("files/top", "top")
+		assert(err == nil, "%s: copy leaf: %s", name, err)
+		expect("files/top", m["top"])
+		expect("top", m["top"])
+
+		err = db.Copy("files/top", "top")
+		assert(errors.Is(err, ebolt.ErrExists), "%s: copy over leaf: saw %v", name, err)
+
+		// buckets
+		err = db.Rename("tmp/upload-1", "files/report")
+		assert(err == nil, "%s: rename dir: %s", name, err)
+		for _, k := range []string{"a", "b", "c/d"} {
+			expect("files/report/"+k, m["tmp/upload-1/"+k])
+			missing("tmp/upload-1/" + k)
+		}
+
+		dirs, err := db.Dir("tmp")
+		assert(err == nil, "%s: dir: %s", name, err)
+		assert(len(dirs) == 0, "%s: dir: saw %v", name, dirs)
+
+		dirs, err = db.Dir("files")
+		assert(err == nil, "%s: dir: %s", name, err)
+		assert(slices.Equal(dirs, []string{"report"}), "%s: dir: saw %v", name, dirs)
+
+		// the sorted index of the new bucket is complete
+		kv, _, err := db.List("files/report", ebolt.ListOptions{})
+		assert(err == nil, "%s: list: %s", name, err)
+		assert(len(kv) == 2 && kv[0].Key == "files/report/a" && kv[1].Key == "files/report/b", "%s: list: saw %v", name, kv)
+
+		err = db.Copy("sessions", "archive/sessions")
+		assert(err == nil, "%s: copy dir: %s", name, err)
+		for k, v := range m {
+			if p, ok := strings.CutPrefix(k, "sessions/"); ok {
+				expect(k, v)
+				expect("archive/sessions/"+p, v)
+			}
+		}
+
+		err = db.Copy("sessions", "archive/sessions")
+		assert(errors.Is(err, ebolt.ErrExists), "%s: copy over dir: saw %v", name, err)
+		err = db.Rename("sessions", "sessions/2026")
+		assert(err != nil, "%s: renamed a bucket into itself", name)
+		err = db.Rename("nope", "nope2")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: rename missing: saw %v", name, err)
+
+		// empty buckets move too
+		err = db.Set("empty/x", []byte("x"))
+		assert(err == nil, "%s: set: %s", name, err)
+		err = db.Del("empty/x")
+		assert(err == nil, "%s: del: %s", name, err)
+		err = db.Rename("empty", "files/empty")
+		assert(err == nil, "%s: rename empty: %s", name, err)
+		_, err = db.AllKeys("files/empty")
+		assert(err == nil, "%s: all-keys: %s", name, err)
+
+		// deleting buckets
+		err = db.DelDir("sessions/2024", false)
+		assert(errors.Is(err, ebolt.ErrNotEmpty), "%s: del-dir: saw %v", name, err)
+		err = db.DelDir("files/empty", false)
+		assert(err == nil, "%s: del-dir empty: %s", name, err)
+		err = db.DelDir("sessions/2024", true)
+		assert(err == nil, "%s: del-dir: %s", name, err)
+		missing("sessions/2024/s1")
+		missing("sessions/2024/x/y")
+		expect("sessions/2025/s3", m["sessions/2025/s3"])
+		expect("archive/sessions/2024/s1", m["sessions/2024/s1"])
+
+		dirs, err = db.Dir("sessions")
+		assert(err == nil, "%s: dir: %s", name, err)
+		assert(slices.Equal(dirs, []string{"2025"}), "%s: dir: saw %v", name, dirs)
+
+		err = db.DelDir("sessions/2024", true)
+		assert(errors.Is(err, ebolt.ErrBucketNotFound), "%s: del-dir missing: saw %v", name, err)
+		err = db.DelDir("", true)
+		assert(err != nil, "%s: deleted the top of the db", name)
+
+		// all of it within one transaction
+		err = db.Update(func(tx ebolt.Tx) error {
+			if err := tx.Rename("archive", "old"); err != nil {
+				return err
+			}
+			return tx.DelDir("old/sessions/2025", true)
+		})
+		assert(err == nil, "%s: update: %s", name, err)
+		expect("old/sessions/2024/x/y", m["sessions/2024/x/y"])
+		missing("old/sessions/2025/s3")
+		db.Close()
+
+		// the new records survive a reopen
+		db, err = newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: reopen: %s", name, err)
+		expect("files/report/c/d", m["tmp/upload-1/c/d"])
+		db.Close()
+	}
+}
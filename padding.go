@@ -0,0 +1,138 @@
+// padding.go -- hiding the size of records
+
+package ebolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// Padding describes how records are padded before they're encrypted;
+// this hides the exact size of key-paths and values from anyone who
+// can read the file. Path segments - the names of buckets and records
+// - are padded too, by Pow2 or Block alone. The padding policy is
+// chosen when a db is created and is recorded in its format header,
+// sealed by the data key: the bucket names in Max don't appear in the
+// file.
+//
+// The plaintext of a record or segment is padded with a single 0x80
+// byte followed by zeros (ISO/IEC 7816-4); it decodes without knowing
+// the policy that padded it.
+type Padding struct {
+	// Pow2 pads every record to the next power of two
+	Pow2 bool `json:"pow2,omitempty"`
+
+	// Block pads every record to a multiple of Block bytes
+	Block int `json:"block,omitempty"`
+
+	// Max pads every record under the bucket named by the key to at
+	// least that many bytes: records of up to this size are then
+	// indistinguishable. When several buckets match a key-path, the
+	// deepest one applies. Pow2 or Block then apply to the result.
+	Max map[string]int `json:"max,omitempty"`
+}
+
+func (p *Padding) validate() error {
+	if p.Pow2 && p.Block > 0 {
+		return fmt.Errorf("padding: pow2 and block are exclusive")
+	}
+	if p.Block < 0 {
+		return fmt.Errorf("padding: invalid block size %d", p.Block)
+	}
+	for k, n := range p.Max {
+		if n < 0 {
+			return fmt.Errorf("padding: invalid max %d for %s", n, k)
+		}
+	}
+	return nil
+}
+
+// the padding feature of the format header: the policy itself is
+// sealed in a record of its own
+const paddingSealed = "sealed"
+
+// seal the policy for the format header with 'c', the encryptor of
+// the data key
+func (p *Padding) seal(c *encryptor) []byte {
+	b, err := json.Marshal(p)
+	if err != nil {
+		panic(fmt.Sprintf("padding: %s", err))
+	}
+	return c.seal(b)
+}
+
+// open the padding policy sealed in the header with 'c' - the
+// encryptor of the data key - and make 'c' use it
+func (h *header) openPadding(c *encryptor) error {
+	switch h.padding {
+	case "":
+		return nil
+	case paddingSealed:
+	default:
+		return fmt.Errorf("%w: padding %q", ErrFormat, h.padding)
+	}
+
+	b, err := c.unseal(h.policy)
+	if err != nil {
+		return fmt.Errorf("%w: padding: %w", ErrFormat, err)
+	}
+
+	var p Padding
+	if err = json.Unmarshal(b, &p); err != nil {
+		return fmt.Errorf("%w: padding: %w", ErrFormat, err)
+	}
+	if err = p.validate(); err != nil {
+		return fmt.Errorf("%w: %w", ErrFormat, err)
+	}
+
+	h.pad = &p
+	c.pad = h.pad
+	return nil
+}
+
+// return the padded size of a record of 'n' bytes for the key-path 'k'
+func (p *Padding) size(k string, n int) int {
+	var best string
+
+	lim := 0
+	for nm, sz := range p.Max {
+		if (k == nm || strings.HasPrefix(k, nm+"/")) && len(nm) >= len(best) {
+			best, lim = nm, sz
+		}
+	}
+	return p.round(max(n, lim))
+}
+
+// round 'n' up to the next power of two or multiple of the block size
+func (p *Padding) round(n int) int {
+	switch {
+	case p.Pow2 && n > 1:
+		n = 1 << bits.Len(uint(n-1))
+	case p.Block > 0:
+		n = (n + p.Block - 1) / p.Block * p.Block
+	}
+	return n
+}
+
+// pad the path segment - or sealed blob - 'nm'
+func (p *Padding) segment(nm []byte) []byte {
+	b := make([]byte, p.round(len(nm)+1))
+	b[copy(b, nm)] = 0x80
+	return b
+}
+
+// strip the padding of 'b'
+func unpad(b []byte) ([]byte, error) {
+	for i := len(b) - 1; i >= 0; i-- {
+		switch b[i] {
+		case 0:
+		case 0x80:
+			return b[:i], nil
+		default:
+			return nil, fmt.Errorf("padding: malformed")
+		}
+	}
+	return nil, fmt.Errorf("padding: malformed")
+}
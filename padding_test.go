@@ -0,0 +1,285 @@
+// padding_test.go -- record padding tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// return the size of the AEAD plaintext of every record in the
+// db in 'fn', by bucket; buckets are numbered depth first from 1.
+// Reserved records are skipped.
+func rawSizes(fn string) (map[int][]int, error) {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// aes-256-gcm: nonce and tag, and the metadata block that holds
+	// the expiry: its length, the expiry and a tag
+	const ov = 12 + 16 + 1 + 8 + 16
+
+	m := make(map[int][]int)
+	id := 0
+
+	var walk func(bu *bolt.Bucket, id int) error
+	walk = func(bu *bolt.Bucket, id int) error {
+		return bu.ForEach(func(k, v []byte) error {
+			if v == nil {
+				id++
+				return walk(bu.Bucket(k), id)
+			}
+			if len(k) > 8 {
+				m[id] = append(m[id], len(v)-ov)
+			}
+			return nil
+		})
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+			id++
+			return walk(bu, id)
+		})
+	})
+	return m, err
+}
+
+// return the size of the plaintext of every encrypted bucket and
+// record name in the db in 'fn'
+func rawNames(fn string) ([]int, error) {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	// aes-256-gcm: synthetic nonce and tag
+	const ov = 12 + 16
+
+	var sizes []int
+
+	var walk func(bu *bolt.Bucket) error
+	walk = func(bu *bolt.Bucket) error {
+		return bu.ForEach(func(k, v []byte) error {
+			if len(k) > 8 {
+				sizes = append(sizes, len(k)-ov)
+			}
+			if v == nil {
+				return walk(bu.Bucket(k))
+			}
+			return nil
+		})
+	}
+
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+			sizes = append(sizes, len(nm)-ov)
+			return walk(bu)
+		})
+	})
+	return sizes, err
+}
+
+func TestPadding(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	sizes := []int{0, 1, 15, 16, 100, 255, 256, 1000, 5000}
+	fill := func(fn string, bucket string, pad *ebolt.Padding) map[string][]byte {
+		db, err := newBoltOpt(fn, "key", &ebolt.Config{Padding: pad})
+		assert(err == nil, "%s: open: %s", fn, err)
+		defer db.Close()
+
+		m := make(map[string][]byte)
+		for i, n := range sizes {
+			k := fmt.Sprintf("%s/%d", bucket, i)
+			// values that look like padding
+			m[k] = bytes.Repeat([]byte{0x80, 0}, n)[:n]
+			err = db.Set(k, m[k])
+			assert(err == nil, "%s: set %s: %s", fn, k, err)
+		}
+		return m
+	}
+
+	verify := func(fn string, m map[string][]byte) {
+		// the policy comes from the header
+		db, err := newBolt(fn, "key")
+		assert(err == nil, "%s: reopen: %s", fn, err)
+		defer db.Close()
+
+		for k, v := range m {
+			z, err := db.Get(k)
+			assert(err == nil, "%s: get %s: %s", fn, k, err)
+			assert(bytes.Equal(z, v), "%s: get %s: content mismatch", fn, k)
+		}
+	}
+
+	// power of two
+	fn := path.Join(tmp, "pow2.db")
+	m := fill(fn, "a", &ebolt.Padding{Pow2: true})
+	verify(fn, m)
+
+	raw, err := rawSizes(fn)
+	assert(err == nil, "raw: %s", err)
+	assert(len(raw[1]) == len(sizes), "pow2: exp %d records, saw %d", len(sizes), len(raw[1]))
+	for _, n := range raw[1] {
+		assert(n&(n-1) == 0, "pow2: saw size %d", n)
+	}
+
+	// fixed block
+	fn = path.Join(tmp, "block.db")
+	m = fill(fn, "a", &ebolt.Padding{Block: 256})
+	verify(fn, m)
+
+	raw, err = rawSizes(fn)
+	assert(err == nil, "raw: %s", err)
+	assert(len(raw[1]) == len(sizes), "block: exp %d records, saw %d", len(sizes), len(raw[1]))
+	for _, n := range raw[1] {
+		assert(n%256 == 0, "block: saw size %d", n)
+	}
+
+	// and so are the names
+	names, err := rawNames(fn)
+	assert(err == nil, "raw names: %s", err)
+	assert(len(names) == len(sizes)+1, "block: exp %d names, saw %d", len(sizes)+1, len(names))
+	for _, n := range names {
+		assert(n == 256, "block: saw name size %d", n)
+	}
+
+	// per-bucket max: every record in the bucket is the same size
+	fn = path.Join(tmp, "max.db")
+	m = fill(fn, "secrets/keys", &ebolt.Padding{Max: map[string]int{"secrets": 8192}})
+	verify(fn, m)
+
+	raw, err = rawSizes(fn)
+	assert(err == nil, "raw: %s", err)
+	assert(len(raw[2]) == len(sizes), "max: exp %d records, saw %d", len(sizes), len(raw[2]))
+	for _, n := range raw[2] {
+		assert(n == 8192, "max: saw size %d", n)
+	}
+
+	// the policy names buckets; it's sealed in the header
+	b, err := os.ReadFile(fn)
+	assert(err == nil, "read: %s", err)
+	assert(!bytes.Contains(b, []byte("secrets")), "max: bucket name is in the file")
+	assert(!bytes.Contains(b, []byte("8192")), "max: policy is in the file")
+
+	// a rekey reseals it; one that's interrupted is finished with the
+	// new key
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+	nk := sha3.Sum256([]byte("new"))
+	err = ebolt.InterruptRekey(db, nk[:], 3)
+	assert(err == nil, "interrupt: %s", err)
+	db.Close()
+
+	db, err = newBolt(fn, "new")
+	assert(err == nil, "resume: %s", err)
+	for k, v := range m {
+		z, err := db.Get(k)
+		assert(err == nil, "rekey: get %s: %s", k, err)
+		assert(bytes.Equal(z, v), "rekey: get %s: content mismatch", k)
+	}
+	db.Close()
+
+	raw, err = rawSizes(fn)
+	assert(err == nil, "raw: %s", err)
+	for _, n := range raw[2] {
+		assert(n == 8192, "rekey: saw size %d", n)
+	}
+
+	_, err = newBoltOpt(path.Join(tmp, "bad.db"), "key", &ebolt.Config{
+		Padding: &ebolt.Padding{Pow2: true, Block: 16},
+	})
+	assert(errors.Is(err, ebolt.ErrConfig), "bad padding policy: exp config error, saw %v", err)
+}
+
+// the sorted and blind indexes, the flat directories and the List()
+// tokens are padded like the records
+func TestPaddingIndexes(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	const block = 256
+
+	// aes-256-gcm: nonce and tag
+	const ov = 12 + 16
+
+	for _, flat := range []bool{false, true} {
+		fn := path.Join(tmp, fmt.Sprintf("indexes-%v.db", flat))
+		opt := &ebolt.Config{
+			Flat:    flat,
+			Padding: &ebolt.Padding{Block: block},
+			Indexes: []ebolt.Index{emailIndex()},
+		}
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", fn, err)
+
+		for i := range 20 {
+			k := fmt.Sprintf("users/user-%d", i)
+			v := fmt.Sprintf(`{"email": "%s@example.com"}`, strings.Repeat("x", i))
+			err = db.Set(k, []byte(v))
+			assert(err == nil, "%s: set %s: %s", fn, k, err)
+		}
+
+		_, tok, err := db.List("users", ebolt.ListOptions{Limit: 3})
+		assert(err == nil, "%s: list: %s", fn, err)
+		ct, err := base64.RawURLEncoding.DecodeString(tok)
+		assert(err == nil, "%s: token: %s", fn, err)
+		assert((len(ct)-ov)%block == 0, "%s: token: unpadded size %d", fn, len(ct)-ov)
+		db.Close()
+
+		raw, err := bolt.Open(fn, 0600, nil)
+		assert(err == nil, "%s: raw open: %s", fn, err)
+
+		var walk func(bu *bolt.Bucket, blind bool) error
+		walk = func(bu *bolt.Bucket, blind bool) error {
+			return bu.ForEach(func(k, v []byte) error {
+				switch {
+				case v == nil:
+					return walk(bu.Bucket(k), blind)
+				case blind && string(k) != ".spec", !blind && len(k) <= 8:
+					assert((len(v)-ov)%block == 0, "%s: index %x: unpadded size %d", fn, k, len(v)-ov)
+				case !blind && flat:
+					// leaves and directories carry a metadata block
+					n := len(v) - ov - 1 - 8 - 16
+					assert(n%block == 0, "%s: flat %x: unpadded size %d", fn, k, n)
+				}
+				return nil
+			})
+		}
+
+		err = raw.View(func(tx *bolt.Tx) error {
+			return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+				if string(nm) == ".ebolt" {
+					return nil
+				}
+				return walk(bu, string(nm) == ".blind")
+			})
+		})
+		assert(err == nil, "%s: raw view: %s", fn, err)
+		raw.Close()
+	}
+}
@@ -0,0 +1,240 @@
+// rekey.go -- re-encrypting the db under a new key
+
+package ebolt
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A Rekey moves every record from the encoding of the old data key to
+// that of a new, random data key in bounded write transactions (see
+// reencrypt()). Before the first record moves, we record a journal in
+// the format header holding each data key sealed under the other and
+// the new data key wrapped for the new key. If the rekey is
+// interrupted, the next Open() - with either the old or the new key -
+// recovers the other data key from the journal and finishes the job.
+type journal struct {
+	// the new data key sealed with the old one
+	next []byte
+
+	// the old data key sealed with the new one
+	prev []byte
+
+	// the header MAC under the new data key
+	check []byte
+
+	// the new data key wrapped by the KeyWrapper named 'wrap'
+	dek  []byte
+	wrap []byte
+}
+
+func (j *journal) fields() []*[]byte {
+	return []*[]byte{&j.next, &j.prev, &j.check, &j.dek, &j.wrap}
+}
+
+func (j *journal) marshal() []byte {
+	var b []byte
+	var n [4]byte
+
+	for _, f := range j.fields() {
+		enc32(n[:], len(*f))
+		b = append(b, n[:]...)
+		b = append(b, *f...)
+	}
+	return b
+}
+
+func unmarshalJournal(b []byte) (*journal, error) {
+	var j journal
+	var ok bool
+
+	for _, f := range j.fields() {
+		if b, *f, ok = decField(b); !ok {
+			return nil, fmt.Errorf("%w: malformed rekey journal", ErrFormat)
+		}
+	}
+	return &j, nil
+}
+
+// Rekey re-encrypts every bucket name and value under a new, random
+// data key and wraps it with 'key' - as if the db was opened with
+// Open(fn, key, ..). Keyed buckets get new keys of their own. The
+// database stays open while this happens; other transactions wait for
+// it to complete. A Rekey interrupted by a crash is completed the next
+// time the database is opened with either the old or the new key.
+//
+// The other key slots wrap the old data key and are dropped; the new
+// data key is held in a single slot named "default". To only change
+// the key protecting the data key, use Rewrap().
+func (b *bdb) Rekey(key []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db.IsReadOnly() {
+		return &StorageError{"rekey", "", ErrReadOnly}
+	}
+
+	dek := newDEK()
+	cur, h, j, err := b.startRekey(dek, newKeyWrapper(key))
+	if err != nil {
+		return &StorageError{"rekey", "", err}
+	}
+
+	if err = b.finishRekey(b.c, cur, h, j); err != nil {
+		return &StorageError{"rekey", "", err}
+	}
+
+	b.use(dek, h, cur)
+	b.slot = defaultSlot
+
+	// the indexes were keyed by the old data key
+	if err = b.buildIndexes(); err != nil {
+		return &StorageError{"rekey", "", err}
+	}
+	return nil
+}
+
+// Rewrap protects the data key with 'w' instead of the key the db was
+// opened with: it replaces the key slot that was used to open the db.
+// Nothing else is re-encrypted.
+func (b *bdb) Rewrap(w KeyWrapper) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.db.IsReadOnly() {
+		return &StorageError{"rewrap", "", ErrReadOnly}
+	}
+
+	blob, err := w.Wrap(b.dek)
+	if err != nil {
+		return &StorageError{"rewrap", "", err}
+	}
+
+	h := *b.h
+	h.slots = replaceSlot(h.slots, keySlot{b.slot, w.Name(), blob})
+	if err = b.writeHeader(&h); err != nil {
+		return &StorageError{"rewrap", "", err}
+	}
+	return nil
+}
+
+// record the journal for moving to the data key 'dek' wrapped by 'w';
+// return the encryptor for it along with the header and journal.
+func (b *bdb) startRekey(dek []byte, w KeyWrapper) (*encryptor, *header, *journal, error) {
+	cur, err := newEncryptor(dek, b.h)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	blob, err := w.Wrap(dek)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("wrap: %w", err)
+	}
+
+	h := *b.h
+	j := &journal{
+		next:  b.c.seal(dek),
+		prev:  cur.seal(b.dek),
+		check: cur.check(h.marshal()),
+		dek:   blob,
+		wrap:  []byte(w.Name()),
+	}
+
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put(metaRekey, j.marshal())
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return cur, &h, j, nil
+}
+
+// resumeRekey completes a rekey that was interrupted; 'w' unwraps
+// either the old or the new data key.
+func (b *bdb) resumeRekey(w KeyWrapper, h *header) error {
+	j, err := unmarshalJournal(h.rekey)
+	if err != nil {
+		return err
+	}
+
+	var old, cur *encryptor
+	var dek []byte
+
+	if prev, _, err := h.unwrap(w); err == nil {
+		// we were given the old key
+		if old, err = newEncryptor(prev, h); err != nil {
+			return err
+		}
+		if err = h.openPadding(old); err != nil {
+			return err
+		}
+		if dek, err = old.unseal(j.next); err != nil {
+			return err
+		}
+		if cur, err = newEncryptor(dek, h); err != nil {
+			return err
+		}
+	} else if dek, err = unwrap(w, string(j.wrap), j.dek); err == nil {
+		// we were given the new key
+		if cur, err = newEncryptor(dek, h); err != nil {
+			return err
+		}
+
+		prev, err := cur.unseal(j.prev)
+		if err != nil {
+			return err
+		}
+		if old, err = newEncryptor(prev, h); err != nil {
+			return err
+		}
+
+		// the policy is sealed by the old data key until we're done
+		if err = h.openPadding(old); err != nil {
+			return err
+		}
+		cur.pad = h.pad
+	} else {
+		return err
+	}
+
+	if b.db.IsReadOnly() {
+		return fmt.Errorf("%w: interrupted rekey; open the db for writing to finish it", ErrFormat)
+	}
+
+	if err = b.finishRekey(old, cur, h, j); err != nil {
+		return fmt.Errorf("rekey: %w", err)
+	}
+
+	b.use(dek, h, cur)
+	b.slot = defaultSlot
+	return nil
+}
+
+// move every record from 'old' to 'cur' and retire the journal 'j'
+func (b *bdb) finishRekey(old, cur *encryptor, h *header, j *journal) error {
+	if err := b.reencrypt(h, old, cur, reencryptBatch); err != nil {
+		return err
+	}
+
+	h.check = j.check
+	h.slots = []keySlot{{defaultSlot, string(j.wrap), j.dek}}
+	h.rekey = nil
+	if h.pad != nil {
+		h.policy = h.pad.seal(cur)
+	}
+	return b.db.Update(func(tx *bolt.Tx) error {
+		if err := writeHeader(tx, h); err != nil {
+			return err
+		}
+
+		// index entries are rebuilt under the new key
+		if tx.Bucket(blindBucket) != nil {
+			if err := tx.DeleteBucket(blindBucket); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(metaBucket).Delete(metaRekey)
+	})
+}
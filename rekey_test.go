@@ -0,0 +1,123 @@
+// rekey_test.go -- key rotation tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"errors"
+	"fmt"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func fillRekey(t *testing.T, db ebolt.DB) map[string][]byte {
+	assert := newAsserter(t)
+
+	m := map[string][]byte{
+		"a/b/c/001": randbytes(),
+		"a/b/d/002": randbytes(),
+		"a/x":       randbytes(),
+		"top":       randbytes(),
+	}
+
+	// more than one batch worth of records
+	for i := range 1500 {
+		k := fmt.Sprintf("bulk/%04d", i)
+		m[k] = []byte(k)
+	}
+
+	kv := make([]ebolt.KV, 0, len(m))
+	for k, v := range m {
+		kv = append(kv, ebolt.KV{Key: k, Val: v})
+	}
+
+	err := db.SetMany(kv)
+	assert(err == nil, "set-many: %s", err)
+	return m
+}
+
+func verifyRekey(t *testing.T, db ebolt.DB, m map[string][]byte) {
+	assert := newAsserter(t)
+
+	for k, v := range m {
+		z, err := db.Get(k)
+		assert(err == nil, "get %s: %s", k, err)
+		assert(bytes.Equal(z, v), "get %s: content mismatch", k)
+	}
+
+	dirs, err := db.Dir("a/b")
+	assert(err == nil, "dir: %s", err)
+	assert(len(dirs) == 2, "dir: exp 2 subdirs, saw %d", len(dirs))
+}
+
+func TestRekey(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "rekey.db")
+
+	db, err := newBolt(fn, "old")
+	assert(err == nil, "open: %s", err)
+
+	m := fillRekey(t, db)
+
+	nk := sha3.Sum256([]byte("new"))
+	err = db.Rekey(nk[:])
+	assert(err == nil, "rekey: %s", err)
+
+	// the open db uses the new key right away
+	verifyRekey(t, db, m)
+	err = db.Set("after/rekey", []byte("v"))
+	assert(err == nil, "set: %s", err)
+	m["after/rekey"] = []byte("v")
+	db.Close()
+
+	_, err = newBolt(fn, "old")
+	assert(errors.Is(err, ebolt.ErrWrongKey), "old key: exp wrong-key, saw %v", err)
+
+	db, err = newBolt(fn, "new")
+	assert(err == nil, "open with new key: %s", err)
+	defer db.Close()
+
+	verifyRekey(t, db, m)
+}
+
+func TestRekeyResume(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	// resume with either key
+	for _, pw := range []string{"old", "new"} {
+		fn := path.Join(tmp, pw+".db")
+		db, err := newBolt(fn, "old")
+		assert(err == nil, "open: %s", err)
+
+		m := fillRekey(t, db)
+
+		nk := sha3.Sum256([]byte("new"))
+		err = ebolt.InterruptRekey(db, nk[:], 700)
+		assert(err == nil, "interrupt: %s", err)
+		db.Close()
+
+		_, err = newBolt(fn, "other")
+		assert(errors.Is(err, ebolt.ErrWrongKey), "%s: exp wrong-key, saw %v", pw, err)
+
+		db, err = newBolt(fn, pw)
+		assert(err == nil, "%s: resume: %s", pw, err)
+		verifyRekey(t, db, m)
+		db.Close()
+
+		// once finished, only the new key works
+		_, err = newBolt(fn, "old")
+		assert(errors.Is(err, ebolt.ErrWrongKey), "%s: exp wrong-key, saw %v", pw, err)
+
+		db, err = newBolt(fn, "new")
+		assert(err == nil, "%s: reopen: %s", pw, err)
+		verifyRekey(t, db, m)
+		db.Close()
+	}
+}
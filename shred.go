@@ -0,0 +1,473 @@
+// shred.go -- per-bucket keys and crypto-shredding
+
+package ebolt
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A db can give each bucket up to a chosen depth (Config.KeyDepth) a
+// random key of its own. Everything inside the bucket - names of
+// records and sub-buckets as well as values - is encrypted with an
+// encryptor made from the bucket's key.
+//
+// The keys live in a key table: a reserved top-level bucket that maps
+// a random key id to the key sealed by the table key. A keyed bucket
+// only holds the id of its key. The table key is derived from the data
+// key and a random salt kept in the table.
+//
+// Shred() deletes a bucket and drops its keys from the table in a write
+// transaction that is never committed. Anyone with the data key can open
+// every entry of the table, so the entries must be gone from the file:
+// bbolt keeps what a commit frees in its free pages. Instead, everything
+// the transaction sees is copied - by bbolt - into a new file that
+// replaces the db. The old file is then overwritten with zeros. A crash
+// before the new file is in place leaves the db as it was; a crash after
+// leaves the old file unlinked, but not overwritten.
+//
+// Shred() can't reach copies of the file made before it (backups,
+// snapshots) or the blocks a filesystem or a disk keeps behind when
+// they are overwritten (e.g. copy-on-write filesystems or SSD wear
+// leveling): it's best effort.
+//
+// A Rekey() gives every keyed bucket a new key and re-encrypts its
+// contents (see migrate.go).
+
+// the reserved record of a keyed bucket holding the id of its key. An
+// encrypted name is never this short.
+var bucketKey = []byte(".key")
+
+// the key table and its reserved record holding the salt of the table
+// key
+var (
+	keyTable  = []byte(".keys")
+	tableSalt = []byte(".salt")
+)
+
+// size of key ids and of the salt of the table key
+const (
+	keyIDSize = 16
+	saltSize  = 32
+)
+
+// number of records and buckets written by each transaction of the copy
+// made by Shred()
+const shredBatch = 4096
+
+// return true if 'k' is a reserved record rather than an encrypted name
+func isReserved(k []byte) bool {
+	return string(k) == string(bucketKey) || isIndex(k)
+}
+
+// return the key depth recorded in the header
+func (h *header) keyDepth() (int, error) {
+	if len(h.keydepth) == 0 {
+		return 0, nil
+	}
+
+	n, err := strconv.Atoi(h.keydepth)
+	if err != nil || n < 1 {
+		return 0, fmt.Errorf("%w: key depth %q", ErrFormat, h.keydepth)
+	}
+	return n, nil
+}
+
+// return the encryptor for the entries of a key table whose salt is
+// 'salt' in a db whose data key is behind 'c'
+func tableKey(c *encryptor, h *header, salt []byte) (*encryptor, error) {
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("%w: key table salt is malformed", ErrIntegrity)
+	}
+
+	k := expand(dekSize, c.tab, "Key Table Key", salt)
+	defer clear(k)
+
+	return newEncryptor(k, h)
+}
+
+// add a random key to the key table 'tab' whose entries are sealed by
+// 'tk'; return its id and the encryptor made from it.
+func addKey(tab *bolt.Bucket, tk *encryptor, h *header) ([]byte, *encryptor, error) {
+	k := newDEK()
+	defer clear(k)
+
+	bc, err := newEncryptor(k, h)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	id := randfill(make([]byte, keyIDSize))
+	if err = tab.Put(id, tk.seal(k)); err != nil {
+		return nil, nil, err
+	}
+	return id, bc, nil
+}
+
+// return the encryptor made from the key 'id' in the key table 'tab'
+// whose entries are sealed by 'tk'
+func openKey(tab *bolt.Bucket, tk *encryptor, h *header, id []byte) (*encryptor, error) {
+	var w []byte
+	if tab != nil {
+		w = tab.Get(id)
+	}
+	if w == nil {
+		return nil, fmt.Errorf("%w: bucket key %x is not in the key table", ErrIntegrity, id)
+	}
+
+	k, err := tk.unseal(w)
+	if err != nil {
+		return nil, fmt.Errorf("bucket key: %w", err)
+	}
+	defer clear(k)
+
+	return newEncryptor(k, h)
+}
+
+// append the key ids of the keyed bucket 'bu' at depth 'd' - and of
+// the keyed buckets below it - to 'ids'
+func keyIDs(ids [][]byte, bu *bolt.Bucket, d, depth int) [][]byte {
+	if d > depth {
+		return ids
+	}
+
+	if id := bu.Get(bucketKey); id != nil {
+		ids = append(ids, slices.Clone(id))
+	}
+
+	bu.ForEachBucket(func(k []byte) error {
+		ids = keyIDs(ids, bu.Bucket(k), d+1, depth)
+		return nil
+	})
+	return ids
+}
+
+// return the key table and the encryptor for its entries. A missing
+// table is created if 'mk' is true; else it's returned as nil.
+func (t *xact) keyTable(mk bool) (*bolt.Bucket, *encryptor, error) {
+	tab := t.Bucket(keyTable)
+	if tab == nil {
+		if !mk {
+			return nil, nil, nil
+		}
+
+		var err error
+		if tab, err = t.CreateBucket(keyTable); err != nil {
+			return nil, nil, err
+		}
+		if err = tab.Put(tableSalt, randfill(make([]byte, saltSize))); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if t.tk == nil {
+		tk, err := tableKey(t.c, t.h, tab.Get(tableSalt))
+		if err != nil {
+			return nil, nil, err
+		}
+		t.tk = tk
+	}
+	return tab, t.tk, nil
+}
+
+// return the encryptor for the contents of the keyed bucket 'bu'. A
+// 'fresh' bucket gets a new key.
+func (t *xact) bucketKey(bu *bolt.Bucket, fresh bool) (*encryptor, error) {
+	id := bu.Get(bucketKey)
+	if id == nil {
+		if !fresh {
+			return nil, fmt.Errorf("%w: bucket key is missing", ErrIntegrity)
+		}
+
+		tab, tk, err := t.keyTable(true)
+		if err != nil {
+			return nil, err
+		}
+
+		id, bc, err := addKey(tab, tk, t.h)
+		if err != nil {
+			return nil, err
+		}
+		if err = bu.Put(bucketKey, id); err != nil {
+			return nil, err
+		}
+
+		t.keys.Store(string(id), bc)
+		return bc, nil
+	}
+
+	if bc, ok := t.keys.Load(string(id)); ok {
+		return bc.(*encryptor), nil
+	}
+
+	tab, tk, err := t.keyTable(false)
+	if err != nil {
+		return nil, err
+	}
+
+	bc, err := openKey(tab, tk, t.h, id)
+	if err != nil {
+		return nil, err
+	}
+
+	t.keys.Store(string(id), bc)
+	return bc, nil
+}
+
+// Shred deletes the bucket 'p' along with its key and replaces the file
+// with a copy that holds nothing of either; the old file is overwritten
+// with zeros. Only buckets that have a key of their own (see
+// Config.KeyDepth) can be shredded. Other transactions wait for it to
+// complete.
+func (b *bdb) Shred(p string) error {
+	v := splitBucket(p)
+	if len(p) == 0 || len(v) > b.depth {
+		return &StorageError{"shred", p, fmt.Errorf("bucket doesn't have a key of its own")}
+	}
+
+	// no other transaction may use the file we replace
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bt, err := b.db.Begin(true)
+	if err != nil {
+		return &StorageError{"shred", p, boltErr(err)}
+	}
+
+	tx := b.newXact(bt, nil)
+	defer tx.Rollback()
+
+	if err = tx.unindexDir(v); err != nil {
+		return &StorageError{"shred", p, boltErr(err)}
+	}
+	if err = tx.shred(v); err != nil {
+		return &StorageError{"shred", p, boltErr(err)}
+	}
+
+	fn := b.db.Path()
+	tmp := fn + ".shred"
+	if err = copyTx(bt, tmp); err != nil {
+		os.Remove(tmp)
+		return &StorageError{"shred", p, boltErr(err)}
+	}
+
+	// the shred is in the copy alone
+	tx.Rollback()
+	if err = b.replace(tmp); err != nil {
+		return &StorageError{"shred", p, boltErr(err)}
+	}
+	return nil
+}
+
+// delete the bucket named by 'v' and drop its keys from the key table
+func (t *xact) shred(v []string) error {
+	n := len(v) - 1
+
+	up, c, err := t.walk(v[:n], false)
+	if err != nil {
+		return err
+	}
+	if n > 0 && up == nil {
+		return ErrBucketNotFound
+	}
+
+	var bu *bolt.Bucket
+
+	nm := c.encSegment(v[n])
+	if n == 0 {
+		bu = t.Bucket(nm)
+	} else {
+		bu = up.Bucket(nm)
+	}
+	if bu == nil {
+		return ErrBucketNotFound
+	}
+
+	ids := keyIDs(nil, bu, n+1, t.depth)
+	if n == 0 {
+		err = t.DeleteBucket(nm)
+	} else {
+		err = up.DeleteBucket(nm)
+	}
+	if err != nil {
+		return err
+	}
+	return t.dropKeys(ids)
+}
+
+// remove the keys 'ids' from the key table and from the cache
+func (t *xact) dropKeys(ids [][]byte) error {
+	tab := t.Bucket(keyTable)
+	if tab == nil {
+		return nil
+	}
+
+	for _, id := range ids {
+		t.keys.Delete(string(id))
+		if err := tab.Delete(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write everything 'src' sees to a new db in 'fn' - with the mode of
+// the db of 'src' - in transactions of at most shredBatch records and
+// buckets each.
+func copyTx(src *bolt.Tx, fn string) error {
+	fi, err := os.Stat(src.DB().Path())
+	if err != nil {
+		return err
+	}
+
+	// a copy left behind by a crash would be merged with ours
+	if err = os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	db, err := bolt.Open(fn, fi.Mode().Perm(), nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin(true)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		tx.Rollback()
+	}()
+
+	// the bucket of the copy at 'dir'; the transaction changes as
+	// batches are committed
+	bucket := func(dir [][]byte) *bolt.Bucket {
+		bu := tx.Bucket(dir[0])
+		for _, nm := range dir[1:] {
+			bu = bu.Bucket(nm)
+		}
+		return bu
+	}
+
+	var n int
+	next := func() error {
+		if n++; n < shredBatch {
+			return nil
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+
+		var err error
+		tx, err = db.Begin(true)
+		n = 0
+		return err
+	}
+
+	var cp func(from *bolt.Bucket, dir [][]byte) error
+	cp = func(from *bolt.Bucket, dir [][]byte) error {
+		if err := bucket(dir).SetSequence(from.Sequence()); err != nil {
+			return err
+		}
+
+		return from.ForEach(func(k, v []byte) error {
+			if v != nil {
+				if err := bucket(dir).Put(k, v); err != nil {
+					return err
+				}
+				return next()
+			}
+
+			if _, err := bucket(dir).CreateBucket(k); err != nil {
+				return err
+			}
+			if err := next(); err != nil {
+				return err
+			}
+			return cp(from.Bucket(k), append(slices.Clip(dir), k))
+		})
+	}
+
+	err = src.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+		if _, err := tx.CreateBucket(nm); err != nil {
+			return err
+		}
+		if err := next(); err != nil {
+			return err
+		}
+		return cp(bu, [][]byte{nm})
+	})
+	if err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	return db.Close()
+}
+
+// replace the file of the db with 'fn' - a copy made by copyTx() - and
+// overwrite the old file with zeros once bbolt has let go of it. The
+// caller holds b.mu: no transaction is left that uses the old file.
+func (b *bdb) replace(fn string) error {
+	path := b.db.Path()
+
+	old, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	if err = b.db.Close(); err != nil {
+		return err
+	}
+
+	err = os.Rename(fn, path)
+	if err == nil {
+		err = syncDir(filepath.Dir(path))
+	}
+
+	// the db is reopened whether or not the copy replaced it
+	db, oerr := bolt.Open(path, 0600, b.bopt)
+	if oerr != nil {
+		return fmt.Errorf("reopen: %w", oerr)
+	}
+	b.db = db
+	if err != nil {
+		os.Remove(fn)
+		return err
+	}
+	return zeroFile(old)
+}
+
+// overwrite the file 'fd' with zeros
+func zeroFile(fd *os.File) error {
+	fi, err := fd.Stat()
+	if err != nil {
+		return err
+	}
+
+	zero := make([]byte, 1<<20)
+	for off := int64(0); off < fi.Size(); off += int64(len(zero)) {
+		n := min(int64(len(zero)), fi.Size()-off)
+		if _, err = fd.WriteAt(zero[:n], off); err != nil {
+			return err
+		}
+	}
+	return fd.Sync()
+}
+
+// flush the directory 'dir' so that a rename in it is durable
+func syncDir(dir string) error {
+	fd, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return fd.Sync()
+}
@@ -0,0 +1,207 @@
+// shred_test.go -- per-bucket keys and crypto-shredding tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"crypto/sha3"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+// the sealed entries of the key table in the db 'fn', by key id; and
+// the key id of the second level bucket that has sub-buckets of its own
+func readKeyTable(t *testing.T, fn string) (map[string][]byte, []byte) {
+	assert := newAsserter(t)
+
+	raw, err := bolt.Open(fn, 0600, &bolt.Options{ReadOnly: true})
+	assert(err == nil, "raw open: %s", err)
+	defer raw.Close()
+
+	tab := make(map[string][]byte)
+
+	var nested []byte
+	err = raw.View(func(tx *bolt.Tx) error {
+		kt := tx.Bucket([]byte(".keys"))
+		assert(kt != nil, "raw: no key table")
+		kt.ForEach(func(k, v []byte) error {
+			tab[string(k)] = bytes.Clone(v)
+			return nil
+		})
+
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if nm[0] == '.' {
+				return nil
+			}
+			return bu.ForEachBucket(func(k []byte) error {
+				sub := bu.Bucket(k)
+				if sub.Stats().BucketN > 1 {
+					nested = bytes.Clone(sub.Get([]byte(".key")))
+				}
+				return nil
+			})
+		})
+	})
+	assert(err == nil, "raw view: %s", err)
+	return tab, nested
+}
+
+func TestShred(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "shred.db")
+
+	db, err := newBoltOpt(fn, "key", &ebolt.Config{KeyDepth: 2})
+	assert(err == nil, "open: %s", err)
+
+	m := map[string][]byte{
+		"tenants/acme/users/1": randbytes(),
+		"tenants/acme/name":    randbytes(),
+		"tenants/globex/name":  randbytes(),
+		"other/x":              randbytes(),
+		"top":                  randbytes(),
+	}
+	for k, v := range m {
+		err = db.Set(k, v)
+		assert(err == nil, "set %s: %s", k, err)
+	}
+	db.Close()
+
+	// acme is the only second level bucket with a sub-bucket
+	old, acme := readKeyTable(t, fn)
+	assert(acme != nil, "raw: can't find acme")
+	assert(old[string(acme)] != nil, "raw: acme's key isn't in the key table")
+
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+
+	for k, v := range m {
+		z, err := db.Get(k)
+		assert(err == nil, "get %s: %s", k, err)
+		assert(bytes.Equal(z, v), "get %s: content mismatch", k)
+	}
+
+	err = db.Shred("tenants/acme/users")
+	assert(err != nil, "shredded a bucket without a key of its own")
+
+	err = db.Shred("tenants/initech")
+	assert(errors.Is(err, ebolt.ErrBucketNotFound), "shred missing: exp not-found, saw %v", err)
+
+	// the file as it was before the shred
+	before, err := os.Open(fn)
+	assert(err == nil, "open file: %s", err)
+	defer before.Close()
+
+	err = db.Shred("tenants/acme")
+	assert(err == nil, "shred: %s", err)
+
+	_, err = db.Get("tenants/acme/name")
+	assert(err != nil, "get: shredded record is still there")
+
+	dirs, err := db.Dir("tenants")
+	assert(err == nil, "dir: %s", err)
+	assert(len(dirs) == 1 && dirs[0] == "globex", "dir: exp [globex], saw %v", dirs)
+	db.Close()
+
+	// nothing that sealed acme's key is left anywhere in the file - and
+	// the file it replaced is all zeros
+	b, err := os.ReadFile(fn)
+	assert(err == nil, "read: %s", err)
+	assert(!bytes.Contains(b, old[string(acme)]), "file: acme's key is still there")
+	assert(!bytes.Contains(b, acme), "file: acme's key id is still there")
+
+	b, err = io.ReadAll(before)
+	assert(err == nil, "read old file: %s", err)
+	assert(len(b) > 0 && bytes.Count(b, []byte{0}) == len(b), "old file: not overwritten")
+
+	_, err = os.Stat(fn + ".shred")
+	assert(os.IsNotExist(err), "the copy was left behind: %v", err)
+
+	cur, _ := readKeyTable(t, fn)
+	assert(len(cur) == len(old)-1, "key table: exp %d entries, saw %d", len(old)-1, len(cur))
+	assert(cur[string(acme)] == nil, "key table: acme's key is still there")
+
+	db, err = newBolt(fn, "key")
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	for _, k := range []string{"tenants/globex/name", "other/x", "top"} {
+		z, err := db.Get(k)
+		assert(err == nil, "get %s: %s", k, err)
+		assert(bytes.Equal(z, m[k]), "get %s: content mismatch", k)
+	}
+}
+
+func TestShredNoKeys(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "shred0.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	defer db.Close()
+
+	err = db.Set("tenants/acme/name", randbytes())
+	assert(err == nil, "set: %s", err)
+
+	err = db.Shred("tenants")
+	assert(err != nil, "shredded a bucket without a key of its own")
+}
+
+func TestShredRekey(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "shred-rekey.db")
+
+	db, err := newBoltOpt(fn, "old", &ebolt.Config{KeyDepth: 2})
+	assert(err == nil, "open: %s", err)
+
+	m := fillRekey(t, db)
+	db.Close()
+
+	old, _ := readKeyTable(t, fn)
+
+	db, err = newBolt(fn, "old")
+	assert(err == nil, "reopen: %s", err)
+
+	nk := sha3.Sum256([]byte("new"))
+	err = ebolt.InterruptRekey(db, nk[:], 700)
+	assert(err == nil, "interrupt: %s", err)
+	db.Close()
+
+	db, err = newBolt(fn, "new")
+	assert(err == nil, "resume: %s", err)
+	verifyRekey(t, db, m)
+	db.Close()
+
+	// every keyed bucket has a new key
+	cur, _ := readKeyTable(t, fn)
+	assert(len(cur) == len(old), "key table: exp %d entries, saw %d", len(old), len(cur))
+	for id := range cur {
+		_, ok := old[id]
+		assert(!ok || id == ".salt", "key table: key %x survived the rekey", id)
+	}
+
+	db, err = newBolt(fn, "new")
+	assert(err == nil, "reopen: %s", err)
+
+	err = db.Shred("a/b")
+	assert(err == nil, "shred: %s", err)
+
+	_, err = db.Dir("a/b")
+	assert(err != nil, "dir: shredded bucket is still there")
+
+	z, err := db.Get("a/x")
+	assert(err == nil, "get: %s", err)
+	assert(bytes.Equal(z, m["a/x"]), "get: content mismatch")
+	db.Close()
+}
@@ -0,0 +1,430 @@
+// sorted.go -- sorted indices of the records of a bucket
+
+package ebolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Encrypted leaf names are stored in random order. So that a bucket
+// can be listed in order (see List()), it keeps the names of its
+// records in a sorted index: a head record that lists the chunks of the
+// index and the chunks themselves - each a sorted run of at most
+// idxChunk names. The head and chunks are reserved records sealed by
+// the encryptor of the bucket's contents and padded like its records;
+// each names the bucket it belongs to.
+//
+// A bucket written by an older version of ebolt has no index. It's
+// built the first time the bucket is written to; until then, List()
+// sorts the bucket in memory.
+//
+// The flat layout keeps its directories sorted already (see flat.go).
+
+var (
+	// the head of the index; chunks have a big-endian id appended
+	idxHead = []byte(".idx")
+)
+
+// most names in a chunk; a chunk that grows past it is split
+const idxChunk = 256
+
+// return true if 'k' is a record of the sorted index
+func isIndex(k []byte) bool {
+	return len(k) <= len(idxHead)+4 && bytes.HasPrefix(k, idxHead)
+}
+
+// return the record key of the chunk 'id'
+func chunkKey(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(slices.Clone(idxHead), id)
+}
+
+// chunkRef is a chunk as listed by the head
+type chunkRef struct {
+	id    uint32
+	first string
+}
+
+// sortedIndex is the sorted index of the bucket 'bu' at 'dir' whose
+// contents are encrypted by 'c'.
+type sortedIndex struct {
+	bu  *bolt.Bucket
+	c   *encryptor
+	dir string
+
+	// next chunk id and the chunks in order
+	next   uint32
+	chunks []chunkRef
+
+	// chunks of an index built in memory; it's never written
+	mem map[uint32][]string
+}
+
+func appendField(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// open a sealed index record and verify it belongs to this bucket;
+// return the remainder of the plaintext after the bucket path and the
+// id.
+func (x *sortedIndex) open(v []byte, id uint32) ([]byte, error) {
+	b, err := x.c.unsealPadded(v)
+	if err != nil {
+		return nil, fmt.Errorf("sorted index: %w", err)
+	}
+
+	b, p, ok := decField(b)
+	if !ok || len(b) < 4 {
+		return nil, fmt.Errorf("%w: sorted index of %s is malformed", ErrIntegrity, x.dir)
+	}
+
+	b, n := dec32[uint32](b)
+	if string(p) != x.dir || n != id {
+		return nil, fmt.Errorf("%w: sorted index of %s found in %s", ErrIntegrity, p, x.dir)
+	}
+	return b, nil
+}
+
+// read the sorted index of the bucket 'bu' at 'dir'; return nil if the
+// bucket doesn't have one.
+func readSorted(bu *bolt.Bucket, c *encryptor, dir string) (*sortedIndex, error) {
+	x := &sortedIndex{
+		bu:  bu,
+		c:   c,
+		dir: dir,
+	}
+
+	v := bu.Get(idxHead)
+	if v == nil {
+		return nil, nil
+	}
+
+	// the head has id 0: chunks are numbered from 1
+	b, err := x.open(v, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(b) < 4 {
+		return nil, fmt.Errorf("%w: sorted index of %s is malformed", ErrIntegrity, dir)
+	}
+
+	b, x.next = dec32[uint32](b)
+	for len(b) > 0 {
+		var nm []byte
+		var ok bool
+
+		if len(b) < 4 {
+			return nil, fmt.Errorf("%w: sorted index of %s is malformed", ErrIntegrity, dir)
+		}
+
+		r := chunkRef{}
+		b, r.id = dec32[uint32](b)
+		if b, nm, ok = decField(b); !ok {
+			return nil, fmt.Errorf("%w: sorted index of %s is malformed", ErrIntegrity, dir)
+		}
+		r.first = string(nm)
+		x.chunks = append(x.chunks, r)
+	}
+	return x, nil
+}
+
+// build the sorted index of the bucket 'bu' at 'dir' from its records;
+// it's written to the bucket unless 'mem' is true.
+func buildSorted(bu *bolt.Bucket, c *encryptor, dir string, mem bool) (*sortedIndex, error) {
+	var names []string
+
+	err := bu.ForEach(func(k, v []byte) error {
+		if v == nil || isReserved(k) {
+			return nil
+		}
+
+		nm, err := c.decSegment(k)
+		if err != nil {
+			return err
+		}
+		names = append(names, nm)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(names)
+
+	x := &sortedIndex{
+		bu:   bu,
+		c:    c,
+		dir:  dir,
+		next: 1,
+	}
+	if mem {
+		x.mem = make(map[uint32][]string)
+	}
+
+	for len(names) > 0 {
+		n := min(len(names), idxChunk/2)
+		id := x.next
+		x.next++
+
+		x.chunks = append(x.chunks, chunkRef{id, names[0]})
+		if err := x.putChunk(id, names[:n]); err != nil {
+			return nil, err
+		}
+		names = names[n:]
+	}
+
+	if err := x.putHead(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+// return the sorted index of the bucket 'bu' at 'dir' - building it if
+// the bucket doesn't have one.
+func mustSorted(bu *bolt.Bucket, c *encryptor, dir string) (*sortedIndex, error) {
+	x, err := readSorted(bu, c, dir)
+	if x != nil || err != nil {
+		return x, err
+	}
+	return buildSorted(bu, c, dir, false)
+}
+
+func (x *sortedIndex) putHead() error {
+	if x.mem != nil {
+		return nil
+	}
+
+	b := appendField(nil, x.dir)
+	b = binary.BigEndian.AppendUint32(b, 0)
+	b = binary.BigEndian.AppendUint32(b, x.next)
+	for _, r := range x.chunks {
+		b = binary.BigEndian.AppendUint32(b, r.id)
+		b = appendField(b, r.first)
+	}
+	return x.bu.Put(idxHead, x.c.sealPadded(b))
+}
+
+// read the names in chunk 'id'
+func (x *sortedIndex) chunk(id uint32) ([]string, error) {
+	if x.mem != nil {
+		return x.mem[id], nil
+	}
+
+	v := x.bu.Get(chunkKey(id))
+	if v == nil {
+		return nil, fmt.Errorf("%w: sorted index of %s: chunk %d is missing", ErrIntegrity, x.dir, id)
+	}
+
+	b, err := x.open(v, id)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for len(b) > 0 {
+		var nm []byte
+		var ok bool
+
+		if b, nm, ok = decField(b); !ok {
+			return nil, fmt.Errorf("%w: sorted index of %s is malformed", ErrIntegrity, x.dir)
+		}
+		names = append(names, string(nm))
+	}
+	return names, nil
+}
+
+func (x *sortedIndex) putChunk(id uint32, names []string) error {
+	if x.mem != nil {
+		x.mem[id] = names
+		return nil
+	}
+
+	b := appendField(nil, x.dir)
+	b = binary.BigEndian.AppendUint32(b, id)
+	for _, nm := range names {
+		b = appendField(b, nm)
+	}
+	return x.bu.Put(chunkKey(id), x.c.sealPadded(b))
+}
+
+// return the position of the chunk that holds - or would hold - 'nm'
+func (x *sortedIndex) locate(nm string) int {
+	i := sort.Search(len(x.chunks), func(i int) bool {
+		return x.chunks[i].first > nm
+	})
+	return max(i-1, 0)
+}
+
+// add the name 'nm' to the index
+func (x *sortedIndex) insert(nm string) error {
+	if len(x.chunks) == 0 {
+		id := x.next
+		x.next++
+		x.chunks = append(x.chunks, chunkRef{id, nm})
+		if err := x.putChunk(id, []string{nm}); err != nil {
+			return err
+		}
+		return x.putHead()
+	}
+
+	i := x.locate(nm)
+	r := &x.chunks[i]
+	names, err := x.chunk(r.id)
+	if err != nil {
+		return err
+	}
+
+	j, ok := slices.BinarySearch(names, nm)
+	if ok {
+		return nil
+	}
+	names = slices.Insert(names, j, nm)
+
+	head := false
+	if j == 0 {
+		r.first = nm
+		head = true
+	}
+
+	if len(names) > idxChunk {
+		h := len(names) / 2
+		id := x.next
+		x.next++
+
+		x.chunks = slices.Insert(x.chunks, i+1, chunkRef{id, names[h]})
+		if err = x.putChunk(id, names[h:]); err != nil {
+			return err
+		}
+		names = names[:h]
+		head = true
+	}
+
+	if err = x.putChunk(x.chunks[i].id, names); err != nil {
+		return err
+	}
+	if head {
+		return x.putHead()
+	}
+	return nil
+}
+
+// remove the name 'nm' from the index
+func (x *sortedIndex) remove(nm string) error {
+	if len(x.chunks) == 0 {
+		return nil
+	}
+
+	i := x.locate(nm)
+	r := &x.chunks[i]
+	names, err := x.chunk(r.id)
+	if err != nil {
+		return err
+	}
+
+	j, ok := slices.BinarySearch(names, nm)
+	if !ok {
+		return nil
+	}
+	names = slices.Delete(names, j, j+1)
+
+	if len(names) == 0 {
+		if err = x.bu.Delete(chunkKey(r.id)); err != nil {
+			return err
+		}
+		x.chunks = slices.Delete(x.chunks, i, i+1)
+		return x.putHead()
+	}
+
+	if err = x.putChunk(r.id, names); err != nil {
+		return err
+	}
+	if j == 0 {
+		r.first = names[0]
+		return x.putHead()
+	}
+	return nil
+}
+
+// call 'fn' for every name after 'after' in order until it returns
+// false; if 'rev' is true, for every name before 'after' in reverse
+// order. A nil 'after' starts at the first - or last - name.
+func (x *sortedIndex) scan(after *string, rev bool, fn func(string) bool) error {
+	if len(x.chunks) == 0 {
+		return nil
+	}
+
+	if !rev {
+		i := 0
+		if after != nil {
+			i = x.locate(*after)
+		}
+		for ; i < len(x.chunks); i++ {
+			names, err := x.chunk(x.chunks[i].id)
+			if err != nil {
+				return err
+			}
+
+			j := 0
+			if after != nil {
+				var ok bool
+				if j, ok = slices.BinarySearch(names, *after); ok {
+					j++
+				}
+			}
+			for _, nm := range names[j:] {
+				if !fn(nm) {
+					return nil
+				}
+			}
+		}
+		return nil
+	}
+
+	i := len(x.chunks) - 1
+	if after != nil {
+		i = x.locate(*after)
+	}
+	for ; i >= 0; i-- {
+		names, err := x.chunk(x.chunks[i].id)
+		if err != nil {
+			return err
+		}
+
+		j := len(names)
+		if after != nil {
+			j, _ = slices.BinarySearch(names, *after)
+		}
+		for k := j - 1; k >= 0; k-- {
+			if !fn(names[k]) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// add the leaf 'nm' of the bucket 'bu' at 'dir' to its sorted index
+func (t *xact) sortedAdd(bu *bolt.Bucket, c *encryptor, dir []string, nm string) error {
+	x, err := mustSorted(bu, c, strings.Join(dir, "/"))
+	if err != nil {
+		return err
+	}
+	return x.insert(nm)
+}
+
+// remove the leaf 'nm' of the bucket 'bu' at 'dir' from its sorted index
+func (t *xact) sortedDel(bu *bolt.Bucket, c *encryptor, dir []string, nm string) error {
+	x, err := mustSorted(bu, c, strings.Join(dir, "/"))
+	if err != nil {
+		return err
+	}
+	return x.remove(nm)
+}
@@ -0,0 +1,281 @@
+// stat.go -- record metadata and existence queries
+
+package ebolt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// A db created with Config.Metadata stores the modification time and
+// the size of each value in the record itself. They're sealed apart
+// from the value - by a key of their own and with the record's
+// key-path as additional data - so that Stat() can read them without
+// decrypting the value (see cipher.go). They're encoded as:
+//
+//	mtime [8] || size [8] || expiry [8]
+//
+// A zero expiry means the record doesn't expire (see ttl.go). Fields
+// added later are appended; readers ignore what they don't know.
+//
+// A db created without Config.Metadata keeps the same block with the
+// expiry alone:
+//
+//	expiry [8]
+//
+// Databases created before either have no metadata block; their
+// records can't expire.
+
+// the record metadata schemes recorded in the header
+const (
+	recmetaV1     = "v1"
+	recmetaExpiry = "expiry"
+)
+
+// size of the metadata fields known to this version for each scheme
+const (
+	recMetaSize    = 16
+	recExpiryField = 8
+)
+
+// recMeta is the decoded metadata of a record; mtime and size are zero
+// if the db only records the expiry.
+type recMeta struct {
+	mtime time.Time
+	size  int64
+	exp   time.Time
+}
+
+// encode 'm' for the metadata scheme of 'c'
+func (c *encryptor) marshalMeta(m *recMeta) []byte {
+	var exp int64
+	if !m.exp.IsZero() {
+		exp = m.exp.UnixNano()
+	}
+
+	b := make([]byte, 0, recMetaSize+recExpiryField)
+	if c.stat {
+		b = binary.BigEndian.AppendUint64(b, uint64(m.mtime.UnixNano()))
+		b = binary.BigEndian.AppendUint64(b, uint64(m.size))
+	}
+	return binary.BigEndian.AppendUint64(b, uint64(exp))
+}
+
+// decode the metadata 'b' of the scheme of 'c'
+func (c *encryptor) unmarshalMeta(b []byte) (*recMeta, error) {
+	m := &recMeta{}
+	if c.stat {
+		if len(b) < recMetaSize {
+			return nil, fmt.Errorf("%w: malformed record metadata", ErrIntegrity)
+		}
+
+		m.mtime = time.Unix(0, int64(binary.BigEndian.Uint64(b[:8])))
+		m.size = int64(binary.BigEndian.Uint64(b[8:16]))
+		b = b[recMetaSize:]
+
+		// written before records could expire
+		if len(b) == 0 {
+			return m, nil
+		}
+	}
+
+	if len(b) < recExpiryField {
+		return nil, fmt.Errorf("%w: malformed record metadata", ErrIntegrity)
+	}
+	if exp := int64(binary.BigEndian.Uint64(b[:8])); exp != 0 {
+		m.exp = time.Unix(0, exp)
+	}
+	return m, nil
+}
+
+// return the expiry of the record 'ct' stored for the key-path 'k'
+// without opening its value; zero if it doesn't expire.
+func (c *encryptor) expiry(k string, ct []byte) (time.Time, error) {
+	m, err := c.readMeta(k, ct)
+	if m == nil || err != nil {
+		return time.Time{}, err
+	}
+	return m.exp, nil
+}
+
+// open the metadata of the record 'ct' stored for the key-path 'k';
+// return nil if the db doesn't have a metadata block.
+func (c *encryptor) readMeta(k string, ct []byte) (*recMeta, error) {
+	if c.meta == nil {
+		return nil, nil
+	}
+
+	nl := c.val.NonceSize() + c.tagSize()
+	if len(ct) <= nl || len(ct) < nl+1+int(ct[nl]) {
+		return nil, fmt.Errorf("%w: buf len %d too small", ErrDecrypt, len(ct))
+	}
+
+	nonce := ct[:c.val.NonceSize()]
+	b, err := c.meta.Open(nil, nonce, ct[nl+1:nl+1+int(ct[nl])], []byte(canonical(k)))
+	if err != nil {
+		return nil, fmt.Errorf("%w: record metadata: %w", ErrDecrypt, err)
+	}
+	return c.unmarshalMeta(b)
+}
+
+// Info describes a record or a bucket
+type Info struct {
+	// Path is the key-path of the record or bucket
+	Path string
+
+	// IsDir is true for a bucket
+	IsDir bool
+
+	// Size is the size of the value of a record; it's -1 if the db
+	// doesn't record metadata (see Config.Metadata).
+	Size int64
+
+	// StoredSize is the size of a record in the file. For a bucket,
+	// it's the space used by the bucket and everything under it - or
+	// by its index in the flat layout.
+	StoredSize int64
+
+	// ModTime is when a record was last written; it's zero if the db
+	// doesn't record metadata.
+	ModTime time.Time
+
+	// Records and Buckets count the records and buckets directly in a
+	// bucket.
+	Records int
+	Buckets int
+}
+
+// Exists returns true if 'p' is a record or a bucket. Neither the value
+// of the record nor the contents of the bucket are decrypted; only the
+// metadata of the record is opened to check that it hasn't expired.
+func (t *xact) Exists(p string) (bool, error) {
+	_, ct, err := t.liveRecord(p)
+	if err != nil {
+		return false, &StorageError{"exists", p, err}
+	}
+	if ct != nil {
+		return true, nil
+	}
+
+	ok, err := t.isDir(p)
+	if err != nil {
+		return false, &StorageError{"exists", p, err}
+	}
+	return ok, nil
+}
+
+// IsDir returns true if 'p' is a bucket
+func (t *xact) IsDir(p string) (bool, error) {
+	ok, err := t.isDir(p)
+	if err != nil {
+		return false, &StorageError{"is-dir", p, err}
+	}
+	return ok, nil
+}
+
+func (t *xact) isDir(p string) (bool, error) {
+	if len(p) == 0 {
+		return true, nil
+	}
+
+	n, err := t.nodeAt(strings.Split(p, "/"))
+	return n != nil, boltErr(err)
+}
+
+// Stat describes the record or bucket 'p' without decrypting values. If
+// 'p' names both a record and a bucket, the record is described.
+func (t *xact) Stat(p string) (*Info, error) {
+	c, ct, err := t.record(p)
+	if err != nil {
+		return nil, &StorageError{"stat", p, err}
+	}
+
+	var m *recMeta
+	if ct != nil {
+		if m, err = c.readMeta(p, ct); err != nil {
+			return nil, &StorageError{"stat", p, err}
+		}
+	}
+
+	// a record that has expired is absent
+	if ct != nil && (m == nil || !expired(m.exp)) {
+		fi := &Info{
+			Path:       userPath(canonical(p)),
+			Size:       -1,
+			StoredSize: int64(len(ct)),
+		}
+		if m != nil && c.stat {
+			fi.Size = m.size
+			fi.ModTime = m.mtime
+		}
+		return fi, nil
+	}
+
+	if len(p) == 0 {
+		return nil, &StorageError{"stat", p, ErrNotFound}
+	}
+
+	n, err := t.nodeAt(strings.Split(p, "/"))
+	if err != nil {
+		return nil, &StorageError{"stat", p, boltErr(err)}
+	}
+	if n == nil {
+		return nil, &StorageError{"stat", p, ErrNotFound}
+	}
+
+	fi := &Info{
+		Path:  p,
+		IsDir: true,
+	}
+
+	switch n := n.(type) {
+	case *treeNode:
+		n.bu.ForEach(func(k, v []byte) error {
+			switch {
+			case v == nil:
+				fi.Buckets++
+			case !isReserved(k):
+				fi.Records++
+			}
+			return nil
+		})
+
+		st := n.bu.Stats()
+		fi.StoredSize = int64(st.BranchInuse + st.LeafInuse + st.InlineBucketInuse)
+
+	case *flatNode:
+		for _, e := range n.x.ents {
+			if e.dir {
+				fi.Buckets++
+			} else {
+				fi.Records++
+			}
+		}
+		fi.StoredSize = int64(len(n.bu.Get(t.c.dirKey(n.x.path))))
+	}
+	return fi, nil
+}
+
+// return the encrypted record for the key-path 'p' and the encryptor of
+// its bucket; a nil record means it doesn't exist.
+func (t *xact) record(p string) (*encryptor, []byte, error) {
+	var bu *bolt.Bucket
+	var err error
+
+	if t.c.flat {
+		if bu, err = t.flat(false); bu == nil || err != nil {
+			return nil, nil, boltErr(err)
+		}
+		return t.c, bu.Get(t.c.leafKey(canonical(p))), nil
+	}
+
+	bu, nm, c, err := t.leaf2bucket(p)
+	if bu == nil || err != nil {
+		return nil, nil, boltErr(err)
+	}
+	return c, bu.Get(nm), nil
+}
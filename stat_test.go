@@ -0,0 +1,146 @@
+// stat_test.go -- metadata and existence query tests
+
+package ebolt_test
+
+import (
+	"crypto/sha3"
+	"errors"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestStat(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":   nil,
+		"meta":   {Metadata: true},
+		"flat":   {Metadata: true, Flat: true},
+		"keyed":  {Metadata: true, KeyDepth: 1},
+		"commit": {Metadata: true, KeyCommit: true, Padding: &ebolt.Padding{Block: 64}},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+		meta := opt != nil && opt.Metadata
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		start := time.Now()
+		v := randbytes()
+		err = db.SetMany([]ebolt.KV{
+			{Key: "users/1/email", Val: v},
+			{Key: "users/1/name", Val: []byte("alice")},
+			{Key: "users/2/email", Val: []byte("bob@example.com")},
+			{Key: "users/count", Val: []byte("2")},
+			{Key: "top", Val: []byte("x")},
+		})
+		assert(err == nil, "%s: set-many: %s", name, err)
+		end := time.Now()
+
+		// values still decrypt with metadata in the envelope
+		val, err := db.Get("users/1/name")
+		assert(err == nil && string(val) == "alice", "%s: get: %s", name, err)
+
+		exists := func(p string, exp bool) {
+			err := db.View(func(tx ebolt.Tx) error {
+				ok, err := tx.Exists(p)
+				assert(err == nil, "%s: exists %s: %s", name, p, err)
+				assert(ok == exp, "%s: exists %s: exp %v, saw %v", name, p, exp, ok)
+				return nil
+			})
+			assert(err == nil, "%s: view: %s", name, err)
+		}
+		isDir := func(p string, exp bool) {
+			err := db.View(func(tx ebolt.Tx) error {
+				ok, err := tx.IsDir(p)
+				assert(err == nil, "%s: is-dir %s: %s", name, p, err)
+				assert(ok == exp, "%s: is-dir %s: exp %v, saw %v", name, p, exp, ok)
+				return nil
+			})
+			assert(err == nil, "%s: view: %s", name, err)
+		}
+
+		exists("users/1/email", true)
+		exists("users/1", true)
+		exists("top", true)
+		exists("users/3", false)
+		exists("nope/x", false)
+		isDir("users/1", true)
+		isDir("users/1/email", false)
+		isDir("top", false)
+		isDir("nope", false)
+
+		fi, err := db.Stat("users/1/email")
+		assert(err == nil, "%s: stat: %s", name, err)
+		assert(!fi.IsDir && fi.Path == "users/1/email", "%s: stat: %+v", name, fi)
+		assert(fi.StoredSize > int64(len(v)), "%s: stat: stored size %d", name, fi.StoredSize)
+		if meta {
+			assert(fi.Size == int64(len(v)), "%s: stat: exp size %d, saw %d", name, len(v), fi.Size)
+			assert(!fi.ModTime.Before(start) && !fi.ModTime.After(end), "%s: stat: mtime %s", name, fi.ModTime)
+		} else {
+			assert(fi.Size == -1 && fi.ModTime.IsZero(), "%s: stat: %+v", name, fi)
+		}
+
+		fi, err = db.Stat("top")
+		assert(err == nil, "%s: stat top: %s", name, err)
+		assert(!fi.IsDir && fi.Path == "top", "%s: stat top: %+v", name, fi)
+
+		fi, err = db.Stat("users")
+		assert(err == nil, "%s: stat dir: %s", name, err)
+		assert(fi.IsDir && fi.Records == 1 && fi.Buckets == 2, "%s: stat dir: %+v", name, fi)
+		assert(fi.StoredSize > 0, "%s: stat dir: stored size %d", name, fi.StoredSize)
+
+		_, err = db.Stat("users/3")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: stat missing: saw %v", name, err)
+
+		if meta {
+			// the modification time survives a rekey
+			before, err := db.Stat("users/2/email")
+			assert(err == nil, "%s: stat: %s", name, err)
+
+			nk := sha3.Sum256([]byte("new"))
+			err = db.Rekey(nk[:])
+			assert(err == nil, "%s: rekey: %s", name, err)
+
+			after, err := db.Stat("users/2/email")
+			assert(err == nil, "%s: stat: %s", name, err)
+			assert(after.ModTime.Equal(before.ModTime), "%s: rekey: mtime %s, saw %s", name, before.ModTime, after.ModTime)
+			assert(after.Size == before.Size, "%s: rekey: size %d, saw %d", name, before.Size, after.Size)
+
+			val, err = db.Get("users/2/email")
+			assert(err == nil && string(val) == "bob@example.com", "%s: get after rekey: %v", name, err)
+
+			// and a rename or copy - of a record or a bucket
+			before, err = db.Stat("users/1/email")
+			assert(err == nil, "%s: stat: %s", name, err)
+
+			time.Sleep(2 * time.Millisecond)
+			moves := []struct {
+				op       func(src, dst string) error
+				src, dst string
+				p        string
+			}{
+				{db.Copy, "users/1/email", "email", "email"},
+				{db.Rename, "email", "email2", "email2"},
+				{db.Copy, "users/1", "people/1", "people/1/email"},
+				{db.Rename, "users/1", "staff/1", "staff/1/email"},
+			}
+			for _, m := range moves {
+				err = m.op(m.src, m.dst)
+				assert(err == nil, "%s: move %s: %s", name, m.src, err)
+
+				after, err := db.Stat(m.p)
+				assert(err == nil, "%s: stat %s: %s", name, m.p, err)
+				assert(after.ModTime.Equal(before.ModTime), "%s: move %s: mtime %s, saw %s", name, m.p, before.ModTime, after.ModTime)
+			}
+		}
+		db.Close()
+	}
+}
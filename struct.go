@@ -0,0 +1,368 @@
+// struct.go -- storing structs as a bucket of records
+
+package ebolt
+
+import (
+	"encoding"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// SaveStruct() spreads a struct across a bucket of an Ops - a DB or a
+// Tx: each field is a record
+// named by its `ebolt` tag - or by the name of the field - and a nested
+// struct is a bucket of its own:
+//
+//	type User struct {
+//		Name    string    `ebolt:"name"`
+//		Email   string    `ebolt:"email,omitempty"`
+//		Address *Address  `ebolt:"addr"`
+//		Seen    time.Time `ebolt:"seen"`
+//		Secret  []byte    `ebolt:"-"`
+//	}
+//
+// stores "users/1001/name", "users/1001/email", "users/1001/seen" and
+// the fields of the Address under "users/1001/addr/". As with
+// encoding/json, "-" skips a field, unexported fields are skipped and
+// the fields of an embedded struct are treated as fields of the outer
+// struct.
+//
+// Strings and byte slices are stored as is; bools and numbers as text;
+// types that implement encoding.TextMarshaler - e.g., time.Time - as
+// their text; anything else (slices, maps) as JSON. A nil pointer or a
+// zero field tagged "omitempty" is left out: its record or bucket is
+// deleted. On a DB, SaveStruct() and LoadStruct() each run in a single
+// transaction.
+
+// structField is a field of a struct stored as a record or a bucket
+type structField struct {
+	name  string
+	index []int
+	omit  bool
+	dir   bool
+}
+
+var (
+	textMarshaler   = reflect.TypeFor[encoding.TextMarshaler]()
+	textUnmarshaler = reflect.TypeFor[encoding.TextUnmarshaler]()
+)
+
+// SaveStruct stores the fields of the struct 'v' - or the struct 'v'
+// points to - as the records of the bucket 'p' of 'o'. The records are
+// written in a single SetMany().
+func SaveStruct(o Ops, p string, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return &StorageError{"save-struct", p, fmt.Errorf("%T isn't a struct", v)}
+	}
+
+	var s structSaver
+	if err := s.save(rv, p); err != nil {
+		return &StorageError{"save-struct", p, err}
+	}
+
+	if db, ok := o.(DB); ok {
+		return db.Update(func(tx Tx) error {
+			return s.write(tx)
+		})
+	}
+	return s.write(o)
+}
+
+// LoadStruct reads the records of the bucket 'p' of 'o' into the fields
+// of the struct 'v' points to; it's the inverse of SaveStruct(). Fields
+// without a record are left as they are.
+func LoadStruct(o Ops, p string, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return &StorageError{"load-struct", p, fmt.Errorf("%T isn't a pointer to a struct", v)}
+	}
+
+	if db, ok := o.(DB); ok {
+		return db.View(func(tx Tx) error {
+			return loadStruct(tx, p, rv.Elem())
+		})
+	}
+	return loadStruct(o, p, rv.Elem())
+}
+
+// read the bucket 'p' of 'o' into the struct 'sv'
+func loadStruct(o Ops, p string, sv reflect.Value) error {
+	fields, err := structFields(sv.Type())
+	if err != nil {
+		return &StorageError{"load-struct", p, err}
+	}
+
+	m, err := o.All(p)
+	if err != nil {
+		return err
+	}
+
+	recs := make(map[string][]byte, len(m))
+	for k, v := range m {
+		recs[path.Base(k)] = v
+	}
+
+	for i := range fields {
+		f := &fields[i]
+		fv := sv.FieldByIndex(f.index)
+		fp := joinPath(p, f.name)
+
+		if f.dir {
+			ok, err := o.IsDir(fp)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				continue
+			}
+			if fv.Kind() == reflect.Pointer {
+				if fv.IsNil() {
+					fv.Set(reflect.New(fv.Type().Elem()))
+				}
+				fv = fv.Elem()
+			}
+			if err = loadStruct(o, fp, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		b, ok := recs[f.name]
+		if !ok {
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			if fv.IsNil() {
+				fv.Set(reflect.New(fv.Type().Elem()))
+			}
+			fv = fv.Elem()
+		}
+		if err = decodeField(fv, b); err != nil {
+			return &StorageError{"load-struct", fp, err}
+		}
+	}
+	return nil
+}
+
+// structSaver gathers the records of a struct and what's to be deleted
+type structSaver struct {
+	kv       []KV
+	gone     []string
+	goneDirs []string
+}
+
+// store the records gathered by save() in 'o' and delete the ones that
+// were left out
+func (s *structSaver) write(o Ops) error {
+	if err := o.SetMany(s.kv); err != nil {
+		return err
+	}
+	for _, k := range s.gone {
+		if err := o.Del(k); err != nil && !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+	}
+	for _, d := range s.goneDirs {
+		if err := o.DelDir(d, true); err != nil && !errors.Is(err, ErrBucketNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// gather the fields of the struct 'sv' to be stored in the bucket 'p'
+func (s *structSaver) save(sv reflect.Value, p string) error {
+	fields, err := structFields(sv.Type())
+	if err != nil {
+		return err
+	}
+
+	for i := range fields {
+		f := &fields[i]
+		fv := sv.FieldByIndex(f.index)
+		fp := joinPath(p, f.name)
+
+		if (f.omit && fv.IsZero()) || (fv.Kind() == reflect.Pointer && fv.IsNil()) {
+			if f.dir {
+				s.goneDirs = append(s.goneDirs, fp)
+			} else {
+				s.gone = append(s.gone, fp)
+			}
+			continue
+		}
+		if fv.Kind() == reflect.Pointer {
+			fv = fv.Elem()
+		}
+
+		if f.dir {
+			if err = s.save(fv, fp); err != nil {
+				return err
+			}
+			continue
+		}
+
+		b, err := encodeField(fv)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fp, err)
+		}
+		s.kv = append(s.kv, KV{fp, b})
+	}
+	return nil
+}
+
+// return the stored fields of the struct type 'st'
+func structFields(st reflect.Type) ([]structField, error) {
+	var ret []structField
+
+	seen := make(map[string]bool)
+
+	var gather func(st reflect.Type, index []int) error
+	gather = func(st reflect.Type, index []int) error {
+		for i := range st.NumField() {
+			sf := st.Field(i)
+
+			name, opts, _ := strings.Cut(sf.Tag.Get("ebolt"), ",")
+			if name == "-" && len(opts) == 0 {
+				continue
+			}
+
+			idx := append(index[:len(index):len(index)], i)
+
+			// the fields of an untagged embedded struct are ours
+			if sf.Anonymous && len(name) == 0 && sf.Type.Kind() == reflect.Struct && !isText(sf.Type) {
+				if err := gather(sf.Type, idx); err != nil {
+					return err
+				}
+				continue
+			}
+			if !sf.IsExported() {
+				continue
+			}
+
+			if len(name) == 0 {
+				name = sf.Name
+			}
+			if strings.Contains(name, "/") {
+				return fmt.Errorf("field %s: invalid name %q", sf.Name, name)
+			}
+			if seen[name] {
+				return fmt.Errorf("field %s: name %q is used twice", sf.Name, name)
+			}
+			seen[name] = true
+
+			ft := sf.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+
+			ret = append(ret, structField{
+				name:  name,
+				index: idx,
+				omit:  opts == "omitempty",
+				dir:   ft.Kind() == reflect.Struct && !isText(ft),
+			})
+		}
+		return nil
+	}
+
+	if err := gather(st, nil); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// return true if values of type 't' are stored as their text
+func isText(t reflect.Type) bool {
+	return t.Implements(textMarshaler) || reflect.PointerTo(t).Implements(textUnmarshaler)
+}
+
+// return the value of the record of the field 'v'
+func encodeField(v reflect.Value) ([]byte, error) {
+	if tm, ok := v.Interface().(encoding.TextMarshaler); ok {
+		return tm.MarshalText()
+	}
+	if v.CanAddr() {
+		if tm, ok := v.Addr().Interface().(encoding.TextMarshaler); ok {
+			return tm.MarshalText()
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return []byte(v.String()), nil
+	case reflect.Bool:
+		return strconv.AppendBool(nil, v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.AppendInt(nil, v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return strconv.AppendUint(nil, v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.AppendFloat(nil, v.Float(), 'g', -1, v.Type().Bits()), nil
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes(), nil
+		}
+	}
+	return json.Marshal(v.Interface())
+}
+
+// decode the value 'b' of a record into the field 'v'
+func decodeField(v reflect.Value, b []byte) error {
+	if tu, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return tu.UnmarshalText(b)
+	}
+
+	s := string(b)
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+		return nil
+	case reflect.Bool:
+		x, err := strconv.ParseBool(s)
+		if err == nil {
+			v.SetBool(x)
+		}
+		return err
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		x, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err == nil {
+			v.SetInt(x)
+		}
+		return err
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		x, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err == nil {
+			v.SetUint(x)
+		}
+		return err
+	case reflect.Float32, reflect.Float64:
+		x, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err == nil {
+			v.SetFloat(x)
+		}
+		return err
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	}
+	return json.Unmarshal(b, v.Addr().Interface())
+}
+
+// return the key-path of 'nm' in the bucket 'dir'
+func joinPath(dir, nm string) string {
+	if len(dir) == 0 {
+		return nm
+	}
+	return dir + "/" + nm
+}
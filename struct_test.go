@@ -0,0 +1,157 @@
+// struct_test.go -- struct mapping tests
+
+package ebolt_test
+
+import (
+	"errors"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/opencoff/ebolt"
+)
+
+type address struct {
+	Street string `ebolt:"street"`
+	Zip    int    `ebolt:"zip"`
+}
+
+type audit struct {
+	Created time.Time `ebolt:"created"`
+}
+
+type profile struct {
+	audit
+
+	Name   string   `ebolt:"name"`
+	Email  string   `ebolt:"email,omitempty"`
+	Age    int      `ebolt:"age"`
+	Admin  bool     `ebolt:"admin"`
+	Score  float64  `ebolt:"score"`
+	Tags   []string `ebolt:"tags"`
+	Key    []byte   `ebolt:"key"`
+	Home   address  `ebolt:"home"`
+	Work   *address `ebolt:"work"`
+	Nick   *string
+	Secret string `ebolt:"-"`
+}
+
+func TestStruct(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  nil,
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		nick := "al"
+		exp := profile{
+			audit:  audit{time.Date(2024, 5, 1, 10, 20, 30, 400, time.UTC)},
+			Name:   "alice",
+			Email:  "alice@example.com",
+			Age:    42,
+			Admin:  true,
+			Score:  0.25,
+			Tags:   []string{"a", "b"},
+			Key:    []byte{1, 2, 3},
+			Home:   address{"1 Main St", 12345},
+			Work:   &address{"2 Side St", 67890},
+			Nick:   &nick,
+			Secret: "hunter2",
+		}
+
+		err = ebolt.SaveStruct(db, "users/1001", &exp)
+		assert(err == nil, "%s: save: %s", name, err)
+
+		// each field is a record of its own
+		recs := map[string]string{
+			"users/1001/name":        "alice",
+			"users/1001/age":         "42",
+			"users/1001/admin":       "true",
+			"users/1001/tags":        `["a","b"]`,
+			"users/1001/created":     "2024-05-01T10:20:30.0000004Z",
+			"users/1001/Nick":        "al",
+			"users/1001/home/zip":    "12345",
+			"users/1001/work/zip":    "67890",
+			"users/1001/home/street": "1 Main St",
+		}
+		for k, v := range recs {
+			got, err := db.Get(k)
+			assert(err == nil, "%s: get %s: %s", name, k, err)
+			assert(string(got) == v, "%s: get %s: exp %q, saw %q", name, k, v, got)
+		}
+		_, err = db.Get("users/1001/Secret")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: skipped field stored: %v", name, err)
+
+		var got profile
+		err = ebolt.LoadStruct(db, "users/1001", &got)
+		assert(err == nil, "%s: load: %s", name, err)
+
+		exp.Secret = ""
+		assert(reflect.DeepEqual(got, exp), "%s: load:\nexp %+v\nsaw %+v", name, exp, got)
+
+		// zero fields tagged omitempty and nil pointers are removed
+		exp.Email = ""
+		exp.Work = nil
+		exp.Nick = nil
+		err = ebolt.SaveStruct(db, "users/1001", exp)
+		assert(err == nil, "%s: save: %s", name, err)
+
+		_, err = db.Get("users/1001/email")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: omitted field kept: %v", name, err)
+		ok, err := db.IsDir("users/1001/work")
+		assert(err == nil && !ok, "%s: nil struct kept: %v, %v", name, ok, err)
+
+		got = profile{}
+		err = ebolt.LoadStruct(db, "users/1001", &got)
+		assert(err == nil, "%s: load: %s", name, err)
+		assert(reflect.DeepEqual(got, exp), "%s: load:\nexp %+v\nsaw %+v", name, exp, got)
+
+		// within a transaction
+		err = db.Update(func(tx ebolt.Tx) error {
+			if err := ebolt.SaveStruct(tx, "users/1002", &address{"3 Elm St", 11111}); err != nil {
+				return err
+			}
+
+			var a address
+			err := ebolt.LoadStruct(tx, "users/1002", &a)
+			assert(err == nil && a.Zip == 11111, "%s: tx load: %+v, %v", name, a, err)
+			return err
+		})
+		assert(err == nil, "%s: update: %s", name, err)
+
+		var a address
+		err = ebolt.LoadStruct(db, "users/1002", &a)
+		assert(err == nil && a.Zip == 11111, "%s: load: %+v, %v", name, a, err)
+
+		// bad arguments and bad records
+		err = ebolt.LoadStruct(db, "users/1002", a)
+		assert(err != nil, "%s: load: accepted a struct that isn't a pointer", name)
+		err = ebolt.SaveStruct(db, "users/1003", "x")
+		assert(err != nil, "%s: save: accepted a string", name)
+		err = ebolt.SaveStruct(db, "users/1003", &struct {
+			A string `ebolt:"x"`
+			B string `ebolt:"x"`
+		}{})
+		assert(err != nil, "%s: save: accepted a name used twice", name)
+
+		err = db.Set("users/1002/zip", []byte("not a number"))
+		assert(err == nil, "%s: set: %s", name, err)
+		err = ebolt.LoadStruct(db, "users/1002", &a)
+		assert(err != nil, "%s: load: bad number went unnoticed", name)
+
+		_, err = db.Get("users/1003/x")
+		assert(errors.Is(err, ebolt.ErrBucketNotFound), "%s: failed save wrote: %v", name, err)
+		db.Close()
+	}
+}
@@ -0,0 +1,65 @@
+// suite.go -- cipher suites
+
+package ebolt
+
+import (
+	"crypto/cipher"
+	"fmt"
+
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Names of the cipher suites; one of these is chosen when a db is
+// created (see Config) and recorded in its format header.
+const (
+	// AES-256-GCM with 96-bit random nonces for values. This is the
+	// default and is fastest on CPUs with AES instructions.
+	SuiteAES256GCM = "aes-256-gcm"
+
+	// XChaCha20-Poly1305 with 192-bit random nonces for values. It is
+	// fast without AES instructions and random nonces of this size can
+	// be used for practically any number of writes.
+	SuiteXChaCha20Poly1305 = "xchacha20-poly1305"
+)
+
+// cipherSuite makes the AEADs used to encrypt a db
+type cipherSuite struct {
+	name string
+
+	// domain separation for expanding the data key
+	kdf string
+
+	// make an AEAD from a 32 byte key
+	aead func(key []byte) (cipher.AEAD, error)
+}
+
+var suites = map[string]*cipherSuite{
+	SuiteAES256GCM: {
+		name: SuiteAES256GCM,
+		kdf:  "DB Encryption Keys v1",
+		aead: newGCM,
+	},
+
+	SuiteXChaCha20Poly1305: {
+		name: SuiteXChaCha20Poly1305,
+		kdf:  "DB Encryption Keys v1 " + SuiteXChaCha20Poly1305,
+		aead: newXChaCha,
+	},
+}
+
+// return the cipher suite called 'nm'
+func suiteByName(nm string) (*cipherSuite, error) {
+	cs, ok := suites[nm]
+	if !ok {
+		return nil, fmt.Errorf("%w: cipher suite %q", ErrFormat, nm)
+	}
+	return cs, nil
+}
+
+func newXChaCha(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, fmt.Errorf("xchacha20-poly1305: %w", err)
+	}
+	return aead, nil
+}
@@ -0,0 +1,175 @@
+// suite_test.go -- cipher suite tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCipherSuites(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	for _, suite := range []string{ebolt.SuiteAES256GCM, ebolt.SuiteXChaCha20Poly1305} {
+		fn := path.Join(tmp, suite+".db")
+
+		db, err := newBoltOpt(fn, "key", &ebolt.Config{Suite: suite})
+		assert(err == nil, "%s: open: %s", suite, err)
+
+		m := make(map[string][]byte)
+		for i := range 100 {
+			k := fmt.Sprintf("a/b%d/c%d", i%5, i)
+			m[k] = randbytes()
+			err = db.Set(k, m[k])
+			assert(err == nil, "%s: set %s: %s", suite, k, err)
+		}
+		db.Close()
+
+		// the suite is picked up from the header
+		db, err = newBolt(fn, "key")
+		assert(err == nil, "%s: reopen: %s", suite, err)
+
+		for k, v := range m {
+			z, err := db.Get(k)
+			assert(err == nil, "%s: get %s: %s", suite, k, err)
+			assert(bytes.Equal(z, v), "%s: get %s: content mismatch", suite, k)
+		}
+
+		// and survives a rekey
+		key := []byte("new key")
+		err = db.Rekey(key)
+		assert(err == nil, "%s: rekey: %s", suite, err)
+		db.Close()
+
+		db, err = ebolt.OpenWithConfig(fn, key, &ebolt.Config{Suite: ebolt.SuiteAES256GCM})
+		assert(err == nil, "%s: reopen: %s", suite, err)
+
+		all, err := db.All("a/b0")
+		assert(err == nil, "%s: all: %s", suite, err)
+		assert(len(all) == 20, "%s: all: exp 20, saw %d", suite, len(all))
+		db.Close()
+
+		_, err = newBolt(fn, "key")
+		assert(errors.Is(err, ebolt.ErrWrongKey), "%s: exp wrong-key, saw %v", suite, err)
+	}
+
+	_, err := newBoltOpt(path.Join(tmp, "rot13.db"), "key", &ebolt.Config{Suite: "rot13"})
+	assert(errors.Is(err, ebolt.ErrConfig), "unknown suite: exp config error, saw %v", err)
+}
+
+// return the raw record of the single key-path in the db in 'fn'
+// return the keys of the records in bucket 'bu'; reserved records (a
+// bucket key or a sorted index) are never as long as an encrypted name.
+func recordKeys(bu *bolt.Bucket) [][]byte {
+	var keys [][]byte
+
+	cu := bu.Cursor()
+	for k, v := cu.First(); k != nil; k, v = cu.Next() {
+		if v != nil && len(k) > 8 {
+			keys = append(keys, bytes.Clone(k))
+		}
+	}
+	return keys
+}
+
+func rawRecord(fn string) ([]byte, error) {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	var rec []byte
+	err = db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) != ".ebolt" {
+				k := recordKeys(bu)[0]
+				rec = bytes.Clone(bu.Get(k))
+			}
+			return nil
+		})
+	})
+	return rec, err
+}
+
+func TestKeyCommit(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	for _, suite := range []string{ebolt.SuiteAES256GCM, ebolt.SuiteXChaCha20Poly1305} {
+		plain := path.Join(tmp, suite+"-plain.db")
+		commit := path.Join(tmp, suite+"-commit.db")
+
+		val := randbytes()
+		for _, fn := range []string{plain, commit} {
+			opt := &ebolt.Config{Suite: suite, KeyCommit: fn == commit}
+			db, err := newBoltOpt(fn, "key", opt)
+			assert(err == nil, "%s: open: %s", fn, err)
+			err = db.Set("a/b", val)
+			assert(err == nil, "%s: set: %s", fn, err)
+			db.Close()
+		}
+
+		r0, err := rawRecord(plain)
+		assert(err == nil, "%s: raw: %s", suite, err)
+		r1, err := rawRecord(commit)
+		assert(err == nil, "%s: raw: %s", suite, err)
+		assert(len(r1) == len(r0)+32, "%s: exp a 32 byte tag; saw %d vs %d", suite, len(r1), len(r0))
+
+		// the setting is recorded in the header
+		db, err := newBolt(commit, "key")
+		assert(err == nil, "%s: reopen: %s", suite, err)
+		v, err := db.Get("a/b")
+		assert(err == nil, "%s: get: %s", suite, err)
+		assert(bytes.Equal(v, val), "%s: content mismatch", suite)
+		db.Close()
+
+		// a corrupt tag is caught before the AEAD is opened
+		nl := map[string]int{ebolt.SuiteAES256GCM: 12, ebolt.SuiteXChaCha20Poly1305: 24}[suite]
+		err = pokeRecord(commit, func(b []byte) { b[nl+7] ^= 1 })
+		assert(err == nil, "%s: poke: %s", suite, err)
+
+		db, err = newBolt(commit, "key")
+		assert(err == nil, "%s: reopen: %s", suite, err)
+		_, err = db.Get("a/b")
+		assert(err != nil && strings.Contains(err.Error(), "commitment"), "%s: exp commitment error, saw %v", suite, err)
+		db.Close()
+
+		// turning it off breaks the header MAC
+		err = poke(commit, "commit", []byte("none"))
+		assert(err == nil, "%s: poke: %s", suite, err)
+		_, err = newBolt(commit, "key")
+		assert(errors.Is(err, ebolt.ErrFormat), "%s: exp format error, saw %v", suite, err)
+	}
+}
+
+// modify the raw record of the single key-path in the db in 'fn'
+func pokeRecord(fn string, fp func(b []byte)) error {
+	db, err := bolt.Open(fn, 0600, nil)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.Update(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(nm []byte, bu *bolt.Bucket) error {
+			if string(nm) == ".ebolt" {
+				return nil
+			}
+			k := recordKeys(bu)[0]
+			v := bytes.Clone(bu.Get(k))
+			fp(v)
+			return bu.Put(k, v)
+		})
+	})
+}
@@ -0,0 +1,240 @@
+// ttl.go -- records that expire
+
+package ebolt
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+)
+
+// A record written by SetWithTTL() carries its expiry in its metadata
+// block (see stat.go): it's read without opening the value. Every
+// record of the db has one - a zero expiry if it doesn't expire - so
+// nothing in the file tells a record that expires apart from any other.
+// A db created before record expiry has no metadata block and can't
+// hold records that expire. Reads - Get(), Exists(), Stat(), Lookup(), All(),
+// the iterators, List(), Find() and Walk() - treat a record that has
+// expired as absent; Rename() and Copy() leave it behind. The one
+// exception is Walk() with NoValues: it doesn't open records, so it
+// sees an expired record until it's overwritten, deleted or swept.
+//
+// Sweep() deletes the records that have expired. It finds them in a
+// read-only transaction and deletes them in write transactions of at
+// most Config.SweepBatch records each: writers aren't held up for
+// long. A db opened with Config.Sweep runs it in the background and
+// reports its errors to Config.SweepError.
+
+// returned by decryptKV() and the readers of records for a record that
+// has expired; it never reaches the caller.
+var errExpired = errors.New("record expired")
+
+// default number of records deleted by each transaction of Sweep()
+const defaultSweepBatch = 1024
+
+// return true if a record that expires at 'exp' has expired
+func expired(exp time.Time) bool {
+	return !exp.IsZero() && !time.Now().Before(exp)
+}
+
+// SetWithTTL is like Set() but the record expires after 'ttl'
+func (t *xact) SetWithTTL(p string, v []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return &StorageError{"set-ttl", p, fmt.Errorf("invalid ttl %s", ttl)}
+	}
+	if t.c.meta == nil {
+		return &StorageError{"set-ttl", p, fmt.Errorf("%w: db predates record expiry", ErrFormat)}
+	}
+	return t.putMany("set-ttl", []KV{{p, v}}, []recMeta{{exp: time.Now().Add(ttl)}}, nil)
+}
+
+// return the expiry of the record 'p'; zero if it doesn't have one.
+// Its value isn't decrypted.
+func (t *xact) expiry(p string) (time.Time, error) {
+	m, err := t.meta(p)
+	return m.exp, err
+}
+
+// return the metadata of the record 'p'; zero if it doesn't exist or
+// the db doesn't keep any. Its value isn't decrypted.
+func (t *xact) meta(p string) (recMeta, error) {
+	c, ct, err := t.record(p)
+	if ct == nil || err != nil {
+		return recMeta{}, err
+	}
+
+	m, err := c.readMeta(p, ct)
+	if m == nil || err != nil {
+		return recMeta{}, err
+	}
+	return *m, nil
+}
+
+// return the encrypted record for the key-path 'p' and the encryptor
+// of its bucket like record(), but a record that has expired is
+// returned as nil. Its value isn't decrypted.
+func (t *xact) liveRecord(p string) (*encryptor, []byte, error) {
+	c, ct, err := t.record(p)
+	if ct == nil || err != nil {
+		return c, ct, err
+	}
+
+	exp, err := c.expiry(p, ct)
+	if err != nil {
+		return nil, nil, err
+	}
+	if expired(exp) {
+		return c, nil, nil
+	}
+	return c, ct, nil
+}
+
+// return the key-paths of the records that have expired
+func (t *xact) expiredRecs() ([]string, error) {
+	var ret []string
+
+	var scan func(n findNode, dir []string) error
+	scan = func(n findNode, dir []string) error {
+		leaves, err := n.names(false)
+		if err != nil {
+			return err
+		}
+		for _, nm := range leaves {
+			_, _, err := n.read(nm)
+			if err == errExpired {
+				ret = append(ret, userPath(dirPath(append(slices.Clip(dir), nm))))
+				continue
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		subs, err := n.names(true)
+		if err != nil {
+			return err
+		}
+		for _, nm := range subs {
+			sub, err := n.sub(nm)
+			if err != nil {
+				return err
+			}
+			if sub != nil {
+				if err = scan(sub, append(slices.Clip(dir), nm)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	}
+
+	n, err := t.nodeAt(nil)
+	if n == nil || err != nil {
+		return nil, err
+	}
+	if err = scan(n, nil); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// delete the records in 'v' that are still expired; the others were
+// overwritten or deleted since they were found. Return the number of
+// records deleted.
+func (t *xact) sweep(v []string) (int, error) {
+	var n int
+
+	for _, p := range v {
+		exp, err := t.expiry(p)
+		if err != nil {
+			return n, &StorageError{"sweep", p, err}
+		}
+		if !expired(exp) {
+			continue
+		}
+
+		if err = t.del(p); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Sweep deletes the records that have expired; it returns the number
+// of records deleted.
+func (b *bdb) Sweep() (int, error) {
+	return b.sweep(nil)
+}
+
+// delete the records that have expired - in batches of b.batch - until
+// there are none left or 'stop' is closed
+func (b *bdb) sweep(stop <-chan struct{}) (int, error) {
+	var v []string
+
+	err := b.View(func(tx Tx) error {
+		var err error
+
+		v, err = tx.(*xact).expiredRecs()
+		return err
+	})
+	if err != nil {
+		return 0, &StorageError{"sweep", "", boltErr(err)}
+	}
+
+	var n int
+	for len(v) > 0 {
+		select {
+		case <-stop:
+			return n, nil
+		default:
+		}
+
+		m := min(len(v), b.batch)
+		k, err := b.sweepBatch(v[:m])
+		n += k
+		if err != nil {
+			return n, err
+		}
+		v = v[m:]
+	}
+	return n, nil
+}
+
+// delete the records in 'v' that are still expired in one transaction;
+// return the number of records deleted.
+func (b *bdb) sweepBatch(v []string) (int, error) {
+	var n int
+
+	err := b.Update(func(tx Tx) error {
+		var err error
+
+		n, err = tx.(*xact).sweep(v)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// delete the records that have expired every 'every' until Close()
+func (b *bdb) sweeper(every time.Duration) {
+	defer b.wg.Done()
+
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-tick.C:
+			// a failed sweep is retried the next time around
+			if _, err := b.sweep(b.stop); err != nil && b.sweepErr != nil {
+				b.sweepErr(err)
+			}
+		}
+	}
+}
@@ -0,0 +1,245 @@
+// ttl_test.go -- expiring records tests
+
+package ebolt_test
+
+import (
+	"crypto/sha3"
+	"encoding/json"
+	"errors"
+	"path"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestTTL(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  {},
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+		"meta":  {Metadata: true, Padding: &ebolt.Padding{Pow2: true}},
+	}
+
+	const u = 150 * time.Millisecond
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		opt.Indexes = []ebolt.Index{emailIndex()}
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		set := func(p string, ttl time.Duration) {
+			var err error
+			if ttl == 0 {
+				err = db.Set(p, []byte(p))
+			} else {
+				err = db.SetWithTTL(p, []byte(p), ttl)
+			}
+			assert(err == nil, "%s: set %s: %s", name, p, err)
+		}
+		gone := func(p string) {
+			_, err := db.Get(p)
+			assert(errors.Is(err, ebolt.ErrNotFound), "%s: get %s: exp not found, saw %v", name, p, err)
+		}
+
+		set("sess/a", u)
+		set("sess/b", 0)
+		set("sess/c", 3*u)
+		set("top", u)
+
+		b, _ := json.Marshal(&user{Email: "alice@example.com"})
+		err = db.SetWithTTL("users/1", b, u)
+		assert(err == nil, "%s: set: %s", name, err)
+
+		err = db.SetWithTTL("sess/d", nil, 0)
+		assert(err != nil, "%s: set: accepted a zero ttl", name)
+
+		v, err := db.Get("sess/a")
+		assert(err == nil && string(v) == "sess/a", "%s: get: %q, %v", name, v, err)
+
+		// the expiry survives a rekey
+		nk := sha3.Sum256([]byte("new"))
+		err = db.Rekey(nk[:])
+		assert(err == nil, "%s: rekey: %s", name, err)
+
+		time.Sleep(3 * u / 2)
+
+		gone("sess/a")
+		gone("top")
+		_, err = db.Get("sess/c")
+		assert(err == nil, "%s: get: %s", name, err)
+
+		exp := []string{"sess/b", "sess/c"}
+
+		m, err := db.All("sess")
+		assert(err == nil && len(m) == 2, "%s: all: %v, %v", name, m, err)
+
+		keys, err := db.AllKeys("sess")
+		slices.Sort(keys)
+		assert(err == nil && slices.Equal(keys, exp), "%s: keys: %v, %v", name, keys, err)
+
+		kv, err := db.Find("sess/*")
+		assert(err == nil && len(kv) == 2, "%s: find: %v, %v", name, kv, err)
+
+		kv, _, err = db.List("sess", ebolt.ListOptions{})
+		assert(err == nil && len(kv) == 2, "%s: list: %v, %v", name, kv, err)
+
+		err = db.View(func(tx ebolt.Tx) error {
+			var seen []string
+			for k := range tx.Keys("sess") {
+				seen = append(seen, k)
+			}
+			slices.Sort(seen)
+			assert(slices.Equal(seen, exp), "%s: iter keys: %v", name, seen)
+
+			seen = seen[:0]
+			err := tx.Walk("", ebolt.WalkOptions{}, func(p string, isDir bool, _ []byte) error {
+				if !isDir {
+					seen = append(seen, p)
+				}
+				return nil
+			})
+			assert(slices.Equal(seen, exp), "%s: walk: %v", name, seen)
+			return err
+		})
+		assert(err == nil, "%s: view: %s", name, err)
+
+		ok, err := db.Exists("top")
+		assert(err == nil && !ok, "%s: exists: %v, %v", name, ok, err)
+		_, err = db.Stat("top")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: stat: exp not found, saw %v", name, err)
+		got, err := db.Lookup("email", "alice@example.com")
+		assert(err == nil && len(got) == 0, "%s: lookup: %v, %v", name, got, err)
+
+		// a rename leaves expired records behind and keeps the expiry
+		// of the others
+		err = db.Rename("sess", "old")
+		assert(err == nil, "%s: rename: %s", name, err)
+		gone("old/a")
+
+		// it stays in the file until it's swept
+		n, err := db.Sweep()
+		assert(err == nil && n == 2, "%s: sweep: %d, %v", name, n, err)
+
+		time.Sleep(2 * u)
+
+		gone("old/c")
+		_, err = db.Get("old/b")
+		assert(err == nil, "%s: get: %s", name, err)
+
+		// a write brings it back
+		set("old/c", 0)
+		n, err = db.Sweep()
+		assert(err == nil && n == 0, "%s: sweep: %d, %v", name, n, err)
+		_, err = db.Get("old/c")
+		assert(err == nil, "%s: get: %s", name, err)
+		db.Close()
+	}
+}
+
+func TestTTLSweeper(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "sweep.db")
+
+	ix := emailIndex()
+	ix.Unique = true
+
+	opt := &ebolt.Config{
+		Sweep:      20 * time.Millisecond,
+		SweepBatch: 2,
+		Indexes:    []ebolt.Index{ix},
+	}
+	db, err := newBoltOpt(fn, "key", opt)
+	assert(err == nil, "open: %s", err)
+
+	b, _ := json.Marshal(&user{Email: "alice@example.com"})
+	err = db.SetWithTTL("users/1", b, 10*time.Millisecond)
+	assert(err == nil, "set: %s", err)
+	for _, p := range []string{"users/2", "users/3", "users/4", "users/5"} {
+		err = db.SetWithTTL(p, []byte("{}"), 10*time.Millisecond)
+		assert(err == nil, "set %s: %s", p, err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+
+	// an expired record doesn't hold on to a unique value
+	err = db.Set("users/6", b)
+	assert(err == nil, "set: %s", err)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		keys, err := db.AllKeys("users")
+		assert(err == nil, "keys: %s", err)
+
+		ok, err := db.Exists("users/5")
+		assert(err == nil, "exists: %s", err)
+		if !ok && len(keys) == 1 {
+			break
+		}
+		assert(time.Now().Before(deadline), "sweeper: expired records are still there")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	got, err := db.Lookup("email", "alice@example.com")
+	assert(err == nil && slices.Equal(got, []string{"users/6"}), "lookup: %v, %v", got, err)
+
+	err = db.Close()
+	assert(err == nil, "close: %s", err)
+}
+
+func TestTTLSweepError(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "sweep-err.db")
+
+	db, err := newBolt(fn, "key")
+	assert(err == nil, "open: %s", err)
+	err = db.Set("a/b", []byte("value"))
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	// a record that doesn't decrypt fails every sweep
+	err = pokeRecord(fn, func(b []byte) {
+		b[len(b)-1] ^= 1
+	})
+	assert(err == nil, "poke: %s", err)
+
+	errs := make(chan error, 1)
+	opt := &ebolt.Config{
+		Sweep: 10 * time.Millisecond,
+		SweepError: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		},
+	}
+	db, err = newBoltOpt(fn, "key", opt)
+	assert(err == nil, "reopen: %s", err)
+	defer db.Close()
+
+	// the expiry is read without opening the value
+	_, err = db.Get("a/b")
+	assert(errors.Is(err, ebolt.ErrDecrypt), "get: exp decrypt error, saw %v", err)
+	ok, err := db.Exists("a/b")
+	assert(err == nil && ok, "exists: %v, %v", ok, err)
+	_, err = db.Stat("a/b")
+	assert(err == nil, "stat: %s", err)
+
+	select {
+	case err = <-errs:
+		assert(errors.Is(err, ebolt.ErrDecrypt), "sweeper: exp decrypt error, saw %v", err)
+	case <-time.After(5 * time.Second):
+		assert(false, "sweeper: no error reported")
+	}
+}
@@ -0,0 +1,140 @@
+// unique.go -- uniqueness constraints over indexed values
+
+package ebolt
+
+import (
+	"fmt"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// An index declared Unique (see Index) admits at most one record per
+// value. Writes are checked against it before anything is written: a
+// write that would give two records the same value fails with a
+// ConstraintError and leaves the transaction as it was. The check
+// compares blind tokens (see index.go); the values themselves are never
+// stored.
+
+// ConstraintError is returned when a write violates the uniqueness
+// constraint of an index; it matches ErrConstraint with errors.Is().
+type ConstraintError struct {
+	// Index is the name of the index
+	Index string
+
+	// Key is the key-path being written and Conflict is the key-path
+	// of the record that already has the same value
+	Key      string
+	Conflict string
+}
+
+func (e *ConstraintError) Error() string {
+	return fmt.Sprintf("%s: index %s: value is taken by %s", ErrConstraint, e.Index, e.Conflict)
+}
+
+func (e *ConstraintError) Unwrap() error {
+	return ErrConstraint
+}
+
+// verify that writing the records 'kv' - whose index values are 'bv' -
+// keeps every unique index unique. Records in 'kv' and in 'gone' are
+// being replaced or removed: their current values don't count.
+func (t *xact) checkUnique(kv []KV, bv [][]blindVals, gone map[string]bool) error {
+	batch := make(map[string]bool, len(kv))
+	for i := range kv {
+		batch[canonical(kv[i].Key)] = true
+	}
+
+	skip := func(owner string) bool {
+		return batch[owner] || gone[owner]
+	}
+
+	// token of each unique value written -> its record
+	claim := make(map[string]string)
+	for i := range kv {
+		cp := canonical(kv[i].Key)
+		for _, b := range bv[i] {
+			if !b.ix.Unique {
+				continue
+			}
+
+			bu, err := t.indexBucket(b.ix, false)
+			if err != nil {
+				return err
+			}
+
+			for _, val := range b.vals {
+				tok := t.c.blindToken(b.ix.Name, val)
+
+				ck := b.ix.Name + "/" + string(tok)
+				if other, ok := claim[ck]; ok && other != cp {
+					return &ConstraintError{b.ix.Name, userPath(cp), userPath(other)}
+				}
+				claim[ck] = cp
+
+				if bu == nil {
+					continue
+				}
+
+				other, err := t.owner(bu, tok, cp, skip)
+				if err != nil {
+					return err
+				}
+				if len(other) > 0 {
+					return &ConstraintError{b.ix.Name, userPath(cp), userPath(other)}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// return the first record other than 'cp' that has the token 'tok' in
+// the index bucket 'bu' and isn't skipped; "" if there's none. A record
+// that has expired doesn't hold on to its values.
+func (t *xact) owner(bu *bolt.Bucket, tok []byte, cp string, skip func(string) bool) (string, error) {
+	tb := bu.Bucket(tok)
+	if tb == nil {
+		return "", nil
+	}
+
+	cu := tb.Cursor()
+	for k, v := cu.First(); k != nil; k, v = cu.Next() {
+		pt, err := t.c.unsealPadded(v)
+		if err != nil {
+			return "", err
+		}
+
+		owner := string(pt)
+		if owner == cp || (skip != nil && skip(owner)) {
+			continue
+		}
+
+		exp, err := t.expiry(owner)
+		if err != nil {
+			return "", err
+		}
+		if !expired(exp) {
+			return owner, nil
+		}
+	}
+	return "", nil
+}
+
+// check the record 'cp' whose values are 'vals' against the unique index
+// 'ix' being built
+func (t *xact) checkBuild(ix *index, bu *bolt.Bucket, cp string, vals []string) error {
+	if !ix.Unique {
+		return nil
+	}
+
+	for _, val := range vals {
+		other, err := t.owner(bu, t.c.blindToken(ix.Name, val), cp, nil)
+		if err != nil {
+			return err
+		}
+		if len(other) > 0 {
+			return &ConstraintError{ix.Name, userPath(cp), userPath(other)}
+		}
+	}
+	return nil
+}
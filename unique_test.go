@@ -0,0 +1,169 @@
+// unique_test.go -- uniqueness constraint tests
+
+package ebolt_test
+
+import (
+	"encoding/json"
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestUnique(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  {},
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+	}
+
+	rec := func(email string) []byte {
+		b, _ := json.Marshal(&user{Email: email})
+		return b
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		ix := emailIndex()
+		ix.Unique = true
+		opt.Indexes = []ebolt.Index{ix}
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		violates := func(err error, key, conflict string) {
+			var ce *ebolt.ConstraintError
+
+			assert(errors.Is(err, ebolt.ErrConstraint), "%s: exp constraint error, saw %v", name, err)
+			assert(errors.As(err, &ce), "%s: not a constraint error: %v", name, err)
+			assert(ce.Index == "email" && ce.Key == key && ce.Conflict == conflict,
+				"%s: constraint: exp %s vs %s, saw %+v", name, key, conflict, ce)
+		}
+
+		err = db.Set("users/1", rec("alice"))
+		assert(err == nil, "%s: set: %s", name, err)
+		err = db.Set("users/2", rec("bob"))
+		assert(err == nil, "%s: set: %s", name, err)
+
+		err = db.Set("users/3", rec("alice"))
+		violates(err, "users/3", "users/1")
+		_, err = db.Get("users/3")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: get after violation: %v", name, err)
+
+		// a record keeps its own value
+		err = db.Set("users/1", rec("alice"))
+		assert(err == nil, "%s: set same: %s", name, err)
+
+		// values can trade places in one write
+		err = db.SetMany([]ebolt.KV{
+			{Key: "users/1", Val: rec("bob")},
+			{Key: "users/2", Val: rec("alice")},
+		})
+		assert(err == nil, "%s: swap: %s", name, err)
+
+		// a failed write leaves the transaction as it was
+		tx, err := db.BeginTransaction(true)
+		assert(err == nil, "%s: begin: %s", name, err)
+		err = tx.Set("users/5", rec("eve"))
+		assert(err == nil, "%s: tx set: %s", name, err)
+		err = tx.SetMany([]ebolt.KV{
+			{Key: "users/6", Val: rec("carol")},
+			{Key: "users/7", Val: rec("carol")},
+		})
+		violates(err, "users/7", "users/6")
+		err = tx.Commit()
+		assert(err == nil, "%s: commit: %s", name, err)
+
+		_, err = db.Get("users/5")
+		assert(err == nil, "%s: get: %s", name, err)
+		_, err = db.Get("users/6")
+		assert(errors.Is(err, ebolt.ErrNotFound), "%s: get after failed batch: %v", name, err)
+
+		// renaming a record doesn't conflict with itself; copying does
+		err = db.Rename("users/1", "users/8")
+		assert(err == nil, "%s: rename: %s", name, err)
+		err = db.Copy("users/8", "users/9")
+		violates(err, "users/9", "users/8")
+
+		err = db.Del("users/8")
+		assert(err == nil, "%s: del: %s", name, err)
+		err = db.Set("users/9", rec("bob"))
+		assert(err == nil, "%s: set freed value: %s", name, err)
+
+		got, err := db.Lookup("email", "bob")
+		assert(err == nil && len(got) == 1 && got[0] == "users/9", "%s: lookup: %v, %v", name, got, err)
+		db.Close()
+
+		// existing duplicates fail a new constraint
+		opt.Indexes = []ebolt.Index{emailIndex()}
+		db, err = newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: reopen: %s", name, err)
+		err = db.Set("users/10", rec("bob"))
+		assert(err == nil, "%s: set dup: %s", name, err)
+		db.Close()
+
+		opt.Indexes = []ebolt.Index{ix}
+		_, err = newBoltOpt(fn, "key", opt)
+		assert(errors.Is(err, ebolt.ErrConstraint), "%s: open with duplicates: %v", name, err)
+	}
+}
+
+func TestUniqueStale(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+	fn := path.Join(tmp, "unique-stale.db")
+
+	ix := emailIndex()
+	ix.Unique = true
+	byName := ebolt.Index{
+		Name:    "name",
+		Pattern: "users/*",
+		Extract: func(p string, val []byte) ([]string, error) {
+			var u user
+			err := json.Unmarshal(val, &u)
+			return []string{u.Name}, err
+		},
+	}
+
+	rec := func(email, name string) []byte {
+		b, _ := json.Marshal(&user{email, name})
+		return b
+	}
+
+	db, err := newBoltOpt(fn, "key", &ebolt.Config{Indexes: []ebolt.Index{ix, byName}})
+	assert(err == nil, "open: %s", err)
+	err = db.Set("users/1", rec("alice", "al"))
+	assert(err == nil, "set: %s", err)
+	db.Close()
+
+	// a handle that doesn't keep "name" fails a write on "email"
+	db, err = newBoltOpt(fn, "key", &ebolt.Config{Indexes: []ebolt.Index{ix}})
+	assert(err == nil, "open: %s", err)
+
+	tx, err := db.BeginTransaction(true)
+	assert(err == nil, "begin: %s", err)
+	err = tx.Set("users/2", rec("alice", "bob"))
+	assert(errors.Is(err, ebolt.ErrConstraint), "exp constraint error, saw %v", err)
+	err = tx.Commit()
+	assert(err == nil, "commit: %s", err)
+	db.Close()
+
+	// and leaves "name" as it was
+	opt := &ebolt.Config{
+		Indexes: []ebolt.Index{ix, byName},
+		Bolt:    &ebolt.Options{ReadOnly: true},
+	}
+	db, err = newBoltOpt(fn, "key", opt)
+	assert(err == nil, "open read-only: %s", err)
+	defer db.Close()
+
+	got, err := db.Lookup("name", "al")
+	assert(err == nil && len(got) == 1 && got[0] == "users/1", "lookup: %v, %v", got, err)
+}
@@ -0,0 +1,155 @@
+// walk.go -- recursive walks of a bucket hierarchy
+
+package ebolt
+
+import (
+	"fmt"
+	"io/fs"
+	"slices"
+	"strings"
+)
+
+// WalkFunc is called by Walk() for every bucket and record it visits;
+// 'isDir' is true for a bucket and 'val' is nil for it. Returning
+// fs.SkipDir for a bucket skips its contents; for a record, it skips
+// the rest of the records and buckets of its parent. Returning
+// fs.SkipAll stops the walk. Any other error stops the walk and is
+// returned by Walk().
+type WalkFunc func(p string, isDir bool, val []byte) error
+
+// WalkOptions control the buckets and records visited by Walk()
+type WalkOptions struct {
+	// MaxDepth is the deepest level below the starting bucket that's
+	// visited: 1 visits its own records and buckets alone. 0 visits
+	// every level.
+	MaxDepth int
+
+	// NoValues skips decrypting the values of records; the WalkFunc
+	// is called with a nil value for each.
+	NoValues bool
+}
+
+// Walk calls 'fn' for every bucket and record below the bucket 'p' - or
+// below the top of the db if 'p' is empty - in lexical order; a bucket
+// is visited before its contents. The walk happens inside the
+// transaction and sees a consistent view of the db.
+func (t *xact) Walk(p string, opt WalkOptions, fn WalkFunc) error {
+	var dir []string
+	if len(p) > 0 {
+		dir = strings.Split(p, "/")
+	}
+
+	n, err := t.nodeAt(dir)
+	if err != nil {
+		return &StorageError{"walk", p, boltErr(err)}
+	}
+	if n == nil {
+		if len(dir) == 0 {
+			return nil
+		}
+		return &StorageError{"walk", p, ErrBucketNotFound}
+	}
+
+	w := &walker{opt, fn}
+	err = w.walk(n, dir, 1)
+	if err == fs.SkipAll {
+		return nil
+	}
+	return err
+}
+
+type walker struct {
+	WalkOptions
+
+	fn WalkFunc
+}
+
+// visit the contents of the bucket 'n' at 'dir', which is at 'depth'
+// below the start of the walk
+func (w *walker) walk(n findNode, dir []string, depth int) error {
+	where := func(err error) error {
+		return &StorageError{"walk", dirPath(dir), err}
+	}
+
+	dirs, err := n.names(true)
+	if err != nil {
+		return where(err)
+	}
+
+	// the top-level records are visited as children of the top
+	ln, ldir := n, dir
+	if len(dir) == 0 {
+		dirs = slices.DeleteFunc(dirs, func(nm string) bool { return nm == ".root" })
+		ldir = []string{".root"}
+		if ln, err = n.sub(".root"); err != nil {
+			return where(err)
+		}
+	}
+
+	var leaves []string
+	if ln != nil {
+		if leaves, err = ln.names(false); err != nil {
+			return where(err)
+		}
+	}
+
+	slices.Sort(dirs)
+	slices.Sort(leaves)
+
+	// merge the two; a record comes before a bucket of the same name
+	for len(leaves) > 0 || len(dirs) > 0 {
+		if len(dirs) == 0 || (len(leaves) > 0 && leaves[0] <= dirs[0]) {
+			nm := leaves[0]
+			leaves = leaves[1:]
+
+			var val []byte
+			if !w.NoValues {
+				val, _, err = ln.read(nm)
+				if err == errExpired {
+					continue
+				}
+				if err != nil {
+					return where(err)
+				}
+				if val == nil {
+					return where(fmt.Errorf("%w: record %s is missing", ErrIntegrity, nm))
+				}
+			}
+
+			p := userPath(dirPath(append(slices.Clip(ldir), nm)))
+			if err = w.fn(p, false, val); err != nil {
+				if err == fs.SkipDir {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+
+		nm := dirs[0]
+		dirs = dirs[1:]
+
+		d := append(slices.Clip(dir), nm)
+		if err = w.fn(dirPath(d), true, nil); err != nil {
+			if err == fs.SkipDir {
+				continue
+			}
+			return err
+		}
+
+		if w.MaxDepth > 0 && depth >= w.MaxDepth {
+			continue
+		}
+
+		sub, err := n.sub(nm)
+		if err != nil {
+			return where(err)
+		}
+		if sub != nil {
+			if err = w.walk(sub, d, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
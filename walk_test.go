@@ -0,0 +1,143 @@
+// walk_test.go -- recursive walk tests
+
+package ebolt_test
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/opencoff/ebolt"
+)
+
+func TestWalk(t *testing.T) {
+	assert := newAsserter(t)
+
+	tmp := getTmpdir(t)
+
+	opts := map[string]*ebolt.Config{
+		"tree":  nil,
+		"flat":  {Flat: true},
+		"keyed": {KeyDepth: 1},
+	}
+
+	m := map[string][]byte{
+		"top":               randbytes(),
+		"users/1/email":     randbytes(),
+		"users/1/name":      randbytes(),
+		"users/2/email":     randbytes(),
+		"users/2/prefs/tz":  randbytes(),
+		"users/count":       randbytes(),
+		"sessions/2024/abc": randbytes(),
+	}
+
+	// everything in lexical order; a bucket before its contents
+	all := []string{
+		"sessions/", "sessions/2024/", "sessions/2024/abc",
+		"top",
+		"users/", "users/1/", "users/1/email", "users/1/name",
+		"users/2/", "users/2/email", "users/2/prefs/", "users/2/prefs/tz",
+		"users/count",
+	}
+
+	for name, opt := range opts {
+		fn := path.Join(tmp, name+".db")
+
+		db, err := newBoltOpt(fn, "key", opt)
+		assert(err == nil, "%s: open: %s", name, err)
+
+		for k, v := range m {
+			err = db.Set(k, v)
+			assert(err == nil, "%s: set %s: %s", name, k, err)
+		}
+
+		walk := func(p string, opt ebolt.WalkOptions, skip func(string, bool) error) []string {
+			var seen []string
+			err := db.View(func(tx ebolt.Tx) error {
+				return tx.Walk(p, opt, func(k string, isDir bool, val []byte) error {
+					if isDir {
+						assert(val == nil, "%s: walk %s: dir with a value", name, k)
+						seen = append(seen, k+"/")
+					} else {
+						if opt.NoValues {
+							assert(val == nil, "%s: walk %s: no-values with a value", name, k)
+						} else {
+							assert(bytes.Equal(val, m[k]), "%s: walk %s: content mismatch", name, k)
+						}
+						seen = append(seen, k)
+					}
+					if skip != nil {
+						return skip(k, isDir)
+					}
+					return nil
+				})
+			})
+			assert(err == nil, "%s: walk %s: %s", name, p, err)
+			return seen
+		}
+
+		got := walk("", ebolt.WalkOptions{}, nil)
+		assert(slices.Equal(got, all), "%s: walk: exp %v, saw %v", name, all, got)
+
+		got = walk("", ebolt.WalkOptions{NoValues: true}, nil)
+		assert(slices.Equal(got, all), "%s: walk no-values: exp %v, saw %v", name, all, got)
+
+		got = walk("users", ebolt.WalkOptions{}, nil)
+		exp := slices.DeleteFunc(slices.Clone(all), func(k string) bool {
+			return !strings.HasPrefix(k, "users/") || k == "users/"
+		})
+		assert(slices.Equal(got, exp), "%s: walk users: exp %v, saw %v", name, exp, got)
+
+		got = walk("users", ebolt.WalkOptions{MaxDepth: 1}, nil)
+		exp = []string{"users/1/", "users/2/", "users/count"}
+		assert(slices.Equal(got, exp), "%s: walk depth 1: exp %v, saw %v", name, exp, got)
+
+		got = walk("", ebolt.WalkOptions{}, func(k string, isDir bool) error {
+			if isDir && k == "users/2" {
+				return fs.SkipDir
+			}
+			return nil
+		})
+		exp = slices.DeleteFunc(slices.Clone(all), func(k string) bool {
+			return strings.HasPrefix(k, "users/2/") && k != "users/2/"
+		})
+		assert(slices.Equal(got, exp), "%s: walk skip-dir: exp %v, saw %v", name, exp, got)
+
+		// skip-dir on a record skips the rest of its bucket
+		got = walk("users/1", ebolt.WalkOptions{}, func(k string, isDir bool) error {
+			return fs.SkipDir
+		})
+		exp = []string{"users/1/email"}
+		assert(slices.Equal(got, exp), "%s: walk skip-dir leaf: exp %v, saw %v", name, exp, got)
+
+		got = walk("", ebolt.WalkOptions{}, func(k string, isDir bool) error {
+			if k == "top" {
+				return fs.SkipAll
+			}
+			return nil
+		})
+		exp = all[:4]
+		assert(slices.Equal(got, exp), "%s: walk skip-all: exp %v, saw %v", name, exp, got)
+
+		// errors of the callback are returned as is
+		stop := errors.New("stop")
+		err = db.View(func(tx ebolt.Tx) error {
+			return tx.Walk("users", ebolt.WalkOptions{}, func(string, bool, []byte) error {
+				return stop
+			})
+		})
+		assert(err == stop, "%s: walk: exp stop, saw %v", name, err)
+
+		err = db.View(func(tx ebolt.Tx) error {
+			return tx.Walk("nope", ebolt.WalkOptions{}, func(string, bool, []byte) error {
+				return nil
+			})
+		})
+		assert(errors.Is(err, ebolt.ErrBucketNotFound), "%s: walk missing: saw %v", name, err)
+		db.Close()
+	}
+}